@@ -0,0 +1,361 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/opt/export"
+	"github.com/microstacks/stack/endpoint/opt/import"
+	"github.com/microstacks/stack/endpoint/server"
+)
+
+/*
+ * Admin API, JSON over HTTP
+ *   GET  /imports                         - imports with their backends
+ *   GET  /exports                         - exports with their connections
+ *   GET  /forwards                        - forward listeners of the SSH server
+ *   POST /backends/disable?id=            - take backend out of rotation
+ *   POST /backends/enable?id=             - put backend back in rotation
+ *   POST /backends/drain?id=              - cancel forward, in-flight connections finish
+ *   POST /backends/disconnect?id=         - close the SSH connection of the backend
+ *   POST /exports/drain?rhost=[&timeout=] - stop reconnecting and drain connections
+ *   POST /exports/disconnect?rhost=       - stop reconnecting and disconnect
+ *   POST /reload                          - re-read config, start and stop changed services
+ *   GET  /events                          - NDJSON stream of router events
+ *
+ * The API is served on a unix socket only the router user can open, or on
+ * a TCP address. TCP addresses other than loopback require a token, which
+ * requests then carry as "Authorization: Bearer <token>".
+ */
+
+/*
+ * Error reply
+ */
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e apiError) Error() string {
+	return e.msg
+}
+
+func notFound(format string, args ...interface{}) error {
+	return apiError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+type handlerFunc func(r *http.Request) (interface{}, error)
+
+var errMethod = apiError{http.StatusMethodNotAllowed, "method not allowed"}
+
+/*
+ * Write error reply
+ */
+func replyError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if e, ok := err.(apiError); ok {
+		code = e.code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}); err != nil {
+		log.Debug("Admin: reply failed: ", err)
+	}
+}
+
+/*
+ * Restrict handler to method and encode its reply as JSON
+ */
+func handle(method string, fn handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			replyError(w, errMethod)
+			return
+		}
+
+		v, err := fn(r)
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Debug("Admin: reply failed: ", err)
+		}
+	})
+}
+
+/*
+ * Stream events as NDJSON until the client goes away.
+ * Events are dropped while the client does not keep up.
+ */
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		replyError(w, errMethod)
+		return
+	}
+
+	c, cancel := events.Subscribe(256)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-c:
+			if err := enc.Encode(e); err != nil {
+				log.Debug("Admin: event stream closed: ", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+/*
+ * Required query parameter
+ */
+func param(r *http.Request, name string) (string, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return "", badRequest("missing %s", name)
+	}
+	return value, nil
+}
+
+/*
+ * Backend action, fn reports whether the backend exists
+ */
+func backend(fn func(id string) bool) handlerFunc {
+	return func(r *http.Request) (interface{}, error) {
+		id, err := param(r, "id")
+		if err != nil {
+			return nil, err
+		}
+
+		if !fn(id) {
+			return nil, notFound("backend %s not found", id)
+		}
+		return map[string]string{"id": id}, nil
+	}
+}
+
+func handler(timeout time.Duration, reload func() error) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/imports", handle("GET", func(r *http.Request) (interface{}, error) {
+		return Import.ListStatus(), nil
+	}))
+
+	mux.Handle("/exports", handle("GET", func(r *http.Request) (interface{}, error) {
+		return Export.ListStatus(), nil
+	}))
+
+	mux.Handle("/forwards", handle("GET", func(r *http.Request) (interface{}, error) {
+		return server.Forwards(), nil
+	}))
+
+	mux.Handle("/backends/disable", handle("POST", backend(Import.DisableBackend)))
+	mux.Handle("/backends/enable", handle("POST", backend(Import.EnableBackend)))
+	mux.Handle("/backends/drain", handle("POST", backend(server.CancelForward)))
+	mux.Handle("/backends/disconnect", handle("POST", backend(server.Disconnect)))
+
+	mux.Handle("/exports/drain", handle("POST", func(r *http.Request) (interface{}, error) {
+		rhost, err := param(r, "rhost")
+		if err != nil {
+			return nil, err
+		}
+
+		d := timeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			if d, err = time.ParseDuration(value); err != nil {
+				return nil, badRequest("timeout: %s", err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		ok, err := Export.DrainHost(ctx, rhost)
+		if !ok {
+			return nil, notFound("no export to %s", rhost)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"rhost": rhost}, nil
+	}))
+
+	mux.Handle("/exports/disconnect", handle("POST", func(r *http.Request) (interface{}, error) {
+		rhost, err := param(r, "rhost")
+		if err != nil {
+			return nil, err
+		}
+
+		if !Export.DisconnectHost(rhost) {
+			return nil, notFound("no export to %s", rhost)
+		}
+		return map[string]string{"rhost": rhost}, nil
+	}))
+
+	mux.Handle("/reload", handle("POST", func(r *http.Request) (interface{}, error) {
+		if err := reload(); err != nil {
+			return nil, err
+		}
+		return map[string]bool{"reloaded": true}, nil
+	}))
+
+	mux.HandleFunc("/events", streamEvents)
+
+	return mux
+}
+
+/*
+ * Reject requests without the bearer token, if any
+ */
+func authorize(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			replyError(w, apiError{http.StatusUnauthorized, "invalid or missing token"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+/*
+ * TCP address only reachable from this host
+ */
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+ * Listen on a TCP address or on unix:/path.
+ * TCP addresses other than loopback are refused without a token.
+ */
+func listen(addr string, token string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		if token == "" && !isLoopback(addr) {
+			return nil, fmt.Errorf("admin API on %s requires a token, listen on loopback or unix:/path instead", addr)
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	return listenUnix(strings.TrimPrefix(addr, "unix:"))
+}
+
+/*
+ * Time a socket at the admin path gets to answer before it counts as stale
+ */
+const dialTimeout = time.Second
+
+/*
+ * Listen on unix socket path, only accessible by the owner.
+ * The socket is bound in a private directory and moved to path once
+ * its permissions are set. Only a socket left behind by a previous
+ * run is replaced, one that answers belongs to a running router.
+ */
+func listenUnix(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		conn, err := net.DialTimeout("unix", path, dialTimeout)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another router", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// Removed with dir, the socket at path stays until the next run
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+/*
+ * Serve admin API on addr, blocks until the server fails.
+ * Requests must carry token unless it is empty,
+ * timeout bounds export drains that do not pass their own,
+ * reload is called by POST /reload.
+ */
+func Serve(addr string, token string, timeout time.Duration, reload func() error) error {
+	l, err := listen(addr, token)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Admin API listening on ", l.Addr())
+	return http.Serve(l, authorize(token, handler(timeout, reload)))
+}
@@ -0,0 +1,270 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/events"
+)
+
+func noReload() error {
+	return errors.New("no config file")
+}
+
+func TestErrors(t *testing.T) {
+	h := handler(time.Second, noReload)
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{"POST", "/imports", http.StatusMethodNotAllowed},
+		{"GET", "/backends/disable?id=x", http.StatusMethodNotAllowed},
+		{"POST", "/backends/disable", http.StatusBadRequest},
+		{"POST", "/backends/disable?id=x", http.StatusNotFound},
+		{"POST", "/backends/drain?id=x", http.StatusNotFound},
+		{"POST", "/exports/drain?rhost=lb&timeout=x", http.StatusBadRequest},
+		{"POST", "/exports/disconnect?rhost=lb", http.StatusNotFound},
+		{"GET", "/reload", http.StatusMethodNotAllowed},
+		{"POST", "/reload", http.StatusInternalServerError},
+		{"POST", "/events", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(test.method, test.url, nil))
+
+		var reply map[string]string
+		json.NewDecoder(rec.Body).Decode(&reply)
+
+		if rec.Code != test.code || reply["error"] == "" {
+			t.Error(
+				"For", test.method, test.url,
+				"expected", test.code,
+				"got", rec.Code, reply,
+			)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	h := handler(time.Second, noReload)
+
+	for _, url := range []string{"/imports", "/exports", "/forwards"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+
+		var reply []interface{}
+		err := json.NewDecoder(rec.Body).Decode(&reply)
+		if rec.Code != http.StatusOK || err != nil || reply == nil {
+			t.Error(
+				"For", url,
+				"expected", "empty list",
+				"got", rec.Code, err,
+			)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	reloaded := 0
+	h := handler(time.Second, func() error {
+		reloaded++
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/reload", nil))
+
+	if rec.Code != http.StatusOK || reloaded != 1 {
+		t.Error(
+			"For", "/reload",
+			"expected", 1,
+			"got", rec.Code, reloaded,
+		)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	// Files other than sockets are left alone
+	ioutil.WriteFile(path, nil, 0600)
+	if _, err := listen("unix:"+path, ""); err == nil {
+		t.Error(
+			"For", "regular file",
+			"expected", "error",
+			"got", err,
+		)
+	}
+	os.Remove(path)
+
+	// Stale socket is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Error(
+			"For", path,
+			"expected", "mode 0600",
+			"got", info, err,
+		)
+	}
+	go http.Serve(l, handler(time.Second, noReload))
+
+	c := http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+		DisableKeepAlives: true,
+	}}
+
+	resp, err := c.Get("http://admin/imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error(
+			"For", path,
+			"expected", http.StatusOK,
+			"got", resp.StatusCode,
+		)
+	}
+
+	// Socket of a running router is not taken over
+	if other, err := listen("unix:"+path, ""); err == nil {
+		other.Close()
+		t.Error(
+			"For", "live socket",
+			"expected", "error",
+			"got", err,
+		)
+	}
+
+	resp, err = c.Get("http://admin/imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestEvents(t *testing.T) {
+	srv := httptest.NewServer(handler(time.Second, noReload))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Error(
+			"For", "/events",
+			"expected", "application/x-ndjson",
+			"got", ct,
+		)
+	}
+
+	// Headers are flushed once subscribed
+	events.Publish(events.Event{Type: events.ChildRestarted, Pid: 7})
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		var e events.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.Type != events.ChildRestarted || e.Pid != 7 {
+			t.Error(
+				"For", "/events",
+				"expected", events.ChildRestarted,
+				"got", line,
+			)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("For", "/events", "expected", "event", "got", "timeout")
+	}
+}
+
+func TestToken(t *testing.T) {
+	for addr, allowed := range map[string]bool{
+		"127.0.0.1:0": true,
+		"[::1]:0":     true,
+		"localhost:0": true,
+		":0":          false,
+		"0.0.0.0:0":   false,
+	} {
+		l, err := listen(addr, "")
+		if l != nil {
+			l.Close()
+		}
+		if (err == nil) != allowed {
+			t.Error(
+				"For", addr,
+				"expected", allowed,
+				"got", err,
+			)
+		}
+	}
+
+	// Any address with a token, every request carries it
+	l, err := listen(":0", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	h := authorize("secret", handler(time.Second, noReload))
+	for header, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer other":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/imports", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Error(
+				"For", header,
+				"expected", expected,
+				"got", rec.Code,
+			)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/microstacks/stack/endpoint/omap"
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+/*
+ * Load balancing strategies selectable with lb=<strategy>
+ */
+const (
+	RoundRobin         = "rr"
+	LeastConn          = "leastconn"
+	WeightedRoundRobin = "wrr"
+	TwoChoices         = "p2c"
+	Hash               = "hash"
+)
+
+/*
+ * Balancer picks the backend for an incoming connection.
+ * Done must be called with the picked element once the connection ends.
+ */
+type Balancer interface {
+	Next(src net.Addr) *omap.Element
+	Done(e *omap.Element)
+}
+
+/*
+ * New balancer for the backends in m.
+ */
+func New(strategy string, m *omap.OMap) (Balancer, error) {
+	switch strategy {
+	case "", RoundRobin:
+		return roundRobin{m}, nil
+	case LeastConn:
+		return &leastConn{m: m}, nil
+	case WeightedRoundRobin:
+		return &weighted{m: m, current: make(map[*omap.Element]int)}, nil
+	case TwoChoices:
+		return &twoChoices{leastConn{m: m}}, nil
+	case Hash:
+		return hashed{m}, nil
+	}
+
+	return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+}
+
+/*
+ * Round robin over the ordered map.
+ */
+type roundRobin struct {
+	*omap.OMap
+}
+
+func (r roundRobin) Next(src net.Addr) *omap.Element {
+	return r.OMap.Next()
+}
+
+func (r roundRobin) Done(e *omap.Element) {
+}
+
+/*
+ * Active connection counters shared by least-connections and two-choices.
+ * A backend keeps its counter until it is removed from the map.
+ */
+type active struct {
+	mu     sync.Mutex
+	counts map[*omap.Element]int64
+}
+
+/*
+ * Count a connection to e, must be called with mu held.
+ * Counters of removed backends are dropped first.
+ */
+func (a *active) acquire(m *omap.OMap, e *omap.Element) *omap.Element {
+	if e == nil {
+		return nil
+	}
+
+	if a.counts == nil {
+		a.counts = make(map[*omap.Element]int64)
+	}
+	if len(a.counts) >= m.Len() {
+		for el := range a.counts {
+			if m.Get(el.Key()) != el {
+				delete(a.counts, el)
+			}
+		}
+	}
+
+	a.counts[e]++
+	return e
+}
+
+func (a *active) Done(e *omap.Element) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n, ok := a.counts[e]; ok && n > 0 {
+		a.counts[e] = n - 1
+	}
+}
+
+/*
+ * Least connections, ties rotate like round robin.
+ */
+type leastConn struct {
+	active
+	m    *omap.OMap
+	next uint64
+}
+
+func (l *leastConn) Next(src net.Addr) *omap.Element {
+	els := l.m.Elements()
+	if len(els) == 0 {
+		return nil
+	}
+
+	// Start at a rotating offset so equally loaded backends take turns
+	start := atomic.AddUint64(&l.next, 1) - 1
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var best *omap.Element
+	var min int64
+	for n := range els {
+		e := els[(start+uint64(n))%uint64(len(els))]
+		if c := l.counts[e]; best == nil || c < min {
+			best, min = e, c
+		}
+	}
+
+	return l.acquire(l.m, best)
+}
+
+/*
+ * Power of two random choices, the less loaded of two random backends.
+ */
+type twoChoices struct {
+	leastConn
+}
+
+func (p *twoChoices) Next(src net.Addr) *omap.Element {
+	els := p.m.Elements()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch len(els) {
+	case 0:
+		return nil
+	case 1:
+		return p.acquire(p.m, els[0])
+	}
+
+	a := rand.Intn(len(els))
+	b := rand.Intn(len(els) - 1)
+	if b >= a {
+		b++
+	}
+
+	if p.counts[els[b]] < p.counts[els[a]] {
+		a = b
+	}
+
+	return p.acquire(p.m, els[a])
+}
+
+/*
+ * Smooth weighted round robin, weights come from utils.Host.Weight.
+ */
+type weighted struct {
+	mu      sync.Mutex
+	m       *omap.OMap
+	current map[*omap.Element]int
+}
+
+func weight(e *omap.Element) int {
+	if h, ok := e.Value.(*utils.Host); ok && h.Weight > 0 {
+		return int(h.Weight)
+	}
+	return 1
+}
+
+func (w *weighted) Next(src net.Addr) *omap.Element {
+	els := w.m.Elements()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Forget removed backends.
+	if len(w.current) > len(els) {
+		live := make(map[*omap.Element]int, len(els))
+		for _, e := range els {
+			live[e] = w.current[e]
+		}
+		w.current = live
+	}
+
+	var best *omap.Element
+	total := 0
+	for _, e := range els {
+		wt := weight(e)
+		total += wt
+		w.current[e] += wt
+		if best == nil || w.current[e] > w.current[best] {
+			best = e
+		}
+	}
+
+	if best != nil {
+		w.current[best] -= total
+	}
+
+	return best
+}
+
+func (w *weighted) Done(e *omap.Element) {
+}
+
+/*
+ * Consistent hashing on client IP using rendezvous hashing, so only the
+ * clients of an added or removed backend move.
+ */
+type hashed struct {
+	m *omap.OMap
+}
+
+/*
+ * Identity of a backend surviving reconnects of the same exporter: the
+ * address it connects from, the address of its instance and the port it
+ * forwards. Keys change with every SSH session.
+ */
+func identity(e *omap.Element) string {
+	if h, ok := e.Value.(*utils.Host); ok {
+		return fmt.Sprintf("%s/%s:%d", h.RemoteIP, h.LocalIP, h.RemotePort)
+	}
+	return e.Key()
+}
+
+func (c hashed) Next(src net.Addr) *omap.Element {
+	ip := ""
+	if src != nil {
+		ip, _, _ = net.SplitHostPort(src.String())
+	}
+
+	var best *omap.Element
+	var max uint64
+
+	for _, e := range c.m.Elements() {
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte{0})
+		h.Write([]byte(identity(e)))
+		if sum := h.Sum64(); best == nil || sum > max {
+			best, max = e, sum
+		}
+	}
+
+	return best
+}
+
+func (c hashed) Done(e *omap.Element) {
+}
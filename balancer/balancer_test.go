@@ -0,0 +1,247 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/microstacks/stack/endpoint/omap"
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+func initData(weights ...uint32) *omap.OMap {
+	m := omap.New()
+
+	for idx, w := range weights {
+		h := &utils.Host{
+			ID:         fmt.Sprint(idx),
+			RemoteIP:   fmt.Sprintf("10.0.0.%d", idx+1),
+			RemotePort: 8000,
+			Weight:     w,
+		}
+		m.Add(h.ID, h)
+	}
+
+	return m
+}
+
+func client(n int) net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 168, 1, byte(n)), Port: 40000 + n}
+}
+
+func TestUnknown(t *testing.T) {
+	if _, err := New("fastest", omap.New()); err == nil {
+		t.Error(
+			"For", "fastest",
+			"expected", "error",
+			"got", nil,
+		)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for _, s := range []string{RoundRobin, LeastConn, WeightedRoundRobin, TwoChoices, Hash} {
+		b, err := New(s, omap.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if el := b.Next(client(1)); el != nil {
+			t.Error(
+				"For", s,
+				"expected", nil,
+				"got", el,
+			)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, _ := New(RoundRobin, initData(1, 1, 1))
+
+	for round := 0; round < 2; round++ {
+		for idx := 0; idx < 3; idx++ {
+			el := b.Next(client(1))
+			if el.Key() != fmt.Sprint(idx) {
+				t.Error(
+					"For", idx,
+					"expected", idx,
+					"got", el.Key(),
+				)
+			}
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	b, _ := New(LeastConn, initData(1, 1))
+
+	first := b.Next(client(1))
+	second := b.Next(client(1))
+	if first == second {
+		t.Error(
+			"For", "busy backend",
+			"expected", "different backend",
+			"got", second.Key(),
+		)
+	}
+
+	// Releasing the first backend makes it the least loaded again.
+	b.Done(first)
+	if el := b.Next(client(1)); el != first {
+		t.Error(
+			"For", "released backend",
+			"expected", first.Key(),
+			"got", el.Key(),
+		)
+	}
+}
+
+func TestLeastConnTies(t *testing.T) {
+	b, _ := New(LeastConn, initData(1, 1, 1))
+
+	// Idle backends take turns
+	picked := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		el := b.Next(client(1))
+		picked[el.Key()] = true
+		b.Done(el)
+	}
+
+	if len(picked) != 3 {
+		t.Error(
+			"For", "equally loaded backends",
+			"expected", "all 3 picked",
+			"got", picked,
+		)
+	}
+}
+
+func TestLeastConnRemoved(t *testing.T) {
+	m := initData(1, 1)
+	b, _ := New(LeastConn, m)
+	l := b.(*leastConn)
+
+	for i := 0; i < 4; i++ {
+		b.Next(client(1))
+	}
+
+	// Counters live as long as their backend, not their connections
+	el := m.Get("0")
+	b.Done(el)
+	b.Done(el)
+	if n, ok := l.counts[el]; !ok || n != 0 {
+		t.Error(
+			"For", "idle backend",
+			"expected", "counter 0",
+			"got", n, ok,
+		)
+	}
+
+	m.Remove("0")
+	b.Next(client(1))
+	if _, ok := l.counts[el]; ok || len(l.counts) != 1 {
+		t.Error(
+			"For", "removed backend",
+			"expected", "counter dropped",
+			"got", l.counts,
+		)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	b, _ := New(WeightedRoundRobin, initData(3, 1))
+
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[b.Next(client(1)).Key()]++
+	}
+
+	if counts["0"] != 30 || counts["1"] != 10 {
+		t.Error(
+			"For", "weights 3:1",
+			"expected", "30:10",
+			"got", counts,
+		)
+	}
+}
+
+func TestTwoChoices(t *testing.T) {
+	m := initData(1, 1)
+	b, _ := New(TwoChoices, m)
+
+	// With two backends both are sampled, so the idle one always wins.
+	busy := b.Next(client(1))
+	for i := 0; i < 10; i++ {
+		el := b.Next(client(1))
+		if el == busy {
+			t.Error(
+				"For", "busy backend",
+				"expected", "idle backend",
+				"got", el.Key(),
+			)
+		}
+		b.Done(el)
+	}
+}
+
+func TestHashSticky(t *testing.T) {
+	m := initData(1, 1, 1, 1)
+	b, _ := New(Hash, m)
+
+	picked := make(map[int]string)
+	for n := 0; n < 32; n++ {
+		picked[n] = b.Next(client(n)).Key()
+	}
+
+	for n := 0; n < 32; n++ {
+		if el := b.Next(client(n)); el.Key() != picked[n] {
+			t.Error(
+				"For", client(n),
+				"expected", picked[n],
+				"got", el.Key(),
+			)
+		}
+	}
+
+	// Removing a backend only moves its own clients.
+	m.Remove("3")
+	for n := 0; n < 32; n++ {
+		if picked[n] == "3" {
+			continue
+		}
+		if el := b.Next(client(n)); el.Key() != picked[n] {
+			t.Error(
+				"For", client(n),
+				"expected", picked[n],
+				"got", el.Key(),
+			)
+		}
+	}
+}
+
+func TestHashReconnect(t *testing.T) {
+	m := initData(1, 1, 1, 1)
+	b, _ := New(Hash, m)
+
+	picked := make(map[int]string)
+	for n := 0; n < 32; n++ {
+		picked[n] = b.Next(client(n)).Value.(*utils.Host).RemoteIP
+	}
+
+	// Same exporter in a new SSH session, from another source port
+	h := *m.Get("2").Value.(*utils.Host)
+	h.ID = "2-reconnected"
+	m.Remove("2")
+	m.Add(h.ID, &h)
+
+	for n := 0; n < 32; n++ {
+		if ip := b.Next(client(n)).Value.(*utils.Host).RemoteIP; ip != picked[n] {
+			t.Error(
+				"For", client(n),
+				"expected", picked[n],
+				"got", ip,
+			)
+		}
+	}
+}
@@ -4,23 +4,161 @@ import (
 	"fmt"
 	"io"
 	"net"
-    "os"
+    "io/ioutil"
+    "strings"
+    "sync"
+    "context"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+    "github.com/microstacks/stack/endpoint/events"
+    "github.com/microstacks/stack/endpoint/metrics"
+    "github.com/microstacks/stack/endpoint/router"
     "github.com/microstacks/stack/endpoint/utils"
     "github.com/prometheus/common/log"
 )
 
 
 type Connection struct {
-    l net.Listener
+    l net.Listener // nil for UDP forwards
     c *ssh.Client
+    addr string    // forwarded address on the router
+    active utils.WaitGroup // in-flight proxied connections
 }
 
 /*
- * Connection store
+ * Connection as listed by the admin API
  */
-var clients map[string]*Connection = make(map[string]*Connection, 1)
+type Status struct {
+    Hash   string `json:"hash"`
+    Remote string `json:"remote"` // address of the router
+    Listen string `json:"listen"` // forwarded address on the router
+}
+
+/*
+ * Authentication settings used to log into remote SSH servers, the password
+ * is the one of the router. Host keys are verified against KnownHosts and/or Fingerprints,
+ * when neither is set connections fail unless InsecureHostKey is set.
+ */
+type Auth struct {
+    IdentityFile    string   // Private key file for public key authentication
+    KnownHosts      string   // known_hosts file used to verify the router host key
+    Fingerprints    []string // Pinned SHA256 host key fingerprints
+    InsecureHostKey bool     // Accept any host key when nothing to verify it against is set
+}
+
+/*
+ * Build ssh auth methods, public key is preferred over password.
+ * Password authentication is skipped when password is empty.
+ */
+func (a Auth) methods(password string) ([]ssh.AuthMethod, error) {
+    var methods []ssh.AuthMethod
+
+    if a.IdentityFile != "" {
+        key, err := ioutil.ReadFile(a.IdentityFile)
+        if err != nil {
+            return nil, err
+        }
+
+        signer, err := ssh.ParsePrivateKey(key)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", a.IdentityFile, err)
+        }
+        methods = append(methods, ssh.PublicKeys(signer))
+    }
+
+    if password != "" {
+        methods = append(methods, ssh.Password(password))
+    }
+
+    if len(methods) == 0 {
+        return nil, fmt.Errorf("ssh client: no authentication method configured")
+    }
+
+    return methods, nil
+}
+
+/*
+ * Build host key callback, all configured checks must pass.
+ */
+func (a Auth) hostKeyCallback() (ssh.HostKeyCallback, error) {
+    var checks []ssh.HostKeyCallback
+
+    if a.KnownHosts != "" {
+        cb, err := knownhosts.New(a.KnownHosts)
+        if err != nil {
+            return nil, err
+        }
+        checks = append(checks, cb)
+    }
+
+    if len(a.Fingerprints) > 0 {
+        pinned := make(map[string]bool, len(a.Fingerprints))
+        for _, fp := range a.Fingerprints {
+            if !strings.HasPrefix(fp, "SHA256:") {
+                fp = "SHA256:" + fp
+            }
+            pinned[fp] = true
+        }
+
+        checks = append(checks, func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+            fp := ssh.FingerprintSHA256(key)
+            if !pinned[fp] {
+                return fmt.Errorf("ssh: host key fingerprint %s for %s is not pinned", fp, hostname)
+            }
+            return nil
+        })
+    }
+
+    if len(checks) == 0 {
+        if !a.InsecureHostKey {
+            return nil, fmt.Errorf("ssh client: no known hosts or host fingerprint to verify the router host key")
+        }
+        log.Debug("SSH Client: Host key verification disabled")
+        return ssh.InsecureIgnoreHostKey(), nil
+    }
+
+    return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+        for _, check := range checks {
+            if err := check(hostname, remote, key); err != nil {
+                return err
+            }
+        }
+        return nil
+    }, nil
+}
+
+/*
+ * Cancel the remote forward, UDP forwards end with the SSH connection.
+ */
+func (c *Connection) stopForward() {
+    if c.l != nil {
+        c.l.Close()
+    }
+}
+
+func (c *Connection) close() {
+    c.stopForward()
+    c.c.Close()
+}
+
+/*
+ * Connection store of a router keyed by hash
+ */
+type Clients struct {
+    mu      sync.Mutex
+    clients map[string]*Connection
+    active  utils.WaitGroup // in-flight proxied connections
+}
+
+func New() *Clients {
+    return &Clients{clients: make(map[string]*Connection, 1)}
+}
+
+/*
+ * Connections of the endpoint command, used by the package-level functions
+ */
+var Default = New()
 
 func handleClient(client net.Conn, remote net.Conn) {
 	defer client.Close()
@@ -47,52 +185,124 @@ func handleClient(client net.Conn, remote net.Conn) {
 	<-chDone
 }
 
-func Connect(u string, pass string, rhost string, lport uint32, rport uint32, hash string, debug bool) error {
+/*
+ * Log into router rhost as user u and announce the load balancing weight.
+ */
+func dial(r *router.Router, u string, auth Auth, rhost string, weight uint32) (*ssh.Client, error) {
+
+    methods, err := auth.methods(r.Password)
+    if err != nil {
+        return nil, err
+    }
+
+    hostKeyCallback, err := auth.hostKeyCallback()
+    if err != nil {
+        return nil, err
+    }
 
 	sshConfig := &ssh.ClientConfig{
 		User: u,
-		Auth: []ssh.AuthMethod{
-        ssh.Password(pass),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth: methods,
+		HostKeyCallback: hostKeyCallback,
 	}
 
     // remote SSH server
     var serverEndpoint = utils.Endpoint{
         Host: rhost,
-        Port: 22,
-    }
-    
-	// Listen on remote server port
-    bindAddr := os.Getenv("BINDADDR")
-    
-    // remote forwarding port (on remote SSH server)
-    var serviceEndpoint = utils.Endpoint{
-        Host: bindAddr,
-        Port: rport,
+        Port: r.RemotePort(),
     }
 
-    
     fmt.Println("SSH Client: Initiating connection to ", serverEndpoint.String())
     // Connect to SSH remote server using serverEndpoint    
     conn, err := ssh.Dial("tcp", serverEndpoint.String(), sshConfig)
 	if err != nil {
 		log.Debug(fmt.Printf("Dial INTO remote server error: %s", err))
-        return err
+        metrics.DialFailures.WithLabelValues("router").Inc()
+        return nil, err
 	}
+
+    metrics.ClientConnections.Inc()
+    go func() {
+        conn.Wait()
+        metrics.ClientConnections.Dec()
+    }()
     
+    // Announce load balancing weight before forwarding
+    if weight > 0 {
+        ok, _, err := conn.SendRequest(utils.BackendWeightRequest, true, ssh.Marshal(struct{ Weight uint32 }{weight}))
+        if err != nil || !ok {
+            log.Debug("SSH Client: Remote server ignored weight ", weight, err)
+        }
+    }
+
+    return conn, nil
+}
+
+/*
+ * Dial the service on lport from the origin address of a forwarded
+ * connection, on r.BindAddr6 if it does not answer on r.BindAddr as it
+ * may listen on IPv6 only. IPv4 origins are lost on IPv6.
+ */
+func dialService(r *router.Router, network string, origin net.IP, lport uint32) (net.Conn, error) {
+    d := net.Dialer{LocalAddr: localAddr(network, origin)}
+    local, err := d.Dial(network, (&utils.Endpoint{Host: r.BindAddr, Port: lport}).String())
+    if err == nil || r.BindAddr6 == "" {
+        return local, err
+    }
+
+    if origin.To4() != nil {
+        d.LocalAddr = nil
+    }
+    return d.Dial(network, (&utils.Endpoint{Host: r.BindAddr6, Port: lport}).String())
+}
+
+func localAddr(network string, IP net.IP) net.Addr {
+    if network == "udp" {
+        return &net.UDPAddr{IP: IP}
+    }
+    return &net.TCPAddr{IP: IP}
+}
+
+/*
+ * Connect to router rhost as user u and forward rport on it to lport.
+ * The forward is requested on r.BindAddr, the address the service binds to.
+ */
+func (cs *Clients) Connect(r *router.Router, u string, auth Auth, rhost string, lport uint32, rport uint32, weight uint32, hash string) error {
+
+    conn, err := dial(r, u, auth, rhost, weight)
+    if err != nil {
+        return err
+    }
+
+    // remote SSH server
+    var serverEndpoint = utils.Endpoint{
+        Host: rhost,
+        Port: r.RemotePort(),
+    }
+
+    // remote forwarding port (on remote SSH server)
+    var serviceEndpoint = utils.Endpoint{
+        Host: r.BindAddr,
+        Port: rport,
+    }
+
     // Listen on remote server port
     listener, err := conn.Listen("tcp", serviceEndpoint.String())
     if err != nil {
         log.Debug(fmt.Printf("Listen open port ON remote server error: %s", err))
+        conn.Close()
         return err
     }
 
     fmt.Println("SSH Client: Listening connection on ", serverEndpoint.String(), 
                 "@", serverEndpoint.String())
     // Store channel in connection store for easy retival.
-    
-    clients[hash] = &Connection{l: listener, c: conn}
+    connection := &Connection{l: listener, c: conn, addr: listener.Addr().String()}
+
+    cs.mu.Lock()
+    cs.clients[hash] = connection
+    cs.mu.Unlock()
+    r.Publish(events.Event{Type: events.ExportConnected, Service: u, Remote: rhost})
 
 
     go func(){
@@ -102,14 +312,23 @@ func Connect(u string, pass string, rhost string, lport uint32, rport uint32, ha
             remote, err := listener.Accept()
             if err != nil {
                 log.Debug("SSH Client: Remote Listener closed on ", serverEndpoint.String(), " with ", err)
-                delete(clients, hash)
-                log.Debug("SSH Client: clients ", clients)
+                cs.mu.Lock()
+                if cs.clients[hash] == connection {
+                    delete(cs.clients, hash)
+                }
+                cs.mu.Unlock()
+                r.Publish(events.Event{Type: events.ExportDisconnected, Service: u, Remote: rhost})
                 return
             }
 
             fmt.Println("SSH Client: Incoming connection on ", remote.LocalAddr().String(), 
                         " from ", listener.Addr().String())
+            cs.active.Add(1)
+            connection.active.Add(1)
             go func(remote net.Conn) {
+                defer cs.active.Done()
+                defer connection.active.Done()
+
                 rhost, _, err := utils.GetHostPort(remote.RemoteAddr()) 
                 if err != nil {
                     log.Debug(err)
@@ -118,19 +337,11 @@ func Connect(u string, pass string, rhost string, lport uint32, rport uint32, ha
 
                 ip := net.ParseIP(rhost)
 
-                tcpAddr := &net.TCPAddr {
-                    IP: ip,
-                }   
-
-                d := net.Dialer{LocalAddr: tcpAddr}
-
-                // Service Port at remote container
-                serviceEndpoint.Port = lport
-
-                fmt.Println("SSH Client: Connecting to ", serviceEndpoint.String())
-                local, err := d.Dial("tcp", serviceEndpoint.String())
+                fmt.Println("SSH Client: Connecting to ", (&utils.Endpoint{Host: r.BindAddr, Port: lport}).String())
+                local, err := dialService(r, "tcp", ip, lport)
                 if err != nil {
                     log.Debug(fmt.Printf("Dial INTO local service error: %s", err))
+                    metrics.DialFailures.WithLabelValues("service").Inc()
                     remote.Close()
                     return
                 }		
@@ -149,8 +360,10 @@ func Connect(u string, pass string, rhost string, lport uint32, rport uint32, ha
 /*
  * Check if client is already connected
  */
-func IsConnected(hash string) bool {
-    _, ok := clients[hash]
+func (cs *Clients) IsConnected(hash string) bool {
+    cs.mu.Lock()
+    _, ok := cs.clients[hash]
+    cs.mu.Unlock()
     
     if ok {
         return true
@@ -162,13 +375,104 @@ func IsConnected(hash string) bool {
 /*
  * Diconnect client
  */
-func Disconnect(hash string) {
-    connection := clients[hash]
+func (cs *Clients) Disconnect(hash string) {
+    cs.mu.Lock()
+    connection := cs.clients[hash]
+    delete(cs.clients, hash)
+    cs.mu.Unlock()
 
     if connection != nil {
         fmt.Println("Request: Closing connections ", connection)
-        connection.l.Close()
+        connection.close()
+    }
+}
+
+/*
+ * List connected clients
+ */
+func (cs *Clients) Connections() []Status {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    status := make([]Status, 0, len(cs.clients))
+    for hash, connection := range cs.clients {
+        status = append(status, Status{
+            Hash:   hash,
+            Remote: connection.c.RemoteAddr().String(),
+            Listen: connection.addr,
+        })
+    }
+
+    return status
+}
+
+/*
+ * Drain a single client.
+ * The remote forward is cancelled, in-flight connections may finish
+ * until ctx is done, then the SSH connection is closed.
+ */
+func (cs *Clients) DrainConnection(ctx context.Context, hash string) error {
+    cs.mu.Lock()
+    connection := cs.clients[hash]
+    delete(cs.clients, hash)
+    cs.mu.Unlock()
+
+    if connection == nil {
+        return nil
+    }
+
+    connection.stopForward()
+    err := connection.active.Wait(ctx)
+    connection.c.Close()
+
+    return err
+}
+
+/*
+ * Drain all clients.
+ * Remote forwards are cancelled right away so the router stops sending new
+ * connections, in-flight connections may finish until ctx is done, then the
+ * SSH connections are closed.
+ */
+func (cs *Clients) Drain(ctx context.Context) error {
+    cs.mu.Lock()
+    drained := cs.clients
+    cs.clients = make(map[string]*Connection, 1)
+    cs.mu.Unlock()
+
+    for _, connection := range drained {
+        connection.stopForward()
+    }
+
+    err := cs.active.Wait(ctx)
+
+    for _, connection := range drained {
         connection.c.Close()
-        delete(clients, hash)
     }
+
+    return err
+}
+
+func Connect(r *router.Router, u string, auth Auth, rhost string, lport uint32, rport uint32, weight uint32, hash string) error {
+    return Default.Connect(r, u, auth, rhost, lport, rport, weight, hash)
+}
+
+func IsConnected(hash string) bool {
+    return Default.IsConnected(hash)
+}
+
+func Disconnect(hash string) {
+    Default.Disconnect(hash)
+}
+
+func Connections() []Status {
+    return Default.Connections()
+}
+
+func DrainConnection(ctx context.Context, hash string) error {
+    return Default.DrainConnection(ctx, hash)
+}
+
+func Drain(ctx context.Context) error {
+    return Default.Drain(ctx)
 }
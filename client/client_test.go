@@ -0,0 +1,53 @@
+package client
+
+import (
+    "net"
+    "testing"
+
+    "github.com/microstacks/stack/endpoint/router"
+)
+
+func TestDialServiceIPv6(t *testing.T) {
+    ln, err := net.Listen("tcp", "[::1]:0")
+    if err != nil {
+        t.Skip("IPv6 unavailable: ", err)
+    }
+    defer ln.Close()
+    lport := uint32(ln.Addr().(*net.TCPAddr).Port)
+
+    r := &router.Router{BindAddr: "127.0.0.1", BindAddr6: "::1"}
+    for _, origin := range []string{"127.0.0.1", "::1"} {
+        local, err := dialService(r, "tcp", net.ParseIP(origin), lport)
+        if err != nil {
+            t.Error("For", origin, "expected", ln.Addr(), "got", err)
+            continue
+        }
+
+        // IPv6 origins are kept
+        expected := "::1"
+        if host, _, _ := net.SplitHostPort(local.LocalAddr().String()); host != expected {
+            t.Error(
+                "For", origin,
+                "expected", expected,
+                "got", local.LocalAddr(),
+            )
+        }
+        local.Close()
+    }
+
+    r.BindAddr6 = ""
+    if local, err := dialService(r, "tcp", net.ParseIP("127.0.0.1"), lport); err == nil {
+        local.Close()
+        t.Error("For", "IPv4 only", "expected", "error", "got", local.RemoteAddr())
+    }
+}
+
+func TestHostKeyCallbackOptIn(t *testing.T) {
+    if _, err := (Auth{}).hostKeyCallback(); err == nil {
+        t.Error("For", "no known hosts or fingerprints", "expected", "error", "got", nil)
+    }
+
+    if cb, err := (Auth{InsecureHostKey: true}).hostKeyCallback(); err != nil || cb == nil {
+        t.Error("For", "InsecureHostKey", "expected", "callback", "got", err)
+    }
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "syscall"
+
+	"golang.org/x/crypto/ssh"
+    "github.com/microstacks/stack/endpoint/events"
+    "github.com/microstacks/stack/endpoint/metrics"
+    "github.com/microstacks/stack/endpoint/router"
+    "github.com/microstacks/stack/endpoint/utils"
+    "github.com/prometheus/common/log"
+)
+
+/*
+ * Payload of a forwarded UDP channel, see utils.ForwardedUDPChannel
+ */
+type forwardedUDP struct {
+    Host1 string // forwarded address on the router
+    Port1 uint32
+    Host2 string // originator address
+    Port2 uint32
+}
+
+/*
+ * Connect to router rhost as user u and forward datagrams of UDP port rport
+ * on it to the UDP service on lport.
+ */
+func (cs *Clients) ConnectUDP(r *router.Router, u string, auth Auth, rhost string, lport uint32, rport uint32, weight uint32, hash string) error {
+
+    conn, err := dial(r, u, auth, rhost, weight)
+    if err != nil {
+        return err
+    }
+
+    // Flows are opened by the router as soon as the port is bound
+    chans := conn.HandleChannelOpen(utils.ForwardedUDPChannel)
+
+    req := struct {
+        Host string
+        Port uint32
+    }{r.BindAddr, rport}
+
+    ok, reply, err := conn.SendRequest(utils.UDPForwardRequest, true, ssh.Marshal(req))
+    if err == nil && !ok {
+        err = fmt.Errorf("ssh client: udp forward of %s:%d rejected", r.BindAddr, rport)
+    }
+    if err != nil {
+        log.Debug("UDP forward ON remote server error: ", err)
+        conn.Close()
+        return err
+    }
+
+    port := rport
+    if rport == 0 && len(reply) >= 4 {
+        port = binary.BigEndian.Uint32(reply)
+    }
+
+    addr := net.JoinHostPort(r.BindAddr, strconv.Itoa(int(port))) + "/udp"
+    fmt.Println("SSH Client: Forwarding datagrams of ", addr, "@", rhost)
+
+    connection := &Connection{c: conn, addr: addr}
+
+    cs.mu.Lock()
+    cs.clients[hash] = connection
+    cs.mu.Unlock()
+    r.Publish(events.Event{Type: events.ExportConnected, Service: u, Remote: rhost})
+
+    go func() {
+        // Closed with the SSH connection
+        for newCh := range chans {
+            go cs.handleUDP(r, connection, newCh, lport)
+        }
+
+        log.Debug("SSH Client: UDP forward closed on ", addr, "@", rhost)
+        cs.mu.Lock()
+        if cs.clients[hash] == connection {
+            delete(cs.clients, hash)
+        }
+        cs.mu.Unlock()
+        r.Publish(events.Event{Type: events.ExportDisconnected, Service: u, Remote: rhost})
+    }()
+
+    return nil
+}
+
+/*
+ * Pass datagrams of a flow between the channel and the service on lport.
+ */
+func (cs *Clients) handleUDP(r *router.Router, connection *Connection, newCh ssh.NewChannel, lport uint32) {
+    var p forwardedUDP
+    if err := ssh.Unmarshal(newCh.ExtraData(), &p); err != nil {
+        newCh.Reject(ssh.ConnectionFailed, "invalid payload")
+        return
+    }
+
+    // Datagrams originate from the router address like forwarded connections
+    local, err := dialService(r, "udp", net.ParseIP(p.Host2), lport)
+    if err != nil {
+        log.Debug("Dial INTO local udp service error: ", err)
+        metrics.DialFailures.WithLabelValues("service").Inc()
+        newCh.Reject(ssh.ConnectionFailed, err.Error())
+        return
+    }
+
+    ch, reqs, err := newCh.Accept()
+    if err != nil {
+        local.Close()
+        return
+    }
+    go ssh.DiscardRequests(reqs)
+
+    cs.active.Add(1)
+    connection.active.Add(1)
+    defer cs.active.Done()
+    defer connection.active.Done()
+
+    // Replies of the service
+    go func() {
+        buf := make([]byte, utils.MaxDatagram)
+        for {
+            n, err := local.Read(buf)
+            if errors.Is(err, syscall.ECONNREFUSED) {
+                // Service not listening (yet), the datagram is lost
+                continue
+            }
+            if err != nil {
+                ch.Close()
+                return
+            }
+            if err := utils.WriteDatagram(ch, buf[:n]); err != nil {
+                return
+            }
+        }
+    }()
+
+    buf := make([]byte, utils.MaxDatagram)
+    for {
+        b, err := utils.ReadDatagram(ch, buf)
+        if err != nil {
+            break
+        }
+        if _, err := local.Write(b); err != nil {
+            log.Debug("Write INTO local udp service error: ", err)
+        }
+    }
+
+    local.Close()
+    ch.Close()
+}
+
+func ConnectUDP(r *router.Router, u string, auth Auth, rhost string, lport uint32, rport uint32, weight uint32, hash string) error {
+    return Default.ConnectUDP(r, u, auth, rhost, lport, rport, weight, hash)
+}
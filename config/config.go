@@ -0,0 +1,477 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	exports "github.com/microstacks/stack/endpoint/opt/export"
+	imports "github.com/microstacks/stack/endpoint/opt/import"
+	"github.com/microstacks/stack/endpoint/supervisor"
+	"github.com/microstacks/stack/endpoint/utils"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Config file, an alternative to the command line flags.
+ * Imports and exports are rendered to --import/--export option strings,
+ * flags and the PASSWD, PORT and INSTANCE env vars take precedence.
+ */
+type Config struct {
+	Password     string `yaml:"password" json:"password" toml:"password"`                // shared password of all services
+	NoPassword   bool   `yaml:"no-password" json:"no-password" toml:"no-password"`       // disable password authentication
+	IPv6         bool   `yaml:"ipv6" json:"ipv6" toml:"ipv6"`                            // route IPv6 instance addresses, see --ipv6
+	Port         string `yaml:"port" json:"port" toml:"port"`                            // PORT
+	Detect       string `yaml:"detect" json:"detect" toml:"detect"`                      // wildcard port detection, see --detect
+	Instance     int    `yaml:"instance" json:"instance" toml:"instance"`                // INSTANCE
+	Interval     int    `yaml:"interval" json:"interval" toml:"interval"`                // seconds between wildcard export checks
+	DrainTimeout string `yaml:"drain-timeout" json:"drain-timeout" toml:"drain-timeout"` // e.g. 30s
+	MetricsAddr  string `yaml:"metrics-addr" json:"metrics-addr" toml:"metrics-addr"`
+	AdminAddr    string `yaml:"admin-addr" json:"admin-addr" toml:"admin-addr"`
+	AdminToken   string `yaml:"admin-token" json:"admin-token" toml:"admin-token"`             // ADMIN_TOKEN
+	Events       string `yaml:"events" json:"events" toml:"events"`                            // event sink, see --events
+	Register     string `yaml:"register-socket" json:"register-socket" toml:"register-socket"` // listener.so socket, see --register-socket
+	Restart      string `yaml:"restart" json:"restart" toml:"restart"`                         // restart policy of the command, see --restart
+	MaxBackoff   string `yaml:"max-backoff" json:"max-backoff" toml:"max-backoff"`             // e.g. 1m
+
+	Auth      Auth      `yaml:"auth" json:"auth" toml:"auth"`
+	Hooks     Hooks     `yaml:"hooks" json:"hooks" toml:"hooks"`
+	Imports   []Import  `yaml:"imports" json:"imports" toml:"imports"`
+	Exports   []Export  `yaml:"exports" json:"exports" toml:"exports"`
+	Processes []Process `yaml:"processes" json:"processes" toml:"processes"`
+}
+
+/*
+ * Global authentication settings
+ */
+type Auth struct {
+	AuthorizedKeys   string   `yaml:"authorized-keys" json:"authorized-keys" toml:"authorized-keys"`
+	HostKey          string   `yaml:"host-key" json:"host-key" toml:"host-key"`
+	Identity         string   `yaml:"identity" json:"identity" toml:"identity"`
+	KnownHosts       string   `yaml:"known-hosts" json:"known-hosts" toml:"known-hosts"`
+	HostFingerprints []string `yaml:"host-fingerprints" json:"host-fingerprints" toml:"host-fingerprints"`
+	InsecureHostKey  bool     `yaml:"insecure-host-key" json:"insecure-host-key" toml:"insecure-host-key"` // see --insecure-host-key
+}
+
+/*
+ * Global hook scripts
+ */
+type Hooks struct {
+	OnConnect    string `yaml:"on-connect" json:"on-connect" toml:"on-connect"`
+	OnDisconnect string `yaml:"on-disconnect" json:"on-disconnect" toml:"on-disconnect"`
+}
+
+/*
+ * Imported service, see --import
+ */
+type Import struct {
+	Service  string `yaml:"service" json:"service" toml:"service"`    // app:port
+	Listen   string `yaml:"listen" json:"listen" toml:"listen"`       // load balanced laddr:lport
+	Protocol string `yaml:"protocol" json:"protocol" toml:"protocol"` // tcp (default) or udp
+	Block    bool   `yaml:"block" json:"block" toml:"block"`          // wait for the service before starting the command
+	LB       string `yaml:"lb" json:"lb" toml:"lb"`
+	Retries  int    `yaml:"retries" json:"retries" toml:"retries"`
+	Timeout  string `yaml:"timeout" json:"timeout" toml:"timeout"`
+	Cooldown string `yaml:"cooldown" json:"cooldown" toml:"cooldown"`
+	Idle     string `yaml:"idle-timeout" json:"idle-timeout" toml:"idle-timeout"` // udp only
+	Check    *Check `yaml:"check" json:"check" toml:"check"`
+
+	AuthorizedKeys string `yaml:"authorized-keys" json:"authorized-keys" toml:"authorized-keys"`
+	OnConnect      string `yaml:"on-connect" json:"on-connect" toml:"on-connect"`
+	OnDisconnect   string `yaml:"on-disconnect" json:"on-disconnect" toml:"on-disconnect"`
+}
+
+/*
+ * Active health check of an import, readiness check of an export
+ */
+type Check struct {
+	Probe    string `yaml:"probe" json:"probe" toml:"probe"` // tcp, http[:/path] or exec:/path/cmd
+	Interval string `yaml:"interval" json:"interval" toml:"interval"`
+	Timeout  string `yaml:"timeout" json:"timeout" toml:"timeout"`
+	Rise     int    `yaml:"rise" json:"rise" toml:"rise"`
+	Fall     int    `yaml:"fall" json:"fall" toml:"fall"`
+}
+
+/*
+ * Exported service, see --export
+ */
+type Export struct {
+	Service  string `yaml:"service" json:"service" toml:"service"`    // app:port
+	Router   string `yaml:"router" json:"router" toml:"router"`       // raddr[:rport], IPv6 as [addr][:rport]
+	Protocol string `yaml:"protocol" json:"protocol" toml:"protocol"` // tcp (default) or udp
+	Weight   uint32 `yaml:"weight" json:"weight" toml:"weight"`
+	Check    *Check `yaml:"check" json:"check" toml:"check"` // readiness of the service
+
+	Identity         string   `yaml:"identity" json:"identity" toml:"identity"`
+	KnownHosts       string   `yaml:"known-hosts" json:"known-hosts" toml:"known-hosts"`
+	HostFingerprints []string `yaml:"host-fingerprints" json:"host-fingerprints" toml:"host-fingerprints"`
+}
+
+/*
+ * Process run by the router besides the command of the arguments.
+ * Its exports are withdrawn while it is down.
+ */
+type Process struct {
+	Name    string   `yaml:"name" json:"name" toml:"name"`
+	Command []string `yaml:"command" json:"command" toml:"command"` // command and arguments
+	Restart string   `yaml:"restart" json:"restart" toml:"restart"` // always, on-failure or never (default)
+	Exports []Export `yaml:"exports" json:"exports" toml:"exports"`
+}
+
+var processName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-\.]*$`)
+
+/*
+ * Load and validate config file.
+ * Files ending in .json are read as JSON, .toml as TOML and anything
+ * else as YAML. Unknown keys are rejected.
+ */
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	switch filepath.Ext(path) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".toml":
+		err = unmarshalTOML(data, c)
+	default:
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+/*
+ * Decode TOML into c, unknown keys are rejected like in YAML and JSON
+ */
+func unmarshalTOML(data []byte, c *Config) error {
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		return err
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for n, key := range undecoded {
+			keys[n] = key.String()
+		}
+		return fmt.Errorf("unknown keys %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+/*
+ * Validation errors prefixed with the field they belong to
+ */
+type errorList []string
+
+func (l *errorList) add(field string, format string, args ...interface{}) {
+	*l = append(*l, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *errorList) duration(field string, value string) {
+	if value == "" {
+		return
+	}
+	if d, err := time.ParseDuration(value); err != nil {
+		l.add(field, "invalid duration %q", value)
+	} else if d <= 0 {
+		l.add(field, "must be positive")
+	}
+}
+
+/*
+ * Values end up in option strings, so they must not contain separators.
+ */
+func (l *errorList) value(field string, value string) {
+	if strings.ContainsAny(value, ",|") {
+		l.add(field, "must not contain ',' or '|'")
+	}
+}
+
+/*
+ * Spec fields precede the options, a separator in them would add options.
+ */
+func (l *errorList) spec(field string, value string) {
+	if strings.ContainsAny(value, ",=") {
+		l.add(field, "must not contain ',' or '='")
+	}
+}
+
+/*
+ * Option suffix of protocol, invalid protocols are left to the parsers
+ */
+func suffix(protocol string) string {
+	if protocol == "" || protocol == "tcp" {
+		return ""
+	}
+	return "/" + protocol
+}
+
+/*
+ * Values of a check
+ */
+func (l *errorList) check(field string, c *Check) {
+	if c != nil {
+		l.value(field+".probe", c.Probe)
+	}
+}
+
+/*
+ * Config fields of the fields of utils.OptionError
+ */
+var optionFields = map[string]string{
+	"proto":            "protocol",
+	"app:port":         "service",
+	"app":              "service",
+	"port":             "service",
+	"laddr:lport":      "listen",
+	"laddr":            "listen",
+	"lport":            "listen",
+	"raddr":            "router",
+	"rport":            "router",
+	"check":            "check.probe",
+	"check-interval":   "check.interval",
+	"check-timeout":    "check.timeout",
+	"rise":             "check.rise",
+	"fall":             "check.fall",
+	"host-fingerprint": "host-fingerprints",
+}
+
+/*
+ * Errors of Import.Validate or Export.Validate for the rendered option
+ */
+func (l *errorList) options(field string, errs []error) {
+	for _, err := range errs {
+		oe, ok := err.(*utils.OptionError)
+		if !ok {
+			l.add(field, "%s", err)
+			continue
+		}
+
+		name, ok := optionFields[oe.Field]
+		if !ok {
+			name = oe.Field
+		}
+		l.add(field+"."+name, "%q %s", oe.Value, oe.Reason)
+	}
+}
+
+/*
+ * Export fields
+ */
+func (l *errorList) export(field string, e Export) {
+	before := len(*l)
+
+	l.spec(field+".service", e.Service)
+	l.spec(field+".router", e.Router)
+	l.spec(field+".protocol", e.Protocol)
+	l.check(field+".check", e.Check)
+	l.value(field+".identity", e.Identity)
+	l.value(field+".known-hosts", e.KnownHosts)
+	for n, fp := range e.HostFingerprints {
+		l.value(fmt.Sprintf("%s.host-fingerprints[%d]", field, n), fp)
+	}
+
+	// Values with separators would not render to the option
+	if len(*l) == before {
+		l.options(field, exports.Validate([]string{e.option()}))
+	}
+}
+
+/*
+ * Validate checks all fields and reports every error found.
+ */
+func (c *Config) Validate() error {
+	var errs errorList
+
+	if c.Instance < 0 {
+		errs.add("instance", "must not be negative")
+	}
+	if c.Interval < 0 {
+		errs.add("interval", "must not be negative")
+	}
+	errs.duration("drain-timeout", c.DrainTimeout)
+	if c.Detect != "" && c.Detect != "preload" && c.Detect != "procfs" {
+		errs.add("detect", "must be preload or procfs")
+	}
+	if err := supervisor.CheckPolicy(c.Restart); err != nil {
+		errs.add("restart", "%s", err)
+	}
+	errs.duration("max-backoff", c.MaxBackoff)
+
+	for idx, i := range c.Imports {
+		field := fmt.Sprintf("imports[%d]", idx)
+		before := len(errs)
+
+		errs.spec(field+".service", i.Service)
+		errs.spec(field+".listen", i.Listen)
+		errs.spec(field+".protocol", i.Protocol)
+		errs.check(field+".check", i.Check)
+		errs.value(field+".authorized-keys", i.AuthorizedKeys)
+		errs.value(field+".on-connect", i.OnConnect)
+		errs.value(field+".on-disconnect", i.OnDisconnect)
+
+		// Values with separators would not render to the option
+		if len(errs) == before {
+			errs.options(field, imports.Validate([]string{i.option()}))
+		}
+	}
+
+	for idx, e := range c.Exports {
+		errs.export(fmt.Sprintf("exports[%d]", idx), e)
+	}
+
+	names := make(map[string]bool, len(c.Processes))
+	for idx, p := range c.Processes {
+		field := fmt.Sprintf("processes[%d]", idx)
+
+		if !processName.MatchString(p.Name) {
+			errs.add(field+".name", "%q is not a valid name", p.Name)
+		} else if names[p.Name] {
+			errs.add(field+".name", "duplicate name %q", p.Name)
+		}
+		names[p.Name] = true
+
+		if len(p.Command) == 0 || p.Command[0] == "" {
+			errs.add(field+".command", "must not be empty")
+		}
+		if err := supervisor.CheckPolicy(p.Restart); err != nil {
+			errs.add(field+".restart", "%s", err)
+		}
+		for n, e := range p.Exports {
+			errs.export(fmt.Sprintf("%s.exports[%d]", field, n), e)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+/*
+ * Option string builder
+ */
+type option struct {
+	bytes.Buffer
+}
+
+func (o *option) set(key string, value string) {
+	if value != "" {
+		fmt.Fprintf(o, ",%s=%s", key, value)
+	}
+}
+
+func (o *option) setInt(key string, value int) {
+	if value != 0 {
+		fmt.Fprintf(o, ",%s=%d", key, value)
+	}
+}
+
+/*
+ * Check options of imports and exports
+ */
+func (o *option) check(c *Check) {
+	if c != nil {
+		o.set("check", c.Probe)
+		o.set("check-interval", c.Interval)
+		o.set("check-timeout", c.Timeout)
+		o.setInt("rise", c.Rise)
+		o.setInt("fall", c.Fall)
+	}
+}
+
+/*
+ * Render imports as --import option strings
+ */
+func (c *Config) ImportOptions() []string {
+	opts := make([]string, 0, len(c.Imports))
+	for _, i := range c.Imports {
+		opts = append(opts, i.option())
+	}
+	return opts
+}
+
+/*
+ * Render import as --import option string
+ */
+func (i Import) option() string {
+	var o option
+
+	if i.Block {
+		o.WriteString("^")
+	}
+	o.WriteString(i.Service)
+	if i.Listen != "" {
+		o.WriteString(">" + i.Listen)
+	}
+	o.WriteString(suffix(i.Protocol))
+
+	o.set("lb", i.LB)
+	o.setInt("retries", i.Retries)
+	o.set("timeout", i.Timeout)
+	o.set("cooldown", i.Cooldown)
+	o.set("idle-timeout", i.Idle)
+	o.check(i.Check)
+	o.set("authorized-keys", i.AuthorizedKeys)
+	o.set("on-connect", i.OnConnect)
+	o.set("on-disconnect", i.OnDisconnect)
+
+	return o.String()
+}
+
+/*
+ * Render exports as --export option strings
+ */
+func (c *Config) ExportOptions() []string {
+	return exportOptions(c.Exports)
+}
+
+/*
+ * Render exports of the process as --export option strings
+ */
+func (p Process) ExportOptions() []string {
+	return exportOptions(p.Exports)
+}
+
+func exportOptions(exports []Export) []string {
+	opts := make([]string, 0, len(exports))
+	for _, e := range exports {
+		opts = append(opts, e.option())
+	}
+	return opts
+}
+
+/*
+ * Render export as --export option string
+ */
+func (e Export) option() string {
+	var o option
+
+	o.WriteString(e.Service + "@" + e.Router + suffix(e.Protocol))
+	o.setInt("weight", int(e.Weight))
+	o.check(e.Check)
+	o.set("identity", e.Identity)
+	o.set("known-hosts", e.KnownHosts)
+	o.set("host-fingerprint", strings.Join(e.HostFingerprints, "|"))
+
+	return o.String()
+}
@@ -0,0 +1,343 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, data string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlConfig = `
+password: secret
+drain-timeout: 1m
+auth:
+  authorized-keys: /etc/endpoint/keys
+hooks:
+  on-connect: /etc/endpoint/onconnect
+imports:
+  - service: db:3306
+    block: true
+  - service: app:8000
+    listen: eth0:80
+    lb: leastconn
+    retries: 2
+    check:
+      probe: http:/healthz
+      interval: 1s
+      rise: 1
+    authorized-keys: /etc/endpoint/app.keys
+exports:
+  - service: web:80
+    router: lb:8080
+    weight: 2
+    check:
+      probe: http:/ready
+      fall: 2
+    host-fingerprints: [SHA256:aaa, SHA256:bbb]
+`
+
+func TestLoadYAML(t *testing.T) {
+	path := writeConfig(t, "endpoint.yaml", yamlConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imports := []string{
+		"^db:3306",
+		"app:8000>eth0:80,lb=leastconn,retries=2,check=http:/healthz,check-interval=1s,rise=1,authorized-keys=/etc/endpoint/app.keys",
+	}
+	if opts := c.ImportOptions(); !reflect.DeepEqual(opts, imports) {
+		t.Error(
+			"For", "imports",
+			"expected", imports,
+			"got", opts,
+		)
+	}
+
+	exports := []string{"web:80@lb:8080,weight=2,check=http:/ready,fall=2,host-fingerprint=SHA256:aaa|SHA256:bbb"}
+	if opts := c.ExportOptions(); !reflect.DeepEqual(opts, exports) {
+		t.Error(
+			"For", "exports",
+			"expected", exports,
+			"got", opts,
+		)
+	}
+
+	if c.Password != "secret" || c.Auth.AuthorizedKeys != "/etc/endpoint/keys" || c.Hooks.OnConnect != "/etc/endpoint/onconnect" {
+		t.Error(
+			"For", "settings",
+			"expected", "password, authorized keys and hook",
+			"got", c,
+		)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := writeConfig(t, "endpoint.json", `{
+	"imports": [{"service": "db:3306"}],
+	"exports": [{"service": "web:*", "router": "lb"}]
+}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts := c.ExportOptions(); len(opts) != 1 || opts[0] != "web:*@lb" {
+		t.Error(
+			"For", "exports",
+			"expected", "web:*@lb",
+			"got", opts,
+		)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	for name, data := range map[string]string{
+		"endpoint.yaml": "imports:\n  - service: db:3306\n    balance: rr\n",
+		"endpoint.json": `{"imports": [{"service": "db:3306", "balance": "rr"}]}`,
+		"endpoint.toml": "[[imports]]\nservice = \"db:3306\"\nbalance = \"rr\"\n",
+	} {
+		path := writeConfig(t, name, data)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "balance") {
+			t.Error(
+				"For", name,
+				"expected", "unknown field balance",
+				"got", err,
+			)
+		}
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeConfig(t, "endpoint.toml", `
+password = "secret"
+
+[[imports]]
+service = "db:3306"
+block = true
+
+[[exports]]
+service = "web:80"
+router = "lb:8080"
+weight = 2
+host-fingerprints = ["SHA256:aaa"]
+
+  [exports.check]
+  probe = "http:/ready"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imports := []string{"^db:3306"}
+	if opts := c.ImportOptions(); !reflect.DeepEqual(opts, imports) {
+		t.Error(
+			"For", "imports",
+			"expected", imports,
+			"got", opts,
+		)
+	}
+
+	exports := []string{"web:80@lb:8080,weight=2,check=http:/ready,host-fingerprint=SHA256:aaa"}
+	if opts := c.ExportOptions(); !reflect.DeepEqual(opts, exports) || c.Password != "secret" {
+		t.Error(
+			"For", "exports",
+			"expected", exports,
+			"got", opts, c.Password,
+		)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := &Config{
+		DrainTimeout: "soon",
+		Detect:       "ebpf",
+		Imports: []Import{
+			{Service: "db"},
+			{Service: "app:79", LB: "fastest"},
+			{Service: "app:80", Check: &Check{Probe: "udp"}},
+			{Service: "app:81", OnConnect: "/hooks/a,b"},
+			{Service: "dns:53", Protocol: "sctp"},
+			{Service: "app:82", Idle: "1m"},
+			{Service: "app:83", Check: &Check{Probe: "tcp", Interval: "-1s"}},
+			{Service: "app:84", Listen: "eth0:http"},
+			{Service: "app:85", Retries: -1},
+			{Service: "app:86,check=tcp"},
+			{Service: "app:87", Listen: "eth0:87,block"},
+			{Service: "app:88", Protocol: "udp,idle-timeout=1s"},
+		},
+		Exports: []Export{
+			{Service: "web:80", Router: "lb:http"},
+			{Service: "statsd:8125", Router: "lb", Protocol: "quic"},
+			{Service: "web:81", Router: "lb", Check: &Check{Probe: "http:ready"}},
+			{Service: "web:82", Router: "lb", Check: &Check{Probe: "tcp", Fall: -1}},
+			{Service: "web:83", Router: "lb", HostFingerprints: []string{"SHA256:a|b"}},
+			{Service: "web:84", Router: "lb,weight=9"},
+			{Service: "web:85=", Router: "lb"},
+		},
+		Restart:    "sometimes",
+		MaxBackoff: "0s",
+		Processes: []Process{
+			{Name: "worker", Restart: "always"},
+			{Name: "worker", Command: []string{"worker"}, Exports: []Export{{Service: "web", Router: "lb"}}},
+		},
+	}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	for _, field := range []string{
+		"drain-timeout",
+		"detect",
+		"imports[0].service",
+		"imports[1].lb",
+		"imports[2].check.probe",
+		"imports[3].on-connect",
+		"imports[4].protocol",
+		"imports[5].idle-timeout",
+		"imports[6].check.interval",
+		"imports[7].listen",
+		"imports[8].retries",
+		"imports[9].service",
+		"imports[10].listen",
+		"imports[11].protocol",
+		"exports[0].router",
+		"exports[1].protocol",
+		"exports[2].check.probe",
+		"exports[3].check.fall",
+		"exports[4].host-fingerprints[0]",
+		"exports[5].router",
+		"exports[6].service",
+		"restart",
+		"max-backoff",
+		"processes[0].command",
+		"processes[1].name",
+		"processes[1].exports[0].service",
+	} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Error(
+				"For", field,
+				"expected", "error",
+				"got", err,
+			)
+		}
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	c := &Config{
+		Imports: []Import{
+			{Service: "dns:53", Listen: "eth0:53", Protocol: "udp", Idle: "1m"},
+			{Service: "db:3306", Protocol: "tcp"},
+		},
+		Exports: []Export{
+			{Service: "statsd:8125", Router: "lb", Protocol: "udp"},
+		},
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	imports := []string{"dns:53>eth0:53/udp,idle-timeout=1m", "db:3306"}
+	if opts := c.ImportOptions(); !reflect.DeepEqual(opts, imports) {
+		t.Error(
+			"For", "imports",
+			"expected", imports,
+			"got", opts,
+		)
+	}
+
+	exports := []string{"statsd:8125@lb/udp"}
+	if opts := c.ExportOptions(); !reflect.DeepEqual(opts, exports) {
+		t.Error(
+			"For", "exports",
+			"expected", exports,
+			"got", opts,
+		)
+	}
+}
+
+func TestIPv6Router(t *testing.T) {
+	for router, valid := range map[string]bool{
+		"fd00::1":          true,
+		"[fd00::1]":        true,
+		"[fd00::1]:8080":   true,
+		"[::ffff:1.2.3.4]": true,
+		"[lb]:8080":        false,
+		"[fd00::1]8080":    false,
+	} {
+		c := &Config{Exports: []Export{{Service: "web:80", Router: router}}}
+		if err := c.Validate(); (err == nil) != valid {
+			t.Error(
+				"For", router,
+				"expected", valid,
+				"got", err,
+			)
+		}
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	path := writeConfig(t, "endpoint.yaml", `
+restart: on-failure
+max-backoff: 30s
+processes:
+  - name: worker
+    command: [worker, --queue, jobs]
+    restart: always
+    exports:
+      - service: metrics:9100
+        router: lb
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := c.Processes[0]
+	if c.Restart != "on-failure" || p.Name != "worker" || p.Restart != "always" || !reflect.DeepEqual(p.Command, []string{"worker", "--queue", "jobs"}) {
+		t.Error(
+			"For", "processes",
+			"expected", "worker",
+			"got", c.Restart, c.Processes,
+		)
+	}
+
+	exports := []string{"metrics:9100@lb"}
+	if opts := p.ExportOptions(); !reflect.DeepEqual(opts, exports) {
+		t.Error(
+			"For", "process exports",
+			"expected", exports,
+			"got", opts,
+		)
+	}
+}
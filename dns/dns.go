@@ -8,9 +8,11 @@ import (
     "regexp"
     "strconv"
     "io/ioutil"
+    "os/exec"
 
 	"github.com/miekg/dns"
     "github.com/bogdanovich/dns_resolver"
+    "github.com/microstacks/stack/endpoint/metrics"
 )
 
 var resolver *dns_resolver.DnsResolver
@@ -40,6 +42,90 @@ func GenerateIP(instance uint32) net.IP {
     return IP
 }
 
+/*
+ *  IPv6 has a single loopback address, instances get addresses of this
+ *  unique local prefix instead, routed to lo by RouteLoopback6.
+ */
+const Loopback6 = "fd7f::/64"
+
+/*
+ *  Set once Loopback6 is routed, instance names only resolve to IPv6
+ *  addresses then. RouteLoopback6 is called before Start.
+ */
+var routed6 bool
+
+/*
+ *  Ganerate IPv6 address of instance
+ */
+func GenerateIP6(instance uint32) net.IP {
+    _, prefix, _ := net.ParseCIDR(Loopback6)
+    IP := make(net.IP, net.IPv6len)
+    copy(IP, prefix.IP)
+    binary.BigEndian.PutUint32(IP[12:], instance)
+
+    return IP
+}
+
+/*
+ *  Route the Loopback6 prefix to lo, so instances can bind to their address
+ */
+func RouteLoopback6() error {
+    out, err := exec.Command("ip", "-6", "route", "replace", "local", Loopback6, "dev", "lo").CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("ip route %s: %s %s", Loopback6, err, out)
+    }
+    routed6 = true
+    return nil
+}
+
+/*
+ *  Query AAAA records of host from the servers of r
+ */
+func LookupAAAA(r *dns_resolver.DnsResolver, host string) ([]net.IP, error) {
+    m := new(dns.Msg)
+    m.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
+
+    var err error
+    for _, server := range r.Servers {
+        var in *dns.Msg
+        in, err = dns.Exchange(m, server)
+        if err != nil {
+            continue
+        }
+
+        var ipArr []net.IP
+        for _, rr := range in.Answer {
+            if aaaa, ok := rr.(*dns.AAAA); ok {
+                ipArr = append(ipArr, aaaa.AAAA)
+            }
+        }
+        return ipArr, nil
+    }
+
+    return nil, err
+}
+
+/*
+ *  IPv4 and IPv6 addresses of host, IP literals resolve to themselves
+ */
+func LookupIP(r *dns_resolver.DnsResolver, host string) ([]net.IP, error) {
+    if IP := net.ParseIP(host); IP != nil {
+        return []net.IP{IP}, nil
+    }
+
+    ipArr, err := r.LookupHost(host)
+    ip6Arr, err6 := LookupAAAA(r, host)
+    ipArr = append(ipArr, ip6Arr...)
+
+    if len(ipArr) > 0 {
+        return ipArr, nil
+    }
+    if err == nil {
+        err = err6
+    }
+    return nil, err
+}
+
 /*
  *  Parse localhost
  */
@@ -80,39 +166,73 @@ func parseLocalhostInstance(str string) (uint32) {
     return uint32(instance)
 }
 
+/*
+ *  Answer record of name
+ */
+func answer(m *dns.Msg, name string, IP net.IP) {
+    rrtype := "A"
+    if IP.To4() == nil {
+        rrtype = "AAAA"
+    }
+
+    rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", name, rrtype, IP.String()))
+    if err == nil {
+        m.Answer = append(m.Answer, rr)
+    }
+}
+
 func parseQuery(m *dns.Msg) {
 	for _, q := range m.Question {
 		switch q.Qtype {
-		case dns.TypeA:
+		case dns.TypeA, dns.TypeAAAA:
+            ipv6 := q.Qtype == dns.TypeAAAA
+
             ok := parseLocalhost(q.Name)
             if ok {
-                rr, err := dns.NewRR(fmt.Sprintf("%s A 127.0.0.1", q.Name))
-                if err == nil {
-                    m.Answer = append(m.Answer, rr)
+                if ipv6 {
+                    answer(m, q.Name, net.IPv6loopback)
+                } else {
+                    answer(m, q.Name, net.ParseIP("127.0.0.1"))
                 }
+                metrics.DNSQueries.WithLabelValues("localhost").Inc()
                 return
             }
             
             instance := parseLocalhostInstance(q.Name)
             if instance > 0 {
-                IP := GenerateIP(instance)
-                rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, IP.String()))
-                if err == nil {
-                    m.Answer = append(m.Answer, rr)
-                }     
+                if ipv6 {
+                    // No address unless the instance can bind to it
+                    if routed6 {
+                        answer(m, q.Name, GenerateIP6(instance))
+                    }
+                } else {
+                    answer(m, q.Name, GenerateIP(instance))
+                }
+                metrics.DNSQueries.WithLabelValues("instance").Inc()
                 return
             }
 
             // Check if host exists
-            ipArr, err := resolver.LookupHost(q.Name)
+            var ipArr []net.IP
+            var err error
+            if ipv6 {
+                ipArr, err = LookupAAAA(resolver, q.Name)
+            } else {
+                ipArr, err = resolver.LookupHost(q.Name)
+            }
             if err != nil {
                 log.Println(err)
             }                
 
             for _, IP := range ipArr {
-                rr, _ := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, IP.String()))
-                m.Answer = append(m.Answer, rr)
+                answer(m, q.Name, IP)
             } 
+
+            if len(ipArr) > 0 {
+                metrics.DNSQueries.WithLabelValues("upstream").Inc()
+            } else {
+                metrics.DNSQueries.WithLabelValues("none").Inc()
+            }
 		}
 	}
 }
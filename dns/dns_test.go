@@ -0,0 +1,85 @@
+package dns
+
+import (
+    "net"
+    "testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGenerateIP6(t *testing.T) {
+    for instance, expected := range map[uint32]string{
+        0:        "fd7f::",
+        1:        "fd7f::1",
+        65536:    "fd7f::1:0",
+        16777215: "fd7f::ff:ffff",
+    } {
+        if IP := GenerateIP6(instance); IP.String() != expected {
+            t.Error(
+                "For", instance,
+                "expected", expected,
+                "got", IP,
+            )
+        }
+    }
+
+    _, prefix, _ := net.ParseCIDR(Loopback6)
+    if !prefix.Contains(GenerateIP6(42)) {
+        t.Error(
+            "For", 42,
+            "expected", "address in " + Loopback6,
+            "got", GenerateIP6(42),
+        )
+    }
+}
+
+func TestParseQueryAAAA(t *testing.T) {
+    routed6 = true
+    defer func() { routed6 = false }()
+
+    for name, expected := range map[string]string{
+        "localhost.":    "::1",
+        "7.localhost.":  "fd7f::7",
+    } {
+        m := new(dns.Msg)
+        m.SetQuestion(name, dns.TypeAAAA)
+        parseQuery(m)
+
+        if len(m.Answer) != 1 {
+            t.Error("For", name, "expected", expected, "got", m.Answer)
+            continue
+        }
+        aaaa, ok := m.Answer[0].(*dns.AAAA)
+        if !ok || aaaa.AAAA.String() != expected {
+            t.Error(
+                "For", name,
+                "expected", expected,
+                "got", m.Answer[0],
+            )
+        }
+    }
+
+    m := new(dns.Msg)
+    m.SetQuestion("7.localhost.", dns.TypeA)
+    parseQuery(m)
+    if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "127.0.0.7" {
+        t.Error(
+            "For", "7.localhost. A",
+            "expected", "127.0.0.7",
+            "got", m.Answer,
+        )
+    }
+}
+
+func TestParseQueryAAAAUnrouted(t *testing.T) {
+    m := new(dns.Msg)
+    m.SetQuestion("7.localhost.", dns.TypeAAAA)
+    parseQuery(m)
+    if len(m.Answer) != 0 {
+        t.Error(
+            "For", "7.localhost. without " + Loopback6,
+            "expected", "no answer",
+            "got", m.Answer,
+        )
+    }
+}
@@ -0,0 +1,118 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+/*
+ * Event types
+ */
+const (
+	BackendConnected    = "backend-connected"    // backend of an import connected
+	BackendDisconnected = "backend-disconnected" // backend of an import disconnected
+	BackendHealthy      = "backend-healthy"      // backend passes its health checks again
+	BackendUnhealthy    = "backend-unhealthy"    // backend fails its health checks
+	ExportConnected     = "export-connected"     // export forwarded on a router
+	ExportDisconnected  = "export-disconnected"  // forward of an export closed
+	ExportRetry         = "export-retry"         // reconnect loop connects again
+	ExportReady         = "export-ready"         // readiness check of an export passes
+	ExportUnready       = "export-unready"       // readiness check fails, export withdrawn
+	PortRegistered      = "port-registered"      // dynamic port reported by listener.so
+	PortUnregistered    = "port-unregistered"    // dynamic port closed
+	ChildStarted        = "child-started"        // child process started
+	ChildExited         = "child-exited"         // child process exited
+	ChildRestarted      = "child-restarted"      // child process killed for a restart
+	ChildBackoff        = "child-backoff"        // child process restarts after a delay
+)
+
+/*
+ * Router event
+ */
+type Event struct {
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Service string      `json:"service,omitempty"` // service user, e.g. app.80
+	Remote  string      `json:"remote,omitempty"`  // router address of an export
+	Host    *utils.Host `json:"host,omitempty"`    // backend of an import
+	Port    uint32      `json:"port,omitempty"`    // dynamic port of a wildcard export
+	Pid     int         `json:"pid,omitempty"`     // child process
+	Process string      `json:"process,omitempty"` // name of a child process
+	Message string      `json:"message,omitempty"`
+}
+
+/*
+ * Event bus, routers of the same process publish to their own bus
+ */
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Event]bool
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Event]bool)}
+}
+
+/*
+ * Bus of the endpoint command, used by the package-level functions
+ */
+var Default = NewBus()
+
+/*
+ * Subscribe to events, size is the buffer of the channel.
+ * Events are dropped while the buffer is full so slow subscribers
+ * never block the router. cancel unsubscribes and closes the channel.
+ */
+func (b *Bus) Subscribe(size int) (<-chan Event, func()) {
+	c := make(chan Event, size)
+
+	b.mu.Lock()
+	b.subs[c] = true
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, c)
+			b.mu.Unlock()
+			close(c)
+		})
+	}
+	return c, cancel
+}
+
+/*
+ * Publish event to all subscribers, Time defaults to now.
+ */
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+/*
+ * Subscribe to events of the Default bus
+ */
+func Subscribe(size int) (<-chan Event, func()) {
+	return Default.Subscribe(size)
+}
+
+/*
+ * Publish event on the Default bus
+ */
+func Publish(e Event) {
+	Default.Publish(e)
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	c, cancel := Subscribe(1)
+
+	Publish(Event{Type: BackendConnected, Service: "app.80"})
+	Publish(Event{Type: BackendDisconnected, Service: "app.80"})
+
+	e := <-c
+	if e.Type != BackendConnected || e.Time.IsZero() {
+		t.Error(
+			"For", "first event",
+			"expected", BackendConnected,
+			"got", e,
+		)
+	}
+
+	// Buffer was full, the second event is dropped
+	select {
+	case e := <-c:
+		t.Error(
+			"For", "full buffer",
+			"expected", "dropped event",
+			"got", e,
+		)
+	default:
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-c; ok {
+		t.Error(
+			"For", "cancel",
+			"expected", "closed channel",
+			"got", ok,
+		)
+	}
+
+	// Publishing after cancel must not panic or block
+	done := make(chan bool)
+	go func() {
+		Publish(Event{Type: ExportConnected})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("For", "publish", "expected", "no block", "got", "timeout")
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	c, cancel := bus.Subscribe(1)
+	defer cancel()
+	d, cancelDefault := Subscribe(1)
+	defer cancelDefault()
+
+	// Buses do not see each other's events
+	Publish(Event{Type: ExportConnected})
+	bus.Publish(Event{Type: ExportReady})
+
+	if e := <-c; e.Type != ExportReady {
+		t.Error("For", "bus", "expected", ExportReady, "got", e)
+	}
+	if e := <-d; e.Type != ExportConnected {
+		t.Error("For", "default bus", "expected", ExportConnected, "got", e)
+	}
+}
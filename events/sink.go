@@ -0,0 +1,115 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+/*
+ * Event sink writing NDJSON, one event per line. Targets
+ *   -           standard output
+ *   unix:/path  unix socket of a listening consumer, redialed after errors
+ *   path        file, events are appended
+ */
+type Sink struct {
+	target string
+	w      io.WriteCloser
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+/*
+ * Open sink for target.
+ * Files must be writable right away, unix sockets are dialed on the
+ * first event so the consumer may start later.
+ */
+func OpenSink(target string) (*Sink, error) {
+	s := &Sink{target: target}
+	if strings.HasPrefix(target, "unix:") {
+		return s, nil
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sink) open() error {
+	if s.target == "-" {
+		s.w = nopCloser{os.Stdout}
+		return nil
+	}
+
+	if strings.HasPrefix(s.target, "unix:") {
+		conn, err := net.Dial("unix", strings.TrimPrefix(s.target, "unix:"))
+		if err != nil {
+			return err
+		}
+		s.w = conn
+		return nil
+	}
+
+	f, err := os.OpenFile(s.target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.w = f
+	return nil
+}
+
+/*
+ * Write event as a line of JSON
+ */
+func (s *Sink) Write(e Event) error {
+	if s.w == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		// Reopen on the next event
+		s.w.Close()
+		s.w = nil
+		return err
+	}
+	return nil
+}
+
+/*
+ * Write events of c until it is closed, errors are logged and the
+ * event is lost.
+ */
+func (s *Sink) Run(c <-chan Event) {
+	for e := range c {
+		if err := s.Write(e); err != nil {
+			log.Debug("Events: write to ", s.target, " failed: ", err)
+		}
+	}
+}
+
+func (s *Sink) Close() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
@@ -0,0 +1,91 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSinkFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.ndjson")
+	s, err := OpenSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Write(Event{Type: ExportRetry, Service: "web.80"})
+	s.Write(Event{Type: ChildExited, Pid: 42})
+	s.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"type":"export-retry","time":"0001-01-01T00:00:00Z","service":"web.80"}` + "\n" +
+		`{"type":"child-exited","time":"0001-01-01T00:00:00Z","pid":42}` + "\n"
+	if string(data) != expected {
+		t.Error(
+			"For", path,
+			"expected", expected,
+			"got", string(data),
+		)
+	}
+}
+
+func TestSinkUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.sock")
+
+	// Consumer starts after the sink
+	s, err := OpenSink("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(Event{Type: PortRegistered}); err == nil {
+		t.Error("For", "missing consumer", "expected", "error", "got", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := s.Write(Event{Type: PortRegistered, Port: 8080}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var e Event
+	line, _ := bufio.NewReader(conn).ReadBytes('\n')
+	if err := json.Unmarshal(line, &e); err != nil || e.Port != 8080 {
+		t.Error(
+			"For", "unix socket",
+			"expected", 8080,
+			"got", string(line),
+		)
+	}
+}
@@ -0,0 +1,289 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Probe checks a single address once.
+ */
+type Probe interface {
+	Check(ctx context.Context, addr string) error
+}
+
+/*
+ * Parse probe spec
+ * Formats tcp              - TCP connect
+ *         http[:/path]     - HTTP GET, 2xx and 3xx are healthy
+ *         exec:/path/cmd   - command exits 0, LOCALHOST and LOCALPORT are set
+ */
+func Parse(spec string) (Probe, error) {
+	kind, arg := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, arg = spec[:idx], spec[idx+1:]
+	}
+
+	switch kind {
+	case "tcp":
+		if arg != "" {
+			break
+		}
+		return tcpProbe{}, nil
+	case "http":
+		if arg == "" {
+			arg = "/"
+		}
+		if !strings.HasPrefix(arg, "/") {
+			break
+		}
+		return httpProbe{path: arg}, nil
+	case "exec":
+		if arg == "" {
+			break
+		}
+		return execProbe{cmd: arg}, nil
+	}
+
+	return nil, fmt.Errorf("invalid probe %q, expected tcp, http[:/path] or exec:/path/cmd", spec)
+}
+
+type tcpProbe struct{}
+
+func (tcpProbe) Check(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type httpProbe struct {
+	path string
+}
+
+func (p httpProbe) Check(ctx context.Context, addr string) error {
+	req, err := http.NewRequest("GET", "http://"+addr+p.path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type execProbe struct {
+	cmd string
+}
+
+func (p execProbe) Check(ctx context.Context, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	c := exec.CommandContext(ctx, p.cmd)
+	env := os.Environ()
+	env = append(env, fmt.Sprintf("LOCALHOST=%s", host))
+	env = append(env, fmt.Sprintf("LOCALPORT=%s", port))
+	c.Env = env
+	return c.Run()
+}
+
+/*
+ * Checker settings
+ */
+type Checker struct {
+	Probe    Probe
+	Interval time.Duration // Time between probes
+	Timeout  time.Duration // Timeout of a single probe
+	Rise     int           // Consecutive successes to become healthy
+	Fall     int           // Consecutive failures to become unhealthy
+}
+
+/*
+ * Monitor runs the checker against one address and reports transitions.
+ * Targets start healthy unless started with StartUnhealthy.
+ * Transitions are delivered in order by a goroutine of the monitor, so a
+ * slow notify never blocks probes, Fail or Healthy.
+ */
+type Monitor struct {
+	checker Checker
+	addr    string
+	notify  func(healthy bool)
+
+	mu      sync.Mutex
+	healthy bool
+	count   int    // consecutive results disagreeing with the current state
+	pending []bool // transitions not yet delivered
+	wake    chan bool
+
+	cancel context.CancelFunc
+}
+
+/*
+ * Start monitoring addr, notify is called on every state transition.
+ */
+func (c Checker) Start(addr string, notify func(healthy bool)) *Monitor {
+	return c.start(addr, notify, true)
+}
+
+/*
+ * Start monitoring addr, which must pass Rise probes to become healthy,
+ * e.g. a service that may still be starting.
+ */
+func (c Checker) StartUnhealthy(addr string, notify func(healthy bool)) *Monitor {
+	return c.start(addr, notify, false)
+}
+
+func (c Checker) start(addr string, notify func(healthy bool), healthy bool) *Monitor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &Monitor{
+		checker: c,
+		addr:    addr,
+		notify:  notify,
+		healthy: healthy,
+		wake:    make(chan bool, 1),
+		cancel:  cancel,
+	}
+
+	go m.run(ctx)
+	go m.deliver(ctx)
+	return m
+}
+
+func (m *Monitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.checker.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, m.checker.Timeout)
+		err := m.checker.Probe.Check(pctx, m.addr)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.report(err == nil)
+	}
+}
+
+/*
+ * Deliver queued transitions until the monitor is stopped
+ */
+func (m *Monitor) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		}
+
+		m.mu.Lock()
+		pending := m.pending
+		m.pending = nil
+		m.mu.Unlock()
+
+		for _, healthy := range pending {
+			if ctx.Err() != nil {
+				return
+			}
+			m.notify(healthy)
+		}
+	}
+}
+
+/*
+ * Queue transition, called with the lock held
+ */
+func (m *Monitor) transition(healthy bool) {
+	m.healthy = healthy
+	m.count = 0
+	m.pending = append(m.pending, healthy)
+
+	select {
+	case m.wake <- true:
+	default:
+	}
+}
+
+/*
+ * Record a probe result and queue transition when threshold is reached.
+ */
+func (m *Monitor) report(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ok == m.healthy {
+		m.count = 0
+		return
+	}
+
+	m.count++
+	threshold := m.checker.Fall
+	if ok {
+		threshold = m.checker.Rise
+	}
+
+	if m.count < threshold {
+		return
+	}
+
+	m.transition(ok)
+}
+
+/*
+ * Fail marks the target unhealthy right away, e.g. after a failed dial.
+ * It must then pass Rise probes to become healthy again.
+ */
+func (m *Monitor) Fail() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.healthy {
+		return
+	}
+
+	m.transition(false)
+}
+
+/*
+ * Current state
+ */
+func (m *Monitor) Healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.healthy
+}
+
+/*
+ * Stop monitoring, transitions not yet delivered are dropped
+ */
+func (m *Monitor) Stop() {
+	m.cancel()
+}
@@ -0,0 +1,232 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"tcp", "http", "http:/healthz", "exec:/bin/true"}
+	for _, spec := range valid {
+		if _, err := Parse(spec); err != nil {
+			t.Error(
+				"For", spec,
+				"expected", nil,
+				"got", err,
+			)
+		}
+	}
+
+	invalid := []string{"", "udp", "tcp:80", "http:healthz", "exec:"}
+	for _, spec := range invalid {
+		if _, err := Parse(spec); err == nil {
+			t.Error(
+				"For", spec,
+				"expected", "error",
+				"got", nil,
+			)
+		}
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	ok, _ := Parse("http:/healthz")
+	if err := ok.Check(context.Background(), addr); err != nil {
+		t.Error(
+			"For", "/healthz",
+			"expected", nil,
+			"got", err,
+		)
+	}
+
+	bad, _ := Parse("http:/")
+	if err := bad.Check(context.Background(), addr); err == nil {
+		t.Error(
+			"For", "/",
+			"expected", "error",
+			"got", nil,
+		)
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	p, _ := Parse("tcp")
+	if err := p.Check(context.Background(), addr); err != nil {
+		t.Error(
+			"For", addr,
+			"expected", nil,
+			"got", err,
+		)
+	}
+
+	l.Close()
+	if err := p.Check(context.Background(), addr); err == nil {
+		t.Error(
+			"For", addr,
+			"expected", "error",
+			"got", nil,
+		)
+	}
+}
+
+/*
+ * Probe returning scripted results
+ */
+type fakeProbe struct {
+	mu      sync.Mutex
+	results []bool
+}
+
+func (p *fakeProbe) Check(ctx context.Context, addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ok := true
+	if len(p.results) > 0 {
+		ok, p.results = p.results[0], p.results[1:]
+	}
+	if !ok {
+		return errors.New("down")
+	}
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	probe := &fakeProbe{results: []bool{false, false, true, false, false, true, true}}
+	c := Checker{
+		Probe:    probe,
+		Interval: time.Millisecond,
+		Timeout:  time.Second,
+		Rise:     2,
+		Fall:     2,
+	}
+
+	transitions := make(chan bool, 10)
+	m := c.Start("127.0.0.1:1", func(healthy bool) {
+		transitions <- healthy
+	})
+	defer m.Stop()
+
+	for _, expected := range []bool{false, true} {
+		select {
+		case healthy := <-transitions:
+			if healthy != expected {
+				t.Error(
+					"For", "transition",
+					"expected", expected,
+					"got", healthy,
+				)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for transition")
+		}
+	}
+}
+
+func TestMonitorFail(t *testing.T) {
+	c := Checker{
+		Probe:    &fakeProbe{},
+		Interval: time.Hour,
+		Timeout:  time.Second,
+		Rise:     1,
+		Fall:     1,
+	}
+
+	// notify blocks like a slow hook until released
+	release := make(chan bool)
+	transitions := make(chan bool, 10)
+	m := c.Start("127.0.0.1:1", func(healthy bool) {
+		<-release
+		transitions <- healthy
+	})
+	defer m.Stop()
+
+	done := make(chan bool)
+	go func() {
+		m.Fail()
+		m.Fail()
+		m.report(true)
+		m.Fail()
+		done <- m.Healthy()
+	}()
+
+	select {
+	case healthy := <-done:
+		if healthy {
+			t.Error("For", "Fail", "expected", false, "got", healthy)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail blocked on notify")
+	}
+
+	close(release)
+	for _, expected := range []bool{false, true, false} {
+		select {
+		case healthy := <-transitions:
+			if healthy != expected {
+				t.Error(
+					"For", "transition",
+					"expected", expected,
+					"got", healthy,
+				)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for transition")
+		}
+	}
+}
+
+func TestStartUnhealthy(t *testing.T) {
+	c := Checker{
+		Probe:    &fakeProbe{results: []bool{false, true, true}},
+		Interval: time.Millisecond,
+		Timeout:  time.Second,
+		Rise:     2,
+		Fall:     1,
+	}
+
+	transitions := make(chan bool, 10)
+	m := c.StartUnhealthy("127.0.0.1:1", func(healthy bool) {
+		transitions <- healthy
+	})
+	defer m.Stop()
+
+	if m.Healthy() {
+		t.Error("For", "new monitor", "expected", false, "got", true)
+	}
+
+	select {
+	case healthy := <-transitions:
+		if !healthy {
+			t.Error(
+				"For", "transition",
+				"expected", true,
+				"got", healthy,
+			)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for transition")
+	}
+}
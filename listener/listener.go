@@ -1,110 +1,246 @@
 package main
 
+/*
+#include <errno.h>
+
+static void set_errno(int e) { errno = e; }
+*/
+import "C"
+
 import (
-    "C"
-    "syscall"
+    "bufio"
+    "fmt"
     "log"
-    "net/rpc"
+    "net"
     "os"
-    
+    "strings"
+    "sync"
+    "syscall"
+
     "github.com/microstacks/stack/endpoint/opt/register"
     "github.com/rainycape/dl"
 )
 
 // go build -buildmode=c-shared -o listener.so listener.go
 
+/*
+ * LD_PRELOAD hook reporting listening ports of the command to the router.
+ *
+ * Hooks may run on any thread of the program and in forked children, so
+ * no socket is tracked by fd. A socket is reported when listen succeeds
+ * and withdrawn when a close leaves no listening socket on its port, as
+ * read from /proc/net/tcp. dup'ed fds, sockets inherited by children and
+ * SO_REUSEPORT groups keep the port until their last socket closes.
+ * The real libc function is always called, whether the router answers or not.
+ * Ports are registered over the socket of register.SocketEnv.
+ * A function that cannot be resolved fails with ENOSYS and reports nothing,
+ * the program is never terminated by the hook.
+ */
+
 func main() {}
 
-var client *rpc.Client
+/*
+ * Real libc functions, resolved once, nil if they could not be
+ */
+var libc struct {
+    once   sync.Once
+    listen func(fd C.int, backlog C.int) int32
+    close  func(fd C.int) int32
+    dup2   func(oldfd C.int, newfd C.int) int32
+    dup3   func(oldfd C.int, newfd C.int, flags C.int) int32
+}
+
+func resolve() {
+    libc.once.Do(func() {
+        // Kept open for the lifetime of the process
+        lib, err := dl.Open("libc", 0)
+        if err != nil {
+            log.Println("Error opening libc", err)
+            return
+        }
 
-var ports map[uint32]int = make(map[uint32]int, 1)
+        var listen func(fd C.int, backlog C.int) int32
+        var close func(fd C.int) int32
+        var dup2 func(oldfd C.int, newfd C.int) int32
+        var dup3 func(oldfd C.int, newfd C.int, flags C.int) int32
 
-//export listen
-func listen(fd C.int, backlog C.int) int32 {
-    
-    lib, err := dl.Open("libc", 0)
-    if err != nil {
-        log.Println("Error opening libc", err)
-        return 0
+        // Only symbols resolved without error are used
+        for name, sym := range map[string]interface{}{
+            "listen": &listen,
+            "close":  &close,
+            "dup2":   &dup2,
+            "dup3":   &dup3,
+        } {
+            if err := lib.Sym(name, sym); err != nil {
+                log.Println("Error resolving", name, err)
+                continue
+            }
+            switch name {
+                case "listen":
+                    libc.listen = listen
+                case "close":
+                    libc.close = close
+                case "dup2":
+                    libc.dup2 = dup2
+                case "dup3":
+                    libc.dup3 = dup3
+            }
+        }
+    })
+}
+
+/*
+ * Result of a libc function that could not be resolved
+ */
+func unresolved() int32 {
+    C.set_errno(C.ENOSYS)
+    return -1
+}
+
+/*
+ * Report port to the router, errors are logged only
+ */
+func send(action string, addr net.IP, port uint32) {
+    m := register.Message{
+        Action:   action,
+        Pid:      os.Getpid(),
+        BindAddr: addr.String(),
+        Proto:    "tcp",
+        Port:     port,
     }
-    defer lib.Close()
 
-    var reallisten func(fd C.int, backlog C.int) int32
-    lib.Sym("listen", &reallisten)
+    if err := register.Send(m); err != nil {
+        log.Println("Registration of port", port, "failed:", err)
+    }
+}
+
+/*
+ * Address and port of a listening IPv4 or IPv6 TCP socket
+ */
+func listeningAddr(fd C.int) (net.IP, uint32, bool) {
+    accepting, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+    if err != nil || accepting == 0 {
+        return nil, 0, false
+    }
 
     sock, err := syscall.Getsockname(int(fd))
-    if (err != nil) {
-        log.Println("Error getting socket name", err)
-        return reallisten(fd, backlog)        
+    if err != nil {
+        return nil, 0, false
     }
-    
-    switch sock.(type) {
+
+    switch sa := sock.(type) {
         case *syscall.SockaddrInet4:
-            var err error
-            port := uint32(sock.(*syscall.SockaddrInet4).Port)
-            if client == nil {
-                client, err = rpc.DialHTTP("tcp", "localhost:3877")
-                if err != nil {
-                    log.Println("dialing:", err)
-                    return 107
-                }
+            return net.IP(sa.Addr[:]), uint32(sa.Port), true
+        case *syscall.SockaddrInet6:
+            return net.IP(sa.Addr[:]), uint32(sa.Port), true
+    }
+    return nil, 0, false
+}
+
+/*
+ * Check if any socket still listens on port
+ */
+func stillListening(port uint32) bool {
+    suffix := fmt.Sprintf(":%04X", port)
+
+    for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+        f, err := os.Open(path)
+        if err != nil {
+            continue
+        }
+
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+            fields := strings.Fields(scanner.Text())
+            // st 0A is TCP_LISTEN
+            if len(fields) > 3 && fields[3] == "0A" && strings.HasSuffix(fields[1], suffix) {
+                f.Close()
+                return true
             }
+        }
+        f.Close()
+    }
+
+    return false
+}
+
+/*
+ * Withdraw port unless another socket keeps listening on it
+ */
+func closed(addr net.IP, port uint32) {
+    if stillListening(port) {
+        return
+    }
+
+    log.Println("Listening port", port, "closed by pid=", os.Getpid())
+    send(register.ActionClose, addr, port)
+}
 
-            args := &register.Args{Lport: port,
-                                   Rport: port,}
-            var errno int
-            client.Call("RPC.Connect", args, &errno)
-            pid := os.Getpid()
-            ports[port] = pid
-            log.Println("Listening port opened by pid=", pid)
+//export listen
+func listen(fd C.int, backlog C.int) int32 {
+    resolve()
+    if libc.listen == nil {
+        return unresolved()
+    }
+
+    ret := libc.listen(fd, backlog)
+    if ret != 0 {
+        return ret
     }
 
-    return reallisten(fd, backlog)
+    if addr, port, ok := listeningAddr(fd); ok {
+        log.Println("Listening port", port, "opened by pid=", os.Getpid())
+        send(register.ActionListen, addr, port)
+    }
+
+    return ret
 }
 
 //export close
 func close(fd C.int) int32 {
-    
-    lib, err := dl.Open("libc", 0)
-    if err != nil {
-        log.Println("Error opening libc", err)
-        return 0
+    resolve()
+    if libc.close == nil {
+        return unresolved()
     }
-    defer lib.Close()
 
-    var realclose func(fd C.int) int32
-    lib.Sym("close", &realclose)
+    addr, port, ok := listeningAddr(fd)
+    ret := libc.close(fd)
 
-    sock, err := syscall.Getsockname(int(fd))
-    if (err != nil) {
-        return realclose(fd)
+    if ok && ret == 0 {
+        closed(addr, port)
     }
-    
-    switch sock.(type) {
-        case *syscall.SockaddrInet4:
-            var err error
-            port := uint32(sock.(*syscall.SockaddrInet4).Port)
-        
-            if _, ok := ports[port]; ok {
-                if client == nil {
-                    client, err = rpc.DialHTTP("tcp", "localhost:3877")
-                    if err != nil {
-                        log.Println("dialing:", err)
-                        return 107
-                    }
-                }
-
-                pid := os.Getpid()
-                if ports[port] == pid {
-                    log.Println("Listening port closed by pid=", pid)
-                    args := &register.Args{Lport: port,
-                                           Rport: port,}
-                    var errno int
-                    client.Call("RPC.Disconnect", args, &errno)
-                    delete(ports, port)
-                }
-            }
+    return ret
+}
+
+//export dup2
+func dup2(oldfd C.int, newfd C.int) int32 {
+    resolve()
+    if libc.dup2 == nil {
+        return unresolved()
     }
 
-    return realclose(fd)
+    // newfd is closed if open
+    addr, port, ok := listeningAddr(newfd)
+    ret := libc.dup2(oldfd, newfd)
+
+    if ok && ret >= 0 && oldfd != newfd {
+        closed(addr, port)
+    }
+    return ret
+}
+
+//export dup3
+func dup3(oldfd C.int, newfd C.int, flags C.int) int32 {
+    resolve()
+    if libc.dup3 == nil {
+        return unresolved()
+    }
+
+    addr, port, ok := listeningAddr(newfd)
+    ret := libc.dup3(oldfd, newfd, flags)
+
+    if ok && ret >= 0 {
+        closed(addr, port)
+    }
+    return ret
 }
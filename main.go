@@ -1,24 +1,66 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/common/log"
+	"github.com/microstacks/stack/endpoint/admin"
+	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/config"
 	"github.com/microstacks/stack/endpoint/dns"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/metrics"
 	"github.com/microstacks/stack/endpoint/opt/export"
 	"github.com/microstacks/stack/endpoint/opt/import"
+	"github.com/microstacks/stack/endpoint/opt/register"
+	"github.com/microstacks/stack/endpoint/router"
+	"github.com/microstacks/stack/endpoint/server"
+	"github.com/microstacks/stack/endpoint/supervisor"
 	"github.com/microstacks/stack/endpoint/utils"
 	"github.com/microstacks/stack/endpoint/version"
 	"github.com/urfave/cli"
 )
 
+/*
+ *  Time in-flight connections get to finish when draining
+ */
+var drainTimeout = 30 * time.Second
+
+/*
+ *  Supervisor of the processes, nil until they are started
+ */
+var supervised struct {
+	sync.Mutex
+	sup *supervisor.Supervisor
+}
+
+/*
+ *  Send sig to the supervised processes and wait for them to exit.
+ *  Processes still running after the drain timeout are killed.
+ */
+func stopProcesses(sig syscall.Signal) {
+	supervised.Lock()
+	sup := supervised.sup
+	supervised.Unlock()
+	if sup == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := sup.Stop(ctx, sig); err != nil {
+		log.Error("Processes killed: ", err)
+	}
+}
+
 /*
  *  Cleanup before exit
  */
@@ -28,32 +70,132 @@ func cleanup() {
 	Import.Cleanup()
 }
 
+/*
+ *  Drain imports and exports.
+ *  Stop accepting new connections and let in-flight ones finish.
+ */
+func drain() {
+	log.Debug("Draining, timeout ", drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() { errs <- Import.Drain(ctx) }()
+	go func() { errs <- Export.Drain(ctx) }()
+
+	for n := 0; n < 2; n++ {
+		if err := <-errs; err != nil {
+			log.Error("Drain incomplete: ", err)
+		}
+	}
+}
+
 /*
  *  Install Signal handler for proper cleanup.
  */
 func installHandler() {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		sig := <-sigs
 		log.Debug(sig)
-		pgid, _ := syscall.Getpgid(syscall.Getpid())
-		switch sig {
-		case syscall.SIGHUP:
-			syscall.Kill(-pgid, syscall.SIGHUP)
-		case syscall.SIGTERM:
-			syscall.Kill(-pgid, syscall.SIGTERM)
-		case syscall.SIGINT:
-			syscall.Kill(-pgid, syscall.SIGINT)
-		case syscall.SIGQUIT:
-			syscall.Kill(-pgid, syscall.SIGQUIT)
+		// Processes lead their own process groups
+		if sig == syscall.SIGTERM {
+			// Graceful shutdown
+			drain()
+			stopProcesses(syscall.SIGTERM)
+			cleanup()
+			os.Exit(0)
 		}
+		stopProcesses(sig.(syscall.Signal))
 		cleanup()
 		os.Exit(1)
 	}()
 
 }
 
+/*
+ *  Load config file given by --config, empty config without one.
+ */
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	path := c.String("config")
+	if path == "" {
+		return &config.Config{}, nil
+	}
+	return config.Load(path)
+}
+
+/*
+ *  Import and export options of the flags followed by the config file.
+ */
+func serviceOptions(c *cli.Context, cfg *config.Config) ([]string, []string) {
+	imports := append(c.StringSlice("import"), cfg.ImportOptions()...)
+	exports := append(c.StringSlice("export"), cfg.ExportOptions()...)
+	return imports, exports
+}
+
+/*
+ *  Export options of the flags and the config file, owned by the
+ *  command under the empty name, and those of the processes.
+ */
+func exportOwners(exports []string, processes []config.Process) *Export.Owners {
+	owners := &Export.Owners{}
+	owners.Set("", exports)
+	for _, p := range processes {
+		owners.Set(p.Name, p.ExportOptions())
+	}
+	return owners
+}
+
+/*
+ *  Check import and export options, all malformed ones are reported.
+ */
+func validateOptions(imports []string, exports []string) error {
+	errs := append(Import.Validate(imports), Export.Validate(exports)...)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, len(errs))
+	for n, err := range errs {
+		msgs[n] = err.Error()
+	}
+	return fmt.Errorf("invalid options\n  %s", strings.Join(msgs, "\n  "))
+}
+
+/*
+ *  validate subcommand.
+ *  Options and config file are checked without starting the router,
+ *  they are taken from the subcommand and the global flags.
+ */
+func validate(c *cli.Context) error {
+	path := c.String("config")
+	if path == "" {
+		path = c.GlobalString("config")
+	}
+
+	cfg := &config.Config{}
+	if path != "" {
+		var err error
+		if cfg, err = config.Load(path); err != nil {
+			return err
+		}
+	}
+
+	imports := append(c.GlobalStringSlice("import"), c.StringSlice("import")...)
+	imports = append(imports, cfg.ImportOptions()...)
+	exports := append(c.GlobalStringSlice("export"), c.StringSlice("export")...)
+	exports = append(exports, cfg.ExportOptions()...)
+	exports = exportOwners(exports, cfg.Processes).Options()
+
+	if err := validateOptions(imports, exports); err != nil {
+		return err
+	}
+
+	fmt.Printf("OK: %d imports, %d exports\n", len(imports), len(exports))
+	return nil
+}
+
 /*
  * Increase ulimit to handle large concurrent connections.
  */
@@ -110,26 +252,124 @@ func main() {
 			Name:  "debug, D",
 			Usage: "Enable debug logging",
 		},
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "Load imports, exports and settings from a YAML, JSON or TOML `file`, flags and env vars take precedence",
+		},
 		cli.StringSliceFlag{
 			Name:  "import, i",
-			Usage: "Import server component in local address space. Format `app:port[>laddr:lport]` e.g. db:3306 or app:8000>eth0:80",
+			Usage: "Import server component in local address space. Format `app:port[>laddr:lport][/udp][,lb=rr|leastconn|wrr|p2c|hash][,retries=n][,timeout=d][,cooldown=d][,idle-timeout=d][,check=tcp|http:/path|exec:cmd][,rise=n][,fall=n][,authorized-keys=path][,on-connect=script][,on-disconnect=script]` e.g. db:3306 or app:8000>eth0:80,lb=leastconn or dns:53/udp",
 		},
 		cli.StringSliceFlag{
 			Name:  "export, e",
-			Usage: "Export this service. Format `app:port@raddr[:rport]` e.g. app:80@lb or app:80@lb:80 or app:80@lb:0",
+			Usage: "Export this service. Format `app:port@raddr[:rport][/udp][,weight=n][,check=tcp|http:/path|exec:cmd][,rise=n][,fall=n][,identity=file][,known-hosts=file][,host-fingerprint=fp[|fp]]` e.g. app:80@lb or app:80@lb:80 or app:80@lb:0,weight=2 or app:80@lb,check=http:/ready or dns:53@lb/udp",
+		},
+		cli.StringFlag{
+			Name:  "detect",
+			Usage: "Detect ports of the command for wildcard exports with `method` preload (LD_PRELOAD hook) or procfs (polls /proc/net/tcp, works for static binaries)",
+			Value: "preload",
+		},
+		cli.StringFlag{
+			Name:  "restart",
+			Usage: "Restart `policy` of the command, always, on-failure or never. The router exits with the exit code of its processes once none is left to restart",
+			Value: supervisor.Never,
+		},
+		cli.DurationFlag{
+			Name:  "max-backoff",
+			Usage: "Maximum delay before restarting a process, delays double from 1s on every restart",
+			Value: supervisor.DefaultMaxBackoff,
+		},
+		cli.StringFlag{
+			Name:  "register-socket",
+			Usage: "Unix socket `path` listener.so registers the ports of the command on, with --detect preload. Defaults to /var/lib/dupper/register.INSTANCE.sock",
 		},
 		cli.IntFlag{
 			Name:  "interval, t",
 			Usage: "Interval to detect new hosts, used with --export for wildcard option",
 			Value: 10,
 		},
+		cli.StringFlag{
+			Name:  "identity, k",
+			Usage: "Private key `file` used by --export to authenticate with the remote router",
+		},
+		cli.StringFlag{
+			Name:  "authorized-keys",
+			Usage: "authorized_keys `path` accepted for --import services, either a single file or a directory with one file per service user, e.g. app.8000 or dns.53.udp",
+		},
+		cli.StringFlag{
+			Name:  "host-key",
+			Usage: "SSH host key `file` of the router, generated on first start",
+			Value: server.DefaultHostKey,
+		},
+		cli.StringFlag{
+			Name:  "known-hosts",
+			Usage: "known_hosts `file` used by --export to verify the remote router host key",
+		},
+		cli.StringSliceFlag{
+			Name:  "host-fingerprint",
+			Usage: "Pinned SHA256 host key `fingerprint` of the remote router, used by --export. Exports fail to connect unless --known-hosts or --host-fingerprint is set",
+		},
+		cli.BoolFlag{
+			Name:  "insecure-host-key",
+			Usage: "Accept any remote router host key for exports without --known-hosts or --host-fingerprint",
+		},
+		cli.BoolFlag{
+			Name:  "no-password",
+			Usage: "Disable password authentication, PASSWD is ignored",
+		},
+		cli.BoolFlag{
+			Name:  "ipv6",
+			Usage: "Route " + dns.Loopback6 + " to lo so services also bind to an IPv6 address of the instance, BINDADDR6",
+		},
+		cli.DurationFlag{
+			Name:  "drain-timeout",
+			Usage: "Time in-flight connections get to finish on SIGTERM or SIGUSR2",
+			Value: drainTimeout,
+		},
+		cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "Serve Prometheus metrics on `addr` at /metrics, e.g. :9100",
+		},
+		cli.StringFlag{
+			Name:  "admin-addr",
+			Usage: "Serve the admin API on `addr`, either unix:/path/to/socket (recommended) or host:port. Addresses other than loopback require a token in ADMIN_TOKEN, sent as Authorization: Bearer <token>",
+		},
+		cli.StringFlag{
+			Name:  "events",
+			Usage: "Write connection and process events as NDJSON to `target`, a file, - for stdout or unix:/path of a listening socket",
+		},
 		cli.StringFlag{
 			Name:  "on-connect, oc",
-			Usage: "execute command on service connect",
+			Usage: "Hook `script` run with bash when a service connects",
+			Value: utils.OnConnectHook,
 		},
 		cli.StringFlag{
 			Name:  "on-disconnect, od",
-			Usage: "execute command on service disconnect",
+			Usage: "Hook `script` run with bash when a service disconnects",
+			Value: utils.OnDisconnectHook,
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "validate",
+			Usage:     "Check --import and --export options and the --config file without starting the router",
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "Config `file` to check",
+				},
+				cli.StringSliceFlag{
+					Name:  "import, i",
+					Usage: "Import option to check, see endpoint --help",
+				},
+				cli.StringSliceFlag{
+					Name:  "export, e",
+					Usage: "Export option to check, see endpoint --help",
+				},
+			},
+			Action: validate,
 		},
 	}
 
@@ -140,123 +380,344 @@ func main() {
 			log.Base().SetLevel("debug")
 		}
 
+		drainTimeout = c.Duration("drain-timeout")
+
 		return nil
 	}
 
 	app.Action = func(c *cli.Context) error {
-		passwd := os.Getenv("PASSWD")
+		cfg, err := loadConfig(c)
+		if err != nil {
+			return err
+		}
+
+		// Flag value unless only the config file sets it
+		str := func(name string, fallback string) string {
+			if c.IsSet(name) || fallback == "" {
+				return c.String(name)
+			}
+			return fallback
+		}
+
+		// Env var unless only the config file sets it
+		env := func(name string, fallback string) string {
+			if value, ok := os.LookupEnv(name); ok || fallback == "" {
+				return value
+			}
+			return fallback
+		}
+
+		if cfg.DrainTimeout != "" && !c.IsSet("drain-timeout") {
+			drainTimeout, _ = time.ParseDuration(cfg.DrainTimeout)
+		}
+
+		passwd := env("PASSWD", cfg.Password)
 		if passwd == "" {
 			passwd = "123456789"
 		}
 
-		// Set ulimit to max
-		ulimit(999999)
+		if c.Bool("no-password") || cfg.NoPassword {
+			passwd = ""
+		}
 
-		// Start local DNS server
-		dns.Start()
-		port := os.Getenv("PORT")
-		log.Debug("PORT=", port)
-		instance, _ := strconv.Atoi(os.Getenv("INSTANCE"))
-		bindaddr := dns.GenerateIP(uint32(instance)).String()
-		log.Debug("BINDADDR=", bindaddr)
-		os.Setenv("BINDADDR", bindaddr)
+		utils.OnConnectHook = str("on-connect", cfg.Hooks.OnConnect)
+		utils.OnDisconnectHook = str("on-disconnect", cfg.Hooks.OnDisconnect)
+
+		serverAuth := server.Auth{
+			AuthorizedKeys: str("authorized-keys", cfg.Auth.AuthorizedKeys),
+			HostKey:        str("host-key", cfg.Auth.HostKey),
+		}
+
+		fingerprints := c.StringSlice("host-fingerprint")
+		if len(fingerprints) == 0 {
+			fingerprints = cfg.Auth.HostFingerprints
+		}
+
+		clientAuth := client.Auth{
+			IdentityFile:    str("identity", cfg.Auth.Identity),
+			KnownHosts:      str("known-hosts", cfg.Auth.KnownHosts),
+			Fingerprints:    fingerprints,
+			InsecureHostKey: c.Bool("insecure-host-key") || cfg.Auth.InsecureHostKey,
+		}
+		if clientAuth.InsecureHostKey {
+			log.Warn("Host keys of remote routers are not verified without known hosts or fingerprints")
+		}
+
+		imports, exports := serviceOptions(c, cfg)
+		processes := cfg.Processes
+		if err := validateOptions(imports, exportOwners(exports, processes).Options()); err != nil {
+			return err
+		}
 
 		// Poll specific values
 		interval := c.Int("interval")
+		if cfg.Interval > 0 && !c.IsSet("interval") {
+			interval = cfg.Interval
+		}
 
-		debug := c.Bool("D")
+		port := env("PORT", cfg.Port)
+		log.Debug("PORT=", port)
+
+		detect := str("detect", cfg.Detect)
+		if detect != "preload" && detect != "procfs" {
+			return fmt.Errorf("invalid --detect %q: must be preload or procfs", detect)
+		}
+		instance, _ := strconv.Atoi(env("INSTANCE", strconv.Itoa(cfg.Instance)))
+
+		// The command of the arguments followed by the processes of the config file
+		var procs []supervisor.Process
+		if args := c.Args(); len(args) > 0 {
+			restart := str("restart", cfg.Restart)
+			if err := supervisor.CheckPolicy(restart); err != nil {
+				return err
+			}
+			procs = append(procs, supervisor.Process{Command: args, Restart: restart})
+		}
+		for _, p := range processes {
+			procs = append(procs, supervisor.Process{Name: p.Name, Command: p.Command, Restart: p.Restart})
+		}
+
+		maxBackoff := c.Duration("max-backoff")
+		if cfg.MaxBackoff != "" && !c.IsSet("max-backoff") {
+			maxBackoff, _ = time.ParseDuration(cfg.MaxBackoff)
+		}
+
+		rt := &router.Router{
+			BindAddr: dns.GenerateIP(uint32(instance)).String(),
+			Password: passwd,
+			Interval: interval,
+			Debug:    c.Bool("D"),
+		}
+		log.Debug("BINDADDR=", rt.BindAddr)
+
+		// Services get an IPv6 address too when asked for and its prefix can be routed
+		if c.Bool("ipv6") || cfg.IPv6 {
+			if err := dns.RouteLoopback6(); err != nil {
+				log.Error("IPv6 loopback unavailable: ", err)
+			} else {
+				rt.BindAddr6 = dns.GenerateIP6(uint32(instance)).String()
+			}
+		}
+		log.Debug("BINDADDR6=", rt.BindAddr6)
+
+		// Guards imports and exports against reloads during a reboot
+		var mu sync.Mutex
+
+		// Exports by process, with the processes that are down
+		owners := exportOwners(exports, processes)
+
+		// Processes started with the router, others need a restart
+		started := make(map[string]bool, len(processes))
+		for _, p := range processes {
+			started[p.Name] = true
+		}
+
+		// Withdraw or re-establish the exports of a process,
+		// ctx is cancelled on reboot
+		setDown := func(ctx context.Context, name string, isDown bool) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			// A reboot connects all exports again
+			if ctx.Err() != nil || !owners.SetDown(name, isDown) {
+				return
+			}
+
+			if err := Export.Reload(rt, clientAuth, owners.Options()); err != nil {
+				log.Error("Exports of ", name, " not updated: ", err)
+			}
+		}
+
+		// Re-read the config file, only added and removed services
+		// start or stop, also those of the processes. Other settings
+		// and processes need a restart.
+		reload := func() error {
+			cfg, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// Exports of the processes are checked like on start
+			newImports, newExports := serviceOptions(c, cfg)
+			if err := validateOptions(newImports, exportOwners(newExports, cfg.Processes).Options()); err != nil {
+				return err
+			}
+
+			// Exports reload even if a load balancer port cannot be bound
+			imports, exports = newImports, newExports
+			importErr := Import.Reload(imports)
+			owners.Set("", exports)
+			for _, p := range cfg.Processes {
+				if started[p.Name] {
+					owners.Set(p.Name, p.ExportOptions())
+				}
+			}
+			if err := Export.Reload(rt, clientAuth, owners.Options()); err != nil {
+				return err
+			}
+			return importErr
+		}
+
+		// Reload on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for sig := range hup {
+				log.Debug(sig, " Reloading.")
+				if err := reload(); err != nil {
+					log.Error("Reload failed: ", err)
+				}
+			}
+		}()
+
+		// Set ulimit to max
+		ulimit(999999)
+
+		// Start metrics endpoint
+		if addr := str("metrics-addr", cfg.MetricsAddr); addr != "" {
+			go func() {
+				if err := metrics.Serve(addr); err != nil {
+					log.Error("Metrics endpoint failed: ", err)
+				}
+			}()
+		}
+
+		// Start admin API
+		if addr := str("admin-addr", cfg.AdminAddr); addr != "" {
+			go func() {
+				if err := admin.Serve(addr, env("ADMIN_TOKEN", cfg.AdminToken), drainTimeout, reload); err != nil {
+					log.Error("Admin API failed: ", err)
+				}
+			}()
+		}
+
+		// Start event sink
+		if target := str("events", cfg.Events); target != "" {
+			sink, err := events.OpenSink(target)
+			if err != nil {
+				return err
+			}
+			c, _ := events.Subscribe(1024)
+			go sink.Run(c)
+		}
+
+		// Ports of the command reported by listener.so
+		var registrar *register.Server
+		if port == "*" && detect == "preload" {
+			// One socket per instance, instances may share /var/lib/dupper
+			socket := str("register-socket", cfg.Register)
+			if socket == "" {
+				socket = fmt.Sprintf("/var/lib/dupper/register.%d.sock", instance)
+			}
+			registrar, err = register.Listen(socket, Export.Registrar(rt, clientAuth))
+			if err != nil {
+				return err
+			}
+		}
+
+		// The service binds to the address of this instance
+		procEnv := append(os.Environ(), "BINDADDR="+rt.BindAddr)
+		if rt.BindAddr6 != "" {
+			procEnv = append(procEnv, "BINDADDR6="+rt.BindAddr6)
+		}
+		if registrar != nil {
+			procEnv = append(procEnv, "LD_PRELOAD=/usr/local/lib/listener.so")
+			procEnv = append(procEnv, registrar.Env()...)
+		}
+		log.Debug("env=", procEnv)
+
+		for n := range procs {
+			procs[n].Env = procEnv
+		}
+
+		sup := &supervisor.Supervisor{Processes: procs, MaxBackoff: maxBackoff}
+		supervised.Lock()
+		supervised.sup = sup
+		supervised.Unlock()
+
+		// Exports of a process are withdrawn while it is down
+		var watches sync.Map
+		sup.Up = func(ctx context.Context, p supervisor.Process, pid int) {
+			setDown(ctx, p.Name, false)
+
+			// The process leads its own process group
+			if port == "*" && detect == "procfs" {
+				watch, stopWatch := context.WithCancel(ctx)
+				watches.Store(pid, stopWatch)
+				go Export.WatchPorts(watch, rt, clientAuth, pid)
+			}
+		}
+		sup.Down = func(ctx context.Context, p supervisor.Process, pid int, code int) {
+			if stopWatch, ok := watches.Load(pid); ok {
+				stopWatch.(context.CancelFunc)()
+				watches.Delete(pid)
+			}
+
+			setDown(ctx, p.Name, true)
+		}
+
+		// Restart on SIGUSR1
+		restart := make(chan os.Signal, 1)
+		signal.Notify(restart, syscall.SIGUSR1)
+		go func() {
+			for sig := range restart {
+				log.Debug(sig, " Restarting")
+				sup.Restart()
+			}
+		}()
+
+		// Start local DNS server
+		dns.Start()
 
 		for {
-			// Flag for go routing
-			done := make(chan bool, 1)
+			// Cancelled on reboot
+			ctx, stop := context.WithCancel(context.Background())
 
 			// Register services.
-			Export.Process(passwd, c.StringSlice("export"), interval, debug)
+			mu.Lock()
+			if err := Export.Process(rt, clientAuth, owners.Options()); err != nil {
+				mu.Unlock()
+				stop()
+				return err
+			}
 
 			// Wait for Needed service before registering.
-			go Import.Process(passwd, c.StringSlice("import"), func() {
-
-				for {
-					cmdargs := c.Args()
-					if len(cmdargs) > 0 {
-						cmd := cmdargs[0]
-						args := cmdargs[1:]
-						log.Debug("Executing ", cmd, args)
-						proc := exec.Command(cmd, args...)
-						proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-						env := os.Environ()
-
-						if port == "*" {
-							env = append(env, "LD_PRELOAD=/usr/local/lib/listener.so")
-						}
-
-						proc.Env = env
-						log.Debug("env=", proc.Env)
-
-						stream := func(prefix string, out io.Reader) {
-							scanner := bufio.NewScanner(out)
-							for scanner.Scan() {
-								m := scanner.Text()
-								fmt.Println(prefix, m)
-							}
-
-						}
-
-						stdout, err := proc.StdoutPipe()
-						if err != nil {
-							os.Exit(1)
-						}
-
-						go stream("stdout:", stdout)
-						stderr, err := proc.StderrPipe()
-						if err != nil {
-							os.Exit(1)
-						}
-
-						go stream("stderr:", stderr)
-
-						err = proc.Start()
-						if err != nil {
-							log.Error(err)
-							os.Exit(1)
-						}
-
-						go func() {
-							proc.Wait()
-							fmt.Println("Process Terminated")
-							Export.Cleanup()
-						}()
-
-						restart := make(chan os.Signal, 1)
-						signal.Notify(restart, syscall.SIGUSR1)
-
-						select {
-						// Restart on SIGUSR1
-						case sig := <-restart:
-							log.Debug(sig, " Restarting")
-							syscall.Kill(-proc.Process.Pid, syscall.SIGKILL)
-							continue
-
-						case <-done:
-							log.Debug("Terminaing process")
-							syscall.Kill(-proc.Process.Pid, syscall.SIGKILL)
-						}
-					}
-
-					break
+			err := Import.Process(rt, serverAuth, imports, func() {
+				if len(procs) == 0 {
+					return
+				}
+
+				code, err := sup.Run(ctx)
+				if err != nil {
+					// Rebooting or shutting down
+					return
 				}
 
+				// Nothing left to restart, exit like the processes
+				log.Debug("Processes stopped, exit status ", code)
+				cleanup()
+				os.Exit(code)
 			})
+			mu.Unlock()
+			if err != nil {
+				stop()
+				return err
+			}
 
 			reboot := make(chan os.Signal, 1)
 			signal.Notify(reboot, syscall.SIGUSR2)
 
-			// Reboot on SIGUSR2
+			// Reboot on SIGUSR2, let in-flight connections finish first
 			sig := <-reboot
-			done <- true
 			log.Debug(sig, " Rebooting.")
+			mu.Lock()
+			drain()
+			stop()
 			cleanup()
+			mu.Unlock()
 		}
 
 		utils.BlockForever()
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "endpoint"
+
+/*
+ * Byte directions, in flows from the connecting peer to the service,
+ * out carries the replies back.
+ */
+const (
+	In  = "in"
+	Out = "out"
+)
+
+var (
+	// Active SSH connections from this exporter to remote routers
+	ClientConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ssh_client_connections",
+		Help:      "Active SSH connections to remote routers.",
+	})
+
+	// Active SSH connections of exporters to this router
+	ServerConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ssh_server_connections",
+		Help:      "Active SSH connections of exporters that requested forwards.",
+	})
+
+	// Remote port forwards per service user
+	Forwards = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "forwards",
+		Help:      "Active remote port forwards per service user.",
+	}, []string{"user"})
+
+	// Proxied bytes, path is forward for SSH tunnels and lb for load balanced ports
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxied_bytes_total",
+		Help:      "Bytes proxied per path and direction.",
+	}, []string{"path", "direction"})
+
+	// Failed dials, target is backend, service or router
+	DialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dial_failures_total",
+		Help:      "Failed dials per target.",
+	}, []string{"target"})
+
+	// Connection attempts of the export reconnect loop
+	Reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "export_reconnects_total",
+		Help:      "Reconnect attempts to remote routers per remote host.",
+	}, []string{"rhost"})
+
+	// Backends per import, state is up for backends in rotation
+	Backends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "import_backends",
+		Help:      "Connected backends per import and state.",
+	}, []string{"import", "state"})
+
+	// Answered DNS queries, result is localhost, instance, upstream or none
+	DNSQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dns_queries_total",
+		Help:      "DNS questions answered by the local resolver per result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ClientConnections,
+		ServerConnections,
+		Forwards,
+		Bytes,
+		DialFailures,
+		Reconnects,
+		Backends,
+		DNSQueries,
+	)
+}
+
+/*
+ * Set once the metrics endpoint is served, bytes are counted from then on
+ */
+var enabled int32
+
+/*
+ * Count proxied bytes, called by Serve
+ */
+func Enable() {
+	atomic.StoreInt32(&enabled, 1)
+}
+
+/*
+ * Writer adding every written byte to a counter
+ */
+type countingWriter struct {
+	w io.Writer
+	c prometheus.Counter
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.c.Add(float64(n))
+	return n, err
+}
+
+/*
+ * CountWriter counts bytes written to w as proxied on path in direction.
+ * Bytes are counted as they flow, so long lived connections show up
+ * before they close.
+ * The wrapper hides io.ReaderFrom of w, e.g. splice of *net.TCPConn, so
+ * w is returned as is unless metrics are enabled.
+ */
+func CountWriter(w io.Writer, path string, direction string) io.Writer {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return w
+	}
+	return countingWriter{w: w, c: Bytes.WithLabelValues(path, direction)}
+}
+
+/*
+ * AddBytes counts n bytes proxied on path in direction, like CountWriter
+ * only once metrics are enabled.
+ */
+func AddBytes(path string, direction string, n int) {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return
+	}
+	Bytes.WithLabelValues(path, direction).Add(float64(n))
+}
+
+/*
+ * Serve metrics on addr at /metrics, blocks until the server fails.
+ */
+func Serve(addr string) error {
+	Enable()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+/*
+ * Enable or disable metrics until the test ends
+ */
+func setEnabled(t *testing.T, on bool) {
+	old := atomic.LoadInt32(&enabled)
+	t.Cleanup(func() { atomic.StoreInt32(&enabled, old) })
+
+	if on {
+		atomic.StoreInt32(&enabled, 1)
+	} else {
+		atomic.StoreInt32(&enabled, 0)
+	}
+}
+
+func TestCountWriter(t *testing.T) {
+	// Disabled, w keeps its io.ReaderFrom
+	setEnabled(t, false)
+	var plain bytes.Buffer
+	if w := CountWriter(&plain, "test", In); w != io.Writer(&plain) {
+		t.Error(
+			"For", "disabled metrics",
+			"expected", &plain,
+			"got", w,
+		)
+	}
+
+	out := testutil.ToFloat64(Bytes.WithLabelValues("test", Out))
+	AddBytes("test", Out, 5)
+	if got := testutil.ToFloat64(Bytes.WithLabelValues("test", Out)) - out; got != 0 {
+		t.Error(
+			"For", "AddBytes with disabled metrics",
+			"expected", 0,
+			"got", got,
+		)
+	}
+
+	setEnabled(t, true)
+	before := testutil.ToFloat64(Bytes.WithLabelValues("test", In))
+
+	var buf bytes.Buffer
+	w := CountWriter(&buf, "test", In)
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+
+	if got := testutil.ToFloat64(Bytes.WithLabelValues("test", In)) - before; got != 11 {
+		t.Error(
+			"For", "hello world",
+			"expected", 11,
+			"got", got,
+		)
+	}
+
+	AddBytes("test", Out, 5)
+	if got := testutil.ToFloat64(Bytes.WithLabelValues("test", Out)) - out; got != 5 {
+		t.Error(
+			"For", "AddBytes",
+			"expected", 5,
+			"got", got,
+		)
+	}
+
+	if buf.String() != "hello world" {
+		t.Error(
+			"For", "written data",
+			"expected", "hello world",
+			"got", buf.String(),
+		)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Forwards.WithLabelValues("app.80").Set(2)
+	defer Forwards.DeleteLabelValues("app.80")
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	expected := `endpoint_forwards{user="app.80"} 2`
+	if !strings.Contains(string(body), expected) {
+		t.Error(
+			"For", "/metrics",
+			"expected", expected,
+			"got", string(body),
+		)
+	}
+}
@@ -1,102 +1,224 @@
 package omap
 
 import (
-    "container/list"
+    "sync"
+    "sync/atomic"
 )
 
+/*
+ * OMap is an insertion ordered map with round-robin iteration.
+ * It is safe for concurrent use. Writers serialize on a mutex and publish
+ * an immutable snapshot of the enabled elements, so Next never takes a lock.
+ * Disabled elements stay in the map but are skipped by Next and Elements.
+ */
+
 type Element struct {
-    Value interface{}
-    keyPtr  * list.Element
+    Value    interface{}
+    key      string
+    disabled bool
 }
 
 type OMap struct {
-    nextIdx     * list.Element
-    elements    map[uint32]*Element
-    keyList     * list.List
+    mu          sync.RWMutex
+    nextIdx     uint64
+    elements    map[string]*Element
+    order       []*Element
+    snapshot    atomic.Value
     Userdata    interface{}
 }
 
 func New() *OMap {
     var m OMap
 
-    m.nextIdx  = nil
-    m.elements = make(map[uint32]*Element, 1)
-    m.keyList  = list.New()
-    m.keyList.Init()
-    
+    m.elements = make(map[string]*Element, 1)
+    m.snapshot.Store([]*Element(nil))
+
     return &m
 }
 
-func (m *OMap) Add(key uint32, v interface{}) *Element {
-    e := m.keyList.PushBack(key)
-    
-    m.elements[key] = &Element{
-        Value: v,
-        keyPtr: e,
+/*
+ * Key of the element
+ */
+func (e *Element) Key() string {
+    return e.key
+}
+
+/*
+ * Publish copy of the ordered enabled elements for lock free readers.
+ * Must be called with mu held.
+ */
+func (m *OMap) publish() {
+    snap := make([]*Element, 0, len(m.order))
+    for _, e := range m.order {
+        if !e.disabled {
+            snap = append(snap, e)
+        }
     }
-    
-    return m.elements[key]
+    m.snapshot.Store(snap)
 }
 
-func (m *OMap) Remove(key uint32) *Element {
-    //Get Element from maps
-    e := m.elements[key]
-    
-    if (e != nil) {
-        //Remove key from keylist
-        m.keyList.Remove(e.keyPtr)
+func (m *OMap) load() []*Element {
+    return m.snapshot.Load().([]*Element)
+}
 
-        //Remove element from map
-        delete(m.elements, key)        
+func (m *OMap) Add(key string, v interface{}) *Element {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    e := &Element{
+        Value: v,
+        key: key,
+    }
+
+    if old, ok := m.elements[key]; ok {
+        // Replace in place, keeping the position in the rotation
+        for idx, el := range m.order {
+            if el == old {
+                m.order[idx] = e
+                break
+            }
+        }
+    } else {
+        m.order = append(m.order, e)
     }
-    
+
+    m.elements[key] = e
+    m.publish()
+
     return e
 }
 
+func (m *OMap) Remove(key string) *Element {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.remove(m.elements[key])
+}
+
 
 func (m *OMap) RemoveEl(e *Element) *Element {
-    
-    if (e != nil) {
-        //Get key value
-        key := e.keyPtr.Value.(uint32)
-        
-        //Remove key from keylist
-        m.keyList.Remove(e.keyPtr)
-
-        //Remove element from map
-        delete(m.elements, key)        
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.remove(e)
+}
+
+/*
+ * Remove element, must be called with mu held.
+ */
+func (m *OMap) remove(e *Element) *Element {
+    if e == nil || m.elements[e.key] != e {
+        return nil
     }
-    
+
+    //Remove element from map
+    delete(m.elements, e.key)
+
+    //Remove element from ordered list
+    for idx, el := range m.order {
+        if el == e {
+            m.order = append(m.order[:idx], m.order[idx+1:]...)
+            break
+        }
+    }
+
+    m.publish()
+
     return e
 }
 
 
-func (m *OMap) Get(key uint32) *Element {
+func (m *OMap) Get(key string) *Element {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
     //Get Element from maps
     return m.elements[key]
 
 }
 
+/*
+ * Take element out of rotation, returns false if it was already disabled
+ * or does not exist.
+ */
+func (m *OMap) Disable(key string) bool {
+    return m.setDisabled(key, true)
+}
+
+/*
+ * Put element back into rotation, returns false if it was already enabled
+ * or does not exist.
+ */
+func (m *OMap) Enable(key string) bool {
+    return m.setDisabled(key, false)
+}
+
+func (m *OMap) setDisabled(key string, disabled bool) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    e := m.elements[key]
+    if e == nil || e.disabled == disabled {
+        return false
+    }
+
+    e.disabled = disabled
+    m.publish()
+
+    return true
+}
+
+/*
+ * Check if element is in rotation
+ */
+func (m *OMap) Enabled(key string) bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    e := m.elements[key]
+    return e != nil && !e.disabled
+}
+
+/*
+ * Next enabled element in round-robin order, nil if there is none.
+ */
 func (m *OMap) Next() *Element {
-    if len(m.elements) == 0 {
+    snap := m.load()
+    if len(snap) == 0 {
         return nil
     }
-    
-    if m.nextIdx == nil {
-        m.nextIdx = m.keyList.Front()
-    }
-        
-    e := m.elements[m.nextIdx.Value.(uint32)]
-    
-    if m.nextIdx.Next() == nil {
-        m.nextIdx = m.keyList.Front()
-    } else {
-        m.nextIdx = m.nextIdx.Next()
-    }
-    
-    return e    
+
+    idx := atomic.AddUint64(&m.nextIdx, 1) - 1
+
+    return snap[idx % uint64(len(snap))]
 }
 
+/*
+ * Elements returns a snapshot of the enabled elements in insertion order.
+ * The returned slice must not be modified.
+ */
+func (m *OMap) Elements() []*Element {
+    return m.load()
+}
+
+/*
+ * All returns every element, enabled or not, in insertion order.
+ */
+func (m *OMap) All() []*Element {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    all := make([]*Element, len(m.order))
+    copy(all, m.order)
+    return all
+}
+
+/*
+ * Number of elements, enabled or not.
+ */
 func (m *OMap) Len() int {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
     return len(m.elements)
 }
@@ -1,6 +1,8 @@
 package omap
 
 import (
+    "fmt"
+    "sync"
     "testing"
 )
 
@@ -17,17 +19,17 @@ type Host struct {
 }
 
 type testpair struct {
-  key int32
+  key string
   value Host
 }
 
 
 var data = []testpair {
-                        {1, Host{ 1000, "192.168.1.1", 1000, Config {1000, "detach"}}},
-                        {2, Host{ 2000, "192.168.1.2", 2000, Config {2000, "detach"}}},
-                        {3, Host{ 3000, "192.168.1.2", 3000, Config {3000, "detach"}}},
-                        {4, Host{ 4000, "192.168.1.2", 4000, Config {4000, "detach"}}},
-                        {5, Host{ 5000, "192.168.1.2", 5000, Config {5000, "detach"}}},
+                        {"1", Host{ 1000, "192.168.1.1", 1000, Config {1000, "detach"}}},
+                        {"2", Host{ 2000, "192.168.1.2", 2000, Config {2000, "detach"}}},
+                        {"3", Host{ 3000, "192.168.1.2", 3000, Config {3000, "detach"}}},
+                        {"4", Host{ 4000, "192.168.1.2", 4000, Config {4000, "detach"}}},
+                        {"5", Host{ 5000, "192.168.1.2", 5000, Config {5000, "detach"}}},
                       }
 
 func initData() (* OMap) {
@@ -192,3 +194,175 @@ func TestGet(t *testing.T) {
     }
     
 }
+
+func TestReplace(t *testing.T) {
+    //Initialize Data in OrderedMap
+    m := initData()
+
+    m.Add(data[0].key, data[1].value)
+
+    if m.Len() != len(data) {
+        t.Error(
+            "For", data[0].key,
+            "expected", len(data),
+            "got", m.Len(),
+        )
+    }
+
+    el := m.Next()
+    if el.Value.(Host).localPort != data[1].value.localPort {
+        t.Error(
+            "For", data[0].key,
+            "expected", data[1].value.localPort,
+            "got", *el,
+        )
+    }
+}
+
+func TestRemoveEl(t *testing.T) {
+    m := initData()
+
+    el := m.Get(data[0].key)
+    m.Add(data[0].key, data[1].value)
+
+    // Stale element must not remove its replacement.
+    if m.RemoveEl(el) != nil || m.Get(data[0].key) == nil {
+        t.Error(
+            "For", data[0].key,
+            "expected", "replacement to be kept",
+            "got", m.Get(data[0].key),
+        )
+    }
+}
+
+func TestConcurrent(t *testing.T) {
+    const workers = 16
+    const rounds = 1000
+
+    m := initData()
+
+    var wg sync.WaitGroup
+
+    // Readers
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < rounds; i++ {
+                if el := m.Next(); el != nil {
+                    _ = el.Value.(Host)
+                }
+                m.Get(data[i % len(data)].key)
+                m.Len()
+                m.Elements()
+            }
+        }()
+    }
+
+    // Writers
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < rounds; i++ {
+                key := fmt.Sprintf("w%d-%d", w, i)
+                m.Add(key, data[i % len(data)].value)
+                m.Remove(key)
+            }
+        }(w)
+    }
+
+    wg.Wait()
+
+    if m.Len() != len(data) {
+        t.Error(
+            "For", "concurrent add/remove",
+            "expected", len(data),
+            "got", m.Len(),
+        )
+    }
+}
+
+func TestConcurrentNextFair(t *testing.T) {
+    const workers = 8
+    const rounds = 1000
+
+    m := initData()
+
+    var mu sync.Mutex
+    counts := make(map[string]int, len(data))
+
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            local := make(map[string]int, len(data))
+            for i := 0; i < rounds * len(data); i++ {
+                local[m.Next().Key()]++
+            }
+            mu.Lock()
+            for k, v := range local {
+                counts[k] += v
+            }
+            mu.Unlock()
+        }()
+    }
+    wg.Wait()
+
+    for _, conn := range data {
+        if counts[conn.key] != workers * rounds {
+            t.Error(
+                "For", conn.key,
+                "expected", workers * rounds,
+                "got", counts[conn.key],
+            )
+        }
+    }
+}
+
+func TestDisable(t *testing.T) {
+    const disableIdx = 1
+
+    m := initData()
+
+    if !m.Disable(data[disableIdx].key) || m.Disable(data[disableIdx].key) {
+        t.Error(
+            "For", data[disableIdx].key,
+            "expected", "disable once",
+            "got", m.Enabled(data[disableIdx].key),
+        )
+    }
+
+    for idx, conn := range data {
+        if idx == disableIdx {
+            continue
+        }
+
+        el := m.Next()
+        if el.Value.(Host).localPort != conn.value.localPort {
+            t.Error(
+                "For", conn.value,
+                "expected", conn.value.localPort,
+                "got", *el,
+            )
+        }
+    }
+
+    if m.Len() != len(data) || len(m.All()) != len(data) || len(m.Elements()) != len(data) - 1 {
+        t.Error(
+            "For", "disabled element",
+            "expected", len(data), len(data) - 1,
+            "got", m.Len(), len(m.Elements()),
+        )
+    }
+
+    m.Enable(data[disableIdx].key)
+    if !m.Enabled(data[disableIdx].key) || len(m.Elements()) != len(data) {
+        t.Error(
+            "For", data[disableIdx].key,
+            "expected", "enabled",
+            "got", len(m.Elements()),
+        )
+    }
+}
@@ -1,19 +1,24 @@
 package Export
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"net"
-	"net/http"
-	"net/rpc"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bogdanovich/dns_resolver"
 	"github.com/prometheus/common/log"
-	netstat "github.com/shirou/gopsutil/net"
 	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/dns"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/health"
+	"github.com/microstacks/stack/endpoint/metrics"
+	"github.com/microstacks/stack/endpoint/opt/register"
+	"github.com/microstacks/stack/endpoint/router"
 	"github.com/microstacks/stack/endpoint/utils"
 )
 
@@ -28,37 +33,196 @@ type Export struct {
 	rhost    string //remote host to connect to
 	rport    uint32 //remote host port
 	user     string //remote username
+	weight   uint32 //load balancing weight announced to the remote host
+	udp      bool   //forward datagrams instead of connections
+	retry    bool   //set on connects from the reconnect loop
+
+	checker *health.Checker //readiness check, nil to only check the port
+	mon     *health.Monitor //readiness of the reconnect loop
+
+	identity     string   //private key of this service, overrides the global one
+	knownHosts   string   //known_hosts of this service, overrides the global one
+	fingerprints []string //pinned host key fingerprints, override the global ones
+
+	x *Exporter //Exporter running the export
+}
+
+/*
+ *  Reconnect loop of an export
+ */
+type loop struct {
+	e    Export
+	done chan bool
 }
 
-var goroutines map[string]chan bool = make(map[string]chan bool, 1)
-var rpcRegistered bool = false
+/*
+ *  Exports of a router connecting through its clients
+ */
+type Exporter struct {
+	clients *client.Clients
 
-type Args struct {
-	Lport uint32
-	Rport uint32
+	mu         sync.Mutex
+	goroutines map[string]*loop
+	options    []string
+	ports      map[uint32]bool // ports opened by the command
 }
 
-type RPC struct {
-	opts     []string
-	passwd   string
-	interval int
-	debug    bool
+func New(clients *client.Clients) *Exporter {
+	return &Exporter{
+		clients:    clients,
+		goroutines: make(map[string]*loop, 1),
+		ports:      make(map[uint32]bool),
+	}
 }
 
+/*
+ *  Exporter of the endpoint command, used by the package-level functions
+ */
+var Default = New(client.Default)
+
 /*
  *  forEach parser callback
  */
 type parsecb func(*Export) error
 
-func Cleanup() {
+func (x *Exporter) Cleanup() {
 	fmt.Println("Export: Closing all connections.")
-	for key, done := range goroutines {
-		fmt.Println("Export: Closing done=", done)
-		if done != nil {
-			close(done)
-			delete(goroutines, key)
+	x.stop(func(e Export) bool { return true }, true)
+}
+
+/*
+ * Drain exports.
+ * Reconnect loops stop without disconnecting, then the remote forwards
+ * are cancelled and in-flight connections may finish until ctx is done.
+ */
+func (x *Exporter) Drain(ctx context.Context) error {
+	fmt.Println("Export: Draining all connections.")
+	x.stop(func(e Export) bool { return true }, false)
+
+	return x.clients.Drain(ctx)
+}
+
+/*
+ * Export as listed by the admin API
+ */
+type Status struct {
+	Option      string          `json:"option"`
+	Remote      string          `json:"rhost"`
+	Running     bool            `json:"running"` // reconnect loop active
+	Ready       bool            `json:"ready"`   // always true without readiness checks
+	Connections []client.Status `json:"connections"`
+}
+
+/*
+ * List configured exports with their connections
+ */
+func (x *Exporter) ListStatus() []Status {
+	x.mu.Lock()
+	opts := x.options
+	running := make(map[string]bool, len(x.goroutines))
+	ready := make(map[string]bool, len(x.goroutines))
+	for _, l := range x.goroutines {
+		running[l.e.opt] = true
+		if l.e.mon != nil && l.e.mon.Healthy() {
+			ready[l.e.opt] = true
+		}
+	}
+	x.mu.Unlock()
+
+	conns := x.clients.Connections()
+
+	status := []Status{}
+	x.forEach(opts, func(e *Export) error {
+		// Wildcard exports connect with the port assigned at runtime
+		prefix := e.lhost + "."
+		if e.lport != 0 {
+			prefix += fmt.Sprint(e.lport) + "@"
+		}
+
+		st := Status{Option: e.opt, Remote: e.rhost, Running: running[e.opt], Ready: ready[e.opt] || e.checker == nil, Connections: []client.Status{}}
+		for _, c := range conns {
+			if strings.HasPrefix(c.Hash, prefix) && strings.HasSuffix(c.Hash, "/udp") == e.udp {
+				st.Connections = append(st.Connections, c)
+			}
+		}
+		status = append(status, st)
+		return nil
+	})
+
+	return status
+}
+
+/*
+ * Stop the reconnect loops of matching exports, returns how many stopped.
+ * With disconnect their connections are closed before stop returns,
+ * so a replacement export connects right away. Otherwise the
+ * connections are left to Drain.
+ */
+func (x *Exporter) stop(match func(e Export) bool, disconnect bool) int {
+	x.mu.Lock()
+	var stopped []Export
+	for key, l := range x.goroutines {
+		if !match(l.e) {
+			continue
+		}
+
+		close(l.done)
+		delete(x.goroutines, key)
+		stopped = append(stopped, l.e)
+	}
+	x.mu.Unlock()
+
+	if disconnect {
+		for _, e := range stopped {
+			e.withdraw()
 		}
 	}
+	return len(stopped)
+}
+
+/*
+ * Match exports to rhost
+ */
+func toHost(rhost string) func(e Export) bool {
+	return func(e Export) bool {
+		return e.rhost == rhost
+	}
+}
+
+/*
+ * Drain all connections to rhost.
+ * Reconnecting stops, remote forwards are cancelled and in-flight
+ * connections may finish until ctx is done.
+ */
+func (x *Exporter) DrainHost(ctx context.Context, rhost string) (bool, error) {
+	if x.stop(toHost(rhost), false) == 0 {
+		return false, nil
+	}
+
+	ipArr, err := lookupHost(rhost)
+	if err != nil {
+		return true, err
+	}
+
+	for _, ip := range ipArr {
+		for _, c := range x.clients.Connections() {
+			hash := strings.TrimSuffix(c.Hash, "/udp")
+			if strings.HasSuffix(hash, "@"+ip.String()) {
+				if e := x.clients.DrainConnection(ctx, c.Hash); e != nil {
+					err = e
+				}
+			}
+		}
+	}
+
+	return true, err
+}
+
+/*
+ * Disconnect all connections to rhost and stop reconnecting.
+ */
+func (x *Exporter) DisconnectHost(rhost string) bool {
+	return x.stop(toHost(rhost), true) > 0
 }
 
 func lookupHost(rhost string) ([]net.IP, error) {
@@ -68,166 +232,445 @@ func lookupHost(rhost string) ([]net.IP, error) {
 		return nil, err
 	}
 
-	return resolver.LookupHost(rhost)
+	return dns.LookupIP(resolver, rhost)
+}
+
+var hostName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-\.]+$`)
+
+func optionError(e *Export, field string, value string, reason string) error {
+	return &utils.OptionError{Option: e.opt, Field: field, Value: value, Reason: reason}
 }
 
 /*
  *  --export option parser logic
+ *  Format app:port@raddr[:rport][/udp], port * exports a wildcard service and
+ *  rport defaults to port. The /udp suffix exports a UDP service.
+ *  IPv6 raddrs are written in brackets, [fd00::1]:8080, or bare without rport.
  */
-func parse(str string) (string, uint32, string, uint32) {
-	var expr = regexp.MustCompile(`([a-zA-Z^:][a-zA-Z0-9\-\.]+):([0-9]+|\*)(@([^:]+)(:([0-9]+))?)$`)
-	parts := expr.FindStringSubmatch(str)
+func parse(e *Export, spec string) error {
+	if idx := strings.LastIndex(spec, "/"); idx >= 0 {
+		switch proto := spec[idx+1:]; proto {
+		case "udp":
+			e.udp = true
+		case "tcp":
+		default:
+			return optionError(e, "proto", proto, "must be tcp or udp")
+		}
+		spec = spec[:idx]
+	}
 
-	if len(parts) == 0 {
-		utils.Check(errors.New(fmt.Sprintf("Option parse error: [%s]. Format lhost:lport[@rhost:rport]\n", str)))
+	idx := strings.Index(spec, "@")
+	if idx < 0 {
+		return optionError(e, "raddr", "", "missing @raddr")
 	}
+	local, remote := spec[:idx], spec[idx+1:]
 
-	if parts[2] == "*" {
-		parts[2] = "0"
+	idx = strings.LastIndex(local, ":")
+	if idx < 0 {
+		return optionError(e, "app:port", local, "missing :port")
 	}
+	lhost, lport := local[:idx], local[idx+1:]
 
-	lport, err := strconv.Atoi(parts[2])
-	if err != nil {
-		utils.Check(errors.New(fmt.Sprintf("Option parse error: [%s]. Format lhost:lport[@rhost:rport]\n", str)))
+	if !hostName.MatchString(lhost) {
+		return optionError(e, "app", lhost, "invalid host")
+	}
+	e.lhost = lhost
+
+	if lport == "*" {
+		if e.udp {
+			return optionError(e, "port", lport, "wildcard not supported for udp")
+		}
+	} else {
+		port, err := utils.ParsePort(lport, 0)
+		if err != nil {
+			return optionError(e, "port", lport, err.Error())
+		}
+		e.lport = port
 	}
 
-	if parts[6] == "" {
-		parts[6] = parts[2]
+	rhost, rport := remote, ""
+	if strings.HasPrefix(remote, "[") {
+		end := strings.Index(remote, "]")
+		if end < 0 || net.ParseIP(remote[1:end]) == nil {
+			return optionError(e, "raddr", remote, "invalid IPv6 address")
+		}
+		rhost, remote = remote[1:end], remote[end+1:]
+		if idx = strings.Index(remote, ":"); idx >= 0 {
+			rport = remote[idx+1:]
+		} else if remote != "" {
+			return optionError(e, "raddr", remote, "unexpected after ]")
+		}
+	} else if net.ParseIP(remote) != nil {
+		idx = -1
+	} else if idx = strings.Index(remote, ":"); idx >= 0 {
+		rhost, rport = remote[:idx], remote[idx+1:]
 	}
 
-	rport, err := strconv.Atoi(parts[6])
-	if err != nil {
-		utils.Check(errors.New(fmt.Sprintf("Option parse error: [%s]. Format lhost:lport[@rhost:rport]\n", str)))
+	if rhost == "" || strings.ContainsAny(rhost, "@/") {
+		return optionError(e, "raddr", rhost, "invalid host")
 	}
+	e.rhost = rhost
 
-	return parts[1], uint32(lport), parts[4], uint32(rport)
+	e.rport = e.lport
+	if idx >= 0 {
+		port, err := utils.ParsePort(rport, 0)
+		if err != nil {
+			return optionError(e, "rport", rport, err.Error())
+		}
+		e.rport = port
+	}
+
+	return nil
+}
+
+/*
+ *  Parse an --export option
+ */
+func parseExport(opt string) (*Export, error) {
+	e := &Export{opt: opt}
+	spec, opts := utils.SplitOptions(opt)
+	if err := parse(e, spec); err != nil {
+		return nil, err
+	}
+	if err := parseOptions(e, opts); err != nil {
+		return nil, err
+	}
+
+	if e.lport == 0 {
+		e.user = e.lhost
+	} else {
+		e.user = e.lhost + "." + fmt.Sprint(e.lport)
+	}
+	if e.udp {
+		e.user += "/udp"
+	}
+
+	log.Debug("lhost=", e.lhost, ",",
+		"lport=", e.lport, ",",
+		"rhost=", e.rhost, ",",
+		"rport=", e.rport, ",",
+		"ruser=", e.user, ",",
+		"udp=", e.udp)
+	return e, nil
 }
 
 /*
  *  --export options iterater
  */
-func forEach(opts []string, cb parsecb) error {
+func (x *Exporter) forEach(opts []string, cb parsecb) error {
 	for _, opt := range opts {
+		e, err := parseExport(opt)
+		if err != nil {
+			return err
+		}
+		e.x = x
 
-		e := Export{opt: opt}
-		e.lhost, e.lport, e.rhost, e.rport = parse(opt)
+		if cb != nil {
+			if err := cb(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-		if e.lport == 0 {
-			e.user = e.lhost
-		} else {
-			e.user = e.lhost + "." + fmt.Sprint(e.lport)
+/*
+ *  Validate --export options without connecting.
+ *  Every malformed option is reported, errors are *utils.OptionError.
+ */
+func Validate(opts []string) []error {
+	var errs []error
+	for _, opt := range opts {
+		if _, err := parseExport(opt); err != nil {
+			errs = append(errs, err)
 		}
+	}
+	return errs
+}
 
-		log.Debug("lhost=", e.lhost, ",",
-			"lport=", e.lport, ",",
-			"rhost=", e.rhost, ",",
-			"rport=", e.rport, ",",
-			"ruser=", e.user)
+/*
+ *  parse key=value options of --export
+ *    weight=n                       - load balancing weight announced to the router
+ *    identity=path                  - private key of this service
+ *    known-hosts=path               - known_hosts of this service
+ *    host-fingerprint=fp[|fp]       - pinned router host key fingerprints
+ *    check=tcp|http:/path|exec:cmd  - readiness check of the service before
+ *                                     exporting it, exec only for udp
+ *    check-interval=duration        - time between readiness checks, default 1s
+ *    check-timeout=duration         - timeout of a readiness check, default 1s
+ *    rise=n                         - successes to export the service, default 1
+ *    fall=n                         - failures to withdraw it, default 3
+ */
+func parseOptions(e *Export, opts map[string]string) error {
+	checker := health.Checker{
+		Interval: time.Second,
+		Timeout:  time.Second,
+		Rise:     1,
+		Fall:     3,
+	}
 
-		if cb != nil {
-			if err := cb(&e); err != nil {
-				return err
+	for key, value := range opts {
+		switch key {
+		case "weight":
+			weight, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || weight == 0 {
+				return optionError(e, key, value, "must be a positive integer")
+			}
+			e.weight = uint32(weight)
+		case "identity":
+			e.identity = value
+		case "known-hosts":
+			e.knownHosts = value
+		case "host-fingerprint":
+			e.fingerprints = strings.Split(value, "|")
+		case "check":
+			probe, err := health.Parse(value)
+			if err != nil {
+				return optionError(e, key, value, err.Error())
+			}
+			if e.udp && !strings.HasPrefix(value, "exec:") {
+				return optionError(e, key, value, "only exec checks are supported for udp")
+			}
+			checker.Probe = probe
+		case "check-interval", "check-timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return optionError(e, key, value, "must be a positive duration")
+			}
+			if key == "check-interval" {
+				checker.Interval = d
+			} else {
+				checker.Timeout = d
+			}
+		case "rise", "fall":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return optionError(e, key, value, "must be a positive integer")
+			}
+			if key == "rise" {
+				checker.Rise = n
+			} else {
+				checker.Fall = n
 			}
+		default:
+			return optionError(e, key, value, "unknown option")
 		}
 	}
+
+	if checker.Probe != nil {
+		e.checker = &checker
+	}
 	return nil
 }
 
-func (e Export) reconnect(passwd string, interval int, debug bool) {
+/*
+ *  Client auth of this export, per service settings override the global ones.
+ */
+func (e Export) clientAuth(auth client.Auth) client.Auth {
+	if e.identity != "" {
+		auth.IdentityFile = e.identity
+	}
+	if e.knownHosts != "" {
+		auth.KnownHosts = e.knownHosts
+	}
+	if len(e.fingerprints) > 0 {
+		auth.Fingerprints = e.fingerprints
+	}
+	return auth
+}
+
+/*
+ *  Identity of the reconnect loop of this export
+ */
+func (e Export) key() string {
+	return e.hash(e.rhost)
+}
+
+/*
+ *  Identity of the connection of this export to ip
+ */
+func (e Export) hash(ip string) string {
+	hash := e.lhost + "." + fmt.Sprint(e.lport) + "@" + ip
+	if e.udp {
+		hash += "/udp"
+	}
+	return hash
+}
+
+func (e Export) reconnect(r *router.Router, auth client.Auth) {
 	// Channel to notify when to stop this go routine
-	done := make(chan bool)
-	goroutines[e.rhost] = done
+	done := make(chan bool, 1)
+	e.x.mu.Lock()
+	if _, ok := e.x.goroutines[e.key()]; ok {
+		// Already reconnecting
+		e.x.mu.Unlock()
+		return
+	}
+	l := &loop{e: e, done: done}
+	e.x.goroutines[e.key()] = l
+	e.x.mu.Unlock()
+
+	e.retry = true
+
+	// The service is exported once its readiness check passes,
+	// the loop connects right away
+	wake := make(chan bool, 1)
+	if e.checker != nil {
+		notified := e
+		e.mon = e.checker.StartUnhealthy(e.localAddr(r), func(ready bool) {
+			notified.readyChanged(r, ready)
+			if ready {
+				select {
+				case wake <- true:
+				default:
+				}
+			}
+		})
+		defer e.mon.Stop()
+
+		// Listed as ready by the monitor from now on
+		e.x.mu.Lock()
+		l.e.mon = e.mon
+		e.x.mu.Unlock()
+	}
 
 	for {
 
 		// Go connect, ignore errors and keep retrying
-		go e.connect(passwd, debug)
+		go e.connect(r, auth)
 
-		// Diconnect all ssh connection if channel is closed and return.
+		// Closed by stop, which disconnects if asked to
 		select {
-		case _, ok := <-done:
+		case <-done:
 			log.Debug("Terminating goroutine")
-			if !ok {
-				// Check if host exists
-				ipArr, _ := lookupHost(e.rhost)
-
-				for _, ip := range ipArr {
-					hash := e.lhost + "." + fmt.Sprint(e.lport) + "@" + ip.String()
-					client.Disconnect(hash)
-				}
-				return
-			}
-		case <-time.After(time.Duration(interval) * 1000 * time.Millisecond):
+			return
+		case <-wake:
+		case <-time.After(time.Duration(r.Interval) * 1000 * time.Millisecond):
 
 			/* no-op */
 		}
 	}
 }
 
-func (e Export) isPortOpen() bool {
-	conns, err := netstat.Connections("inet")
+/*
+ *  Address of the service as dialed by the router
+ */
+func (e Export) localAddr(r *router.Router) string {
+	return (&utils.Endpoint{Host: r.BindAddr, Port: e.lport}).String()
+}
+
+/*
+ *  Check if the service is ready to be exported.
+ *  Exports with a readiness check follow its monitor. Otherwise TCP
+ *  services must accept a connection on the address the router dials.
+ *  UDP services are never sent a probe, a socket bound to the port on
+ *  an address the router reaches counts as ready, see udpBound. Use a
+ *  check for UDP services that need to be ready beyond that.
+ */
+func (e Export) isReady(r *router.Router) bool {
+	switch {
+	case e.lport == 0:
+		return false
+	case e.checker != nil:
+		return e.mon != nil && e.mon.Healthy()
+	case e.udp:
+		return udpBound(procRoot, e.lport, func(ip net.IP) bool {
+			return reachable(r, ip)
+		})
+	}
+
+	conn, err := net.DialTimeout("tcp", e.localAddr(r), time.Second)
+	if err != nil && r.BindAddr6 != "" {
+		// Service may listen on IPv6 only
+		conn, err = net.DialTimeout("tcp", (&utils.Endpoint{Host: r.BindAddr6, Port: e.lport}).String(), time.Second)
+	}
 	if err != nil {
-		log.Debug(err)
 		return false
 	}
+	conn.Close()
+	return true
+}
 
-	for _, conn := range conns {
-		if e.lport != 0 && conn.Laddr.Port == e.lport {
-			return true
-		}
+/*
+ *  Withdraw the service when it is not ready any more,
+ *  the reconnect loop exports it again.
+ */
+func (e Export) readyChanged(r *router.Router, ready bool) {
+	if ready {
+		fmt.Println("Ready", e.key())
+		r.Publish(events.Event{Type: events.ExportReady, Service: e.user, Remote: e.rhost})
+		return
 	}
 
-	return false
+	fmt.Println("Not ready, withdrawing", e.key())
+	r.Publish(events.Event{Type: events.ExportUnready, Service: e.user, Remote: e.rhost})
+	e.withdraw()
 }
 
 /*
- *  Connect internal to remote host and periodically check the state.
+ *  Disconnect from all addresses of the remote host
  */
-func (e Export) connect(passwd string, debug bool) error {
+func (e Export) withdraw() {
+	ipArr, _ := lookupHost(e.rhost)
 
-	if e.isPortOpen() {
+	for _, ip := range ipArr {
+		e.x.clients.Disconnect(e.hash(ip.String()))
+	}
+}
 
-		ipArr, err := lookupHost(e.rhost)
-		if err != nil {
-			log.Error(err)
-			return err
+/*
+ *  Connect internal to remote host and periodically check the state.
+ *  Without a readiness check the service is only probed while some
+ *  address of the remote host is not connected.
+ */
+func (e Export) connect(r *router.Router, auth client.Auth) error {
+
+	if e.checker != nil && !e.isReady(r) {
+		if e.mon != nil {
+			// Connected before the readiness check failed
+			e.withdraw()
 		}
+		return nil
+	}
+	if e.lport == 0 {
+		return nil
+	}
 
-		// Connect to all IP address for remote host
-		for _, ip := range ipArr {
-			hash := e.lhost + "." + fmt.Sprint(e.lport) + "@" + ip.String()
-
-			// flag for skipping self connection
-			skip := false
-
-			// Make sure to not connect to itself for container:* scenario
-			laddrs, _ := net.InterfaceAddrs()
-			for _, address := range laddrs {
-				if ipnet, ok := address.(*net.IPNet); ok {
-					if ipnet.IP.To4() != nil {
-						if ip.String() == ipnet.IP.String() {
-							skip = true
-							break
-						}
-					}
-				}
-			}
+	ipArr, err := lookupHost(e.rhost)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
 
-			// Skip if remote IP is one of local interface ip
-			if skip {
-				continue
-			}
+	// Addresses of the remote host not connected yet
+	var pending []net.IP
+	for _, ip := range ipArr {
+		// Make sure to not connect to itself for container:* scenario
+		if !r.IsSelf(ip) && !e.x.clients.IsConnected(e.hash(ip.String())) {
+			pending = append(pending, ip)
+		}
+	}
+	if len(pending) == 0 || (e.checker == nil && !e.isReady(r)) {
+		return nil
+	}
 
-			// connect to dynamic port.
-			// store assigned port in map
-			// Use the same port for rest of the connections.
-			if !client.IsConnected(hash) {
-				fmt.Println("Connecting...", hash)
-				err = client.Connect(e.user, passwd, ip.String(), e.lport, e.rport, hash, debug)
-				if err != nil {
-					return err
-				}
-			}
+	// connect to dynamic port.
+	// store assigned port in map
+	// Use the same port for rest of the connections.
+	for _, ip := range pending {
+		hash := e.hash(ip.String())
+		fmt.Println("Connecting...", hash)
+		if e.retry {
+			metrics.Reconnects.WithLabelValues(e.rhost).Inc()
+			r.Publish(events.Event{Type: events.ExportRetry, Service: e.user, Remote: ip.String()})
+		}
+		if e.udp {
+			err = e.x.clients.ConnectUDP(r, e.user, auth, ip.String(), e.lport, e.rport, e.weight, hash)
+		} else {
+			err = e.x.clients.Connect(r, e.user, auth, ip.String(), e.lport, e.rport, e.weight, hash)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -237,10 +680,10 @@ func (e Export) connect(passwd string, debug bool) error {
 /*
  *  Connect to remote host and periodically check the state.
  */
-func (e Export) Connect(passwd string, interval int, debug bool) error {
+func (e Export) Connect(r *router.Router, auth client.Auth) error {
 
-	err := e.connect(passwd, debug)
-	go e.reconnect(passwd, interval, debug)
+	err := e.connect(r, auth)
+	go e.reconnect(r, auth)
 	return err
 }
 
@@ -249,81 +692,242 @@ func (e Export) Connect(passwd string, interval int, debug bool) error {
  */
 func (e Export) Disconnect() {
 	// Disconnect all connections for lport by closing goroutine channel.
-	if goroutines[e.rhost] != nil {
-		close(goroutines[e.rhost])
-		delete(goroutines, e.rhost)
-	}
+	key := e.key()
+	e.x.stop(func(other Export) bool { return other.key() == key }, true)
 }
 
 /*
- *  Connect to all hosts
+ *  Connect wildcard exports to port opened by the command
  */
-func (_rpc RPC) Connect(args *Args, errno *int) error {
+func (x *Exporter) portOpened(r *router.Router, auth client.Auth, port uint32, pid int) {
+	log.Debug("Port opened ", port)
+	r.Publish(events.Event{Type: events.PortRegistered, Port: port, Pid: pid})
 
-	log.Debug("RPC Connect invoked with args=", args)
-	// Start event loop for each option
-	forEach(_rpc.opts, func(r *Export) error {
-		if r.lport == 0 {
-			rDynamic := r
-			rDynamic.lport = args.Lport
-			rDynamic.rport = args.Rport
-			rDynamic.Connect(_rpc.passwd, _rpc.interval, _rpc.debug)
+	x.mu.Lock()
+	x.ports[port] = true
+	x.mu.Unlock()
+
+	x.connectPort(r, auth, x.currentOptions(), port)
+}
+
+/*
+ *  Start event loop for each wildcard export of opts on port
+ */
+func (x *Exporter) connectPort(r *router.Router, auth client.Auth, opts []string, port uint32) {
+	x.forEach(opts, func(e *Export) error {
+		if e.lport == 0 {
+			eDynamic := e
+			eDynamic.lport = port
+			eDynamic.rport = port
+			eDynamic.Connect(r, eDynamic.clientAuth(auth))
 		}
 		return nil
 	})
-
-	*errno = 0
-	return nil
 }
 
 /*
- *  Connect to all hosts
+ *  Disconnect exports of port closed by the command
  */
-func (_rpc RPC) Disconnect(args *Args, errno *int) error {
-	log.Debug("RPC Disconnect invoked with args=", args)
-	// Start event loop for each option
-	forEach(_rpc.opts, func(e *Export) error {
-		e.lport = args.Lport
-		e.rport = args.Rport
+func (x *Exporter) portClosed(r *router.Router, port uint32, pid int) {
+	log.Debug("Port closed ", port)
+	r.Publish(events.Event{Type: events.PortUnregistered, Port: port, Pid: pid})
+
+	x.mu.Lock()
+	delete(x.ports, port)
+	x.mu.Unlock()
+	// Stop event loop for each option
+	x.forEach(x.currentOptions(), func(e *Export) error {
+		e.lport = port
+		e.rport = port
 		e.Disconnect()
 		return nil
 	})
+}
 
-	*errno = 0
-	return nil
+/*
+ *  Sockets bound to any address or to a bind address of the router,
+ *  the router could not reach others
+ */
+func reachable(r *router.Router, ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return true
+	}
+	for _, addr := range []string{r.BindAddr, r.BindAddr6} {
+		if addr != "" && ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
 }
 
 /*
- *  Process --export options
+ *  Registration handler for the ports reported by listener.so.
+ *  Only TCP sockets bound to any address or to the bind address of the
+ *  router are exported, the router could not reach others.
  */
-func Process(passwd string, opts []string, interval int, debug bool) {
-	log.Debug(opts)
+func (x *Exporter) Registrar(r *router.Router, auth client.Auth) register.Handler {
+	return func(m register.Message) error {
+		log.Debug("Registration ", m.Action, " of ", m.Proto, " port ", m.Port, " by pid=", m.Pid)
 
-	if !rpcRegistered {
-		// Init RPC struct and export for remote calling
-		_rpc := new(RPC)
-		_rpc.opts = opts
-		_rpc.passwd = passwd
-		_rpc.interval = interval
-		_rpc.debug = debug
-
-		rpc.Register(_rpc)
-		rpc.HandleHTTP()
-		l, err := net.Listen("tcp", "localhost:3877")
-		if err != nil {
-			log.Error("listen error:", err)
+		if m.Proto != "tcp" {
+			return fmt.Errorf("%s ports are not exported", m.Proto)
+		}
+
+		if !reachable(r, net.ParseIP(m.BindAddr)) {
+			return fmt.Errorf("bound to %s, not %s", m.BindAddr, r.BindAddr)
+		}
+
+		if m.Action == register.ActionListen {
+			x.portOpened(r, auth, m.Port, m.Pid)
+		} else {
+			x.portClosed(r, m.Port, m.Pid)
 		}
-		go http.Serve(l, nil)
-		rpcRegistered = true
+		return nil
 	}
+}
 
-	// Start event loop for each option
-	forEach(opts, func(e *Export) error {
+/*
+ *  Process --export options, nothing connects if an option is malformed.
+ */
+func (x *Exporter) Process(r *router.Router, auth client.Auth, opts []string) error {
+	log.Debug(opts)
+
+	if err := x.forEach(opts, nil); err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	x.options = opts
+	x.mu.Unlock()
+
+	x.start(r, auth, opts)
+	return nil
+}
+
+/*
+ *  Start event loop for each option
+ */
+func (x *Exporter) start(r *router.Router, auth client.Auth, opts []string) {
+	x.forEach(opts, func(e *Export) error {
 		if e.lport != 0 {
-			if err := e.Connect(passwd, interval, debug); err != nil {
+			if err := e.Connect(r, e.clientAuth(auth)); err != nil {
 				log.Error(err)
 			}
 		}
 		return nil
 	})
 }
+
+/*
+ *  Options of the configured exports
+ */
+func (x *Exporter) currentOptions() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.options
+}
+
+/*
+ *  Reload exports from opts.
+ *  Exports whose option string is gone stop reconnecting and disconnect,
+ *  new ones connect and unchanged ones keep their connections. New
+ *  wildcard exports connect to the ports the command opened so far.
+ *  Nothing changes if an option is malformed.
+ */
+func (x *Exporter) Reload(r *router.Router, auth client.Auth, opts []string) error {
+	log.Debug("Reloading exports ", opts)
+
+	if err := x.forEach(opts, nil); err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	old := x.options
+	x.options = opts
+	x.mu.Unlock()
+
+	wanted := make(map[string]bool, len(opts))
+	for _, opt := range opts {
+		wanted[opt] = true
+	}
+
+	current := make(map[string]bool, len(old))
+	for _, opt := range old {
+		current[opt] = true
+		if wanted[opt] {
+			continue
+		}
+
+		fmt.Println("Export removed", opt)
+		removed := opt
+		x.stop(func(e Export) bool { return e.opt == removed }, true)
+	}
+
+	var added []string
+	for _, opt := range opts {
+		if !current[opt] {
+			fmt.Println("Export added", opt)
+			added = append(added, opt)
+			current[opt] = true
+		}
+	}
+
+	x.start(r, auth, added)
+
+	// Wildcard exports also connect to the ports opened before
+	x.mu.Lock()
+	ports := make([]uint32, 0, len(x.ports))
+	for port := range x.ports {
+		ports = append(ports, port)
+	}
+	x.mu.Unlock()
+
+	for _, port := range ports {
+		x.connectPort(r, auth, added, port)
+	}
+	return nil
+}
+
+func Cleanup() {
+	Default.Cleanup()
+}
+
+/*
+ *  Drain exports of the Default exporter
+ */
+func Drain(ctx context.Context) error {
+	return Default.Drain(ctx)
+}
+
+/*
+ *  List exports of the Default exporter
+ */
+func ListStatus() []Status {
+	return Default.ListStatus()
+}
+
+func DrainHost(ctx context.Context, rhost string) (bool, error) {
+	return Default.DrainHost(ctx, rhost)
+}
+
+func DisconnectHost(rhost string) bool {
+	return Default.DisconnectHost(rhost)
+}
+
+func Registrar(r *router.Router, auth client.Auth) register.Handler {
+	return Default.Registrar(r, auth)
+}
+
+/*
+ *  Process --export options with the Default exporter
+ */
+func Process(r *router.Router, auth client.Auth, opts []string) error {
+	return Default.Process(r, auth, opts)
+}
+
+/*
+ *  Reload exports of the Default exporter
+ */
+func Reload(r *router.Router, auth client.Auth, opts []string) error {
+	return Default.Reload(r, auth, opts)
+}
@@ -0,0 +1,426 @@
+package Export
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/omap"
+	"github.com/microstacks/stack/endpoint/router"
+	"github.com/microstacks/stack/endpoint/server"
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+func TestParse(t *testing.T) {
+	for opt, expected := range map[string]Export{
+		"web:80@lb":               {lhost: "web", lport: 80, rhost: "lb", rport: 80},
+		"web:80@lb:8080":          {lhost: "web", lport: 80, rhost: "lb", rport: 8080},
+		"web:*@lb":                {lhost: "web", lport: 0, rhost: "lb", rport: 0},
+		"web:80@lb:0":             {lhost: "web", lport: 80, rhost: "lb", rport: 0},
+		"dns:53@lb/udp":           {lhost: "dns", lport: 53, rhost: "lb", rport: 53, udp: true, user: "dns.53/udp"},
+		"web:80@lb/tcp":           {lhost: "web", lport: 80, rhost: "lb", rport: 80, user: "web.80"},
+		"web:80@fd00::1":          {lhost: "web", lport: 80, rhost: "fd00::1", rport: 80},
+		"web:80@[fd00::1]":        {lhost: "web", lport: 80, rhost: "fd00::1", rport: 80},
+		"web:80@[fd00::1]:8080":   {lhost: "web", lport: 80, rhost: "fd00::1", rport: 8080},
+		"dns:53@[fd00::1]:53/udp": {lhost: "dns", lport: 53, rhost: "fd00::1", rport: 53, udp: true},
+	} {
+		e, err := parseExport(opt)
+		if err != nil {
+			t.Error("For", opt, "expected", expected, "got", err)
+			continue
+		}
+
+		if e.lhost != expected.lhost || e.lport != expected.lport || e.rhost != expected.rhost || e.rport != expected.rport || e.udp != expected.udp {
+			t.Error(
+				"For", opt,
+				"expected", expected,
+				"got", *e,
+			)
+		}
+		if expected.user != "" && e.user != expected.user {
+			t.Error(
+				"For", opt,
+				"expected", expected.user,
+				"got", e.user,
+			)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for opt, field := range map[string]string{
+		"web:80":             "raddr",
+		"web@lb":             "app:port",
+		"1web:80@lb":         "app",
+		"web:99999@lb":       "port",
+		"web:80@":            "raddr",
+		"web:80@lb:http":     "rport",
+		"web:80@lb,weight=0": "weight",
+		"web:80@lb,prio=1":   "prio",
+		"web:*@lb/udp":       "port",
+		"web:80@lb/sctp":     "proto",
+		"web:80@[lb]:80":     "raddr",
+		"web:80@[fd00::1]80": "raddr",
+		"web:80@[fd00::1]:x": "rport",
+	} {
+		errs := Validate([]string{opt})
+		if len(errs) != 1 {
+			t.Error(
+				"For", opt,
+				"expected", "1 error",
+				"got", errs,
+			)
+			continue
+		}
+
+		err, ok := errs[0].(*utils.OptionError)
+		if !ok || err.Field != field || err.Option != opt {
+			t.Error(
+				"For", opt,
+				"expected", field,
+				"got", errs[0],
+			)
+		}
+	}
+}
+
+func TestParseCheck(t *testing.T) {
+	e, err := parseExport("web:80@lb,check=http:/ready,check-interval=2s,fall=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.checker == nil || e.checker.Interval != 2*time.Second || e.checker.Timeout != time.Second || e.checker.Rise != 1 || e.checker.Fall != 1 {
+		t.Error(
+			"For", "check",
+			"expected", "http check every 2s",
+			"got", e.checker,
+		)
+	}
+
+	for opt, field := range map[string]string{
+		"web:80@lb,check=udp":          "check",
+		"dns:53@lb/udp,check=tcp":      "check",
+		"web:80@lb,check-interval=0s":  "check-interval",
+		"web:80@lb,check-timeout=soon": "check-timeout",
+		"web:80@lb,check=tcp,rise=0":   "rise",
+	} {
+		errs := Validate([]string{opt})
+		if len(errs) != 1 {
+			t.Error("For", opt, "expected", "1 error", "got", errs)
+			continue
+		}
+
+		if err, ok := errs[0].(*utils.OptionError); !ok || err.Field != field {
+			t.Error(
+				"For", opt,
+				"expected", field,
+				"got", errs[0],
+			)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	r := &router.Router{BindAddr: "127.0.0.1", Interval: 3600}
+
+	e, _ := parseExport(fmt.Sprintf("web:%d@lb", port))
+	if !e.isReady(r) {
+		t.Error("For", "listening service", "expected", true, "got", false)
+	}
+
+	// Checked exports wait for their monitor
+	checked, _ := parseExport(fmt.Sprintf("web:%d@127.0.0.1,check=tcp,check-interval=10ms", port))
+	checked.x = New(client.New())
+	if checked.isReady(r) {
+		t.Error("For", "checked export", "expected", false, "got", true)
+	}
+
+	c, unsubscribe := events.Subscribe(16)
+	defer unsubscribe()
+
+	go checked.reconnect(r, client.Auth{})
+	defer checked.Disconnect()
+
+	waitEvent := func(typ string) {
+		for {
+			select {
+			case ev := <-c:
+				if ev.Type == typ && ev.Service == checked.user {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for", typ)
+			}
+		}
+	}
+
+	waitEvent(events.ExportReady)
+
+	// Withdrawn once the service stops answering
+	l.Close()
+	waitEvent(events.ExportUnready)
+
+	if e.isReady(r) {
+		t.Error("For", "closed service", "expected", false, "got", true)
+	}
+}
+
+func TestReadyUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	e, _ := parseExport(fmt.Sprintf("dns:%d@lb/udp", port))
+	if !e.isReady(&router.Router{BindAddr: "127.0.0.1"}) {
+		t.Error("For", "bound service", "expected", true, "got", false)
+	}
+
+	// Only the address the router sends to counts
+	if e.isReady(&router.Router{BindAddr: "127.0.0.2"}) {
+		t.Error("For", "service on another address", "expected", false, "got", true)
+	}
+
+	// Readiness is not probed with datagrams
+	pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, addr, err := pc.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("For", "readiness probe", "expected", "no datagram", "got", n, "bytes from", addr)
+	}
+
+	pc.Close()
+	if e.isReady(&router.Router{BindAddr: "127.0.0.1"}) {
+		t.Error("For", "closed service", "expected", false, "got", true)
+	}
+}
+
+func TestOwnersDown(t *testing.T) {
+	owners := &Owners{}
+	owners.Set("", []string{"app:8000@127.0.0.1:1"})
+	owners.Set("worker", []string{"worker:9000@127.0.0.1:1", "worker:9001@127.0.0.1:1"})
+
+	x := New(client.New())
+	defer x.Cleanup()
+	r := &router.Router{BindAddr: "127.0.0.1", Interval: 3600}
+
+	listed := func() []string {
+		var opts []string
+		for _, st := range x.ListStatus() {
+			opts = append(opts, st.Option)
+		}
+		return opts
+	}
+
+	if err := x.Process(r, client.Auth{}, owners.Options()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		down     bool
+		changed  bool
+		expected string
+	}{
+		{true, true, "[app:8000@127.0.0.1:1]"},
+		{true, false, "[app:8000@127.0.0.1:1]"},
+		{false, true, "[app:8000@127.0.0.1:1 worker:9000@127.0.0.1:1 worker:9001@127.0.0.1:1]"},
+	} {
+		if changed := owners.SetDown("worker", step.down); changed != step.changed {
+			t.Error("For", "down", step.down, "expected", "changed", step.changed, "got", changed)
+		}
+		if err := x.Reload(r, client.Auth{}, owners.Options()); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(listed()); got != step.expected {
+			t.Error(
+				"For", "worker down", step.down,
+				"expected", step.expected,
+				"got", got,
+			)
+		}
+	}
+}
+
+func TestListStatusReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	x := New(client.New())
+	defer x.Cleanup()
+	r := &router.Router{BindAddr: "127.0.0.1", Interval: 3600}
+
+	opt := fmt.Sprintf("web:%d@127.0.0.1:1,check=tcp,check-interval=10ms", port)
+	if err := x.Process(r, client.Auth{}, []string{opt}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ready follows the probe once the loop runs
+	waitReady := func(ready bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st := x.ListStatus()
+			if len(st) == 1 && st[0].Running && st[0].Ready == ready {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("For", "ready", ready, "expected", opt, "got", st)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitReady(false)
+	time.Sleep(50 * time.Millisecond)
+	if st := x.ListStatus(); st[0].Ready {
+		t.Error("For", "failing probe", "expected", false, "got", st[0].Ready)
+	}
+
+	l, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	waitReady(true)
+}
+
+func TestReloadChangedOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	port := service.Addr().(*net.TCPAddr).Port
+
+	// Router the service is exported to
+	srv := server.New()
+	defer srv.Close()
+	r := &router.Router{BindAddr: "127.0.0.1", Password: "secret", Interval: 3600}
+	go srv.Listen(r, server.Auth{HostKey: filepath.Join(dir, "ssh_host_ed25519_key")}, "127.0.0.1:0")
+	for wait := 0; srv.Addr() == nil; wait++ {
+		if wait == 500 {
+			t.Fatal("timeout waiting for server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.SSHPort = uint32(srv.Addr().(*net.TCPAddr).Port)
+
+	connected := make(chan *utils.Host, 10)
+	srv.AddUser(fmt.Sprintf("web.%d", port), omap.New(), func(m *omap.OMap, h *utils.Host) {
+		connected <- h
+	}, func(m *omap.OMap, h *utils.Host) {})
+
+	x := New(client.New())
+	defer x.Cleanup()
+	auth := client.Auth{InsecureHostKey: true}
+
+	if err := x.Process(r, auth, []string{fmt.Sprintf("web:%d@127.0.0.1:0", port)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for forward")
+	}
+	for wait := 0; len(x.ListStatus()) == 0 || !x.ListStatus()[0].Running; wait++ {
+		if wait == 500 {
+			t.Fatal("timeout waiting for reconnect loop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	old := x.clients.Connections()
+
+	// Same connection key, replaced before Reload returns
+	if err := x.Reload(r, auth, []string{fmt.Sprintf("web:%d@127.0.0.1:0,weight=5", port)}); err != nil {
+		t.Fatal(err)
+	}
+	if conns := x.clients.Connections(); len(old) != 1 || len(conns) != 1 || conns[0].Listen == old[0].Listen {
+		t.Error(
+			"For", "changed option",
+			"expected", "new connection",
+			"got", conns, old,
+		)
+	}
+	select {
+	case h := <-connected:
+		if h.Weight != 5 {
+			t.Error(
+				"For", "weight=5",
+				"expected", 5,
+				"got", h.Weight,
+			)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error(
+			"For", "changed option",
+			"expected", "reconnected",
+			"got", "old connection",
+		)
+	}
+}
+
+func TestReloadOpenedPort(t *testing.T) {
+	x := New(client.New())
+	defer x.Cleanup()
+	r := &router.Router{BindAddr: "127.0.0.1", Interval: 3600}
+
+	if err := x.Process(r, client.Auth{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	x.portOpened(r, client.Auth{}, 8080, 0)
+	x.portOpened(r, client.Auth{}, 8081, 0)
+	x.portClosed(r, 8081, 0)
+
+	running := func(opt string) bool {
+		for _, st := range x.ListStatus() {
+			if st.Option == opt {
+				return st.Running
+			}
+		}
+		return false
+	}
+
+	// Added wildcard export connects to the port opened before
+	opt := "web:*@127.0.0.1:1"
+	if err := x.Reload(r, client.Auth{}, []string{opt}); err != nil {
+		t.Fatal(err)
+	}
+	for wait := 0; !running(opt); wait++ {
+		if wait == 500 {
+			t.Fatal("For", opt, "expected", "reconnect loop", "got", x.ListStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key, l := range x.goroutines {
+		if l.e.lport != 8080 {
+			t.Error(
+				"For", "closed port",
+				"expected", "no reconnect loop",
+				"got", key,
+			)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package Export
+
+/*
+ *  Export options by the process exporting them, "" is the command.
+ *  The options of a process that is down are left out until it is up
+ *  again. Callers serialize access.
+ */
+type Owners struct {
+	names   []string // in the order the processes were set
+	options map[string][]string
+	down    map[string]bool
+}
+
+/*
+ *  Set the options of process name
+ */
+func (o *Owners) Set(name string, opts []string) {
+	if o.options == nil {
+		o.options = make(map[string][]string)
+		o.down = make(map[string]bool)
+	}
+	if _, ok := o.options[name]; !ok {
+		o.names = append(o.names, name)
+	}
+	o.options[name] = opts
+}
+
+/*
+ *  Mark process name down or up, returns whether it changed
+ */
+func (o *Owners) SetDown(name string, down bool) bool {
+	if o.down[name] == down {
+		return false
+	}
+	if o.down == nil {
+		o.down = make(map[string]bool)
+	}
+	o.down[name] = down
+	return true
+}
+
+/*
+ *  Options of the processes that are up
+ */
+func (o *Owners) Options() []string {
+	var opts []string
+	for _, name := range o.names {
+		if !o.down[name] {
+			opts = append(opts, o.options[name]...)
+		}
+	}
+	return opts
+}
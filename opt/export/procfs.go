@@ -0,0 +1,331 @@
+package Export
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/common/log"
+	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/router"
+)
+
+/*
+ *  Detection of wildcard ports without LD_PRELOAD, for static binaries and
+ *  anything else bypassing libc. Sockets listening in /proc/net/tcp and
+ *  /proc/net/tcp6 are matched by inode against the open files of the
+ *  processes of the child's process group.
+ */
+
+var procRoot = "/proc"
+
+/*
+ *  Time between scans of the listening sockets
+ */
+var pollInterval = time.Second
+
+/*
+ *  TCP_LISTEN in the st column of /proc/net/tcp
+ */
+const tcpListen = "0A"
+
+/*
+ *  Byte order of the 32-bit words of addresses in /proc/net/tcp
+ */
+var hostOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		hostOrder = binary.BigEndian
+	}
+}
+
+/*
+ *  IPv4 or IPv6 address of a /proc/net/tcp row, printed as 32-bit words
+ *  in host byte order
+ */
+func parseProcAddr(s string) (net.IP, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, false
+	}
+
+	ip := make(net.IP, len(b))
+	for n := 0; n < len(b); n += 4 {
+		hostOrder.PutUint32(ip[n:], binary.BigEndian.Uint32(b[n:]))
+	}
+	return ip, true
+}
+
+/*
+ *  Local address and port of a /proc/net/tcp or /proc/net/udp row
+ */
+func parseLocal(fields []string) (net.IP, uint32, bool) {
+	idx := strings.LastIndex(fields[1], ":")
+	if idx < 0 {
+		return nil, 0, false
+	}
+	ip, ok := parseProcAddr(fields[1][:idx])
+	if !ok {
+		return nil, 0, false
+	}
+	port, err := strconv.ParseUint(fields[1][idx+1:], 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return ip, uint32(port), true
+}
+
+/*
+ *  Add inodes of listening sockets in a /proc/net/tcp file to sockets,
+ *  only sockets whose local address is accepted by bound
+ */
+func parseNetTCP(r io.Reader, sockets map[uint64]uint32, bound func(net.IP) bool) error {
+	scanner := bufio.NewScanner(r)
+
+	// Skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+
+		ip, port, ok := parseLocal(fields)
+		if !ok || !bound(ip) {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		sockets[inode] = port
+	}
+
+	return scanner.Err()
+}
+
+/*
+ *  TCP_CLOSE in the st column of /proc/net/udp, unconnected sockets
+ */
+const udpUnconnected = "07"
+
+/*
+ *  Check if a /proc/net/udp file has an unconnected socket on port whose
+ *  local address is accepted by bound
+ */
+func parseNetUDP(r io.Reader, port uint32, bound func(net.IP) bool) (bool, error) {
+	scanner := bufio.NewScanner(r)
+
+	// Skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != udpUnconnected {
+			continue
+		}
+
+		if ip, p, ok := parseLocal(fields); ok && p == port && bound(ip) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+/*
+ *  Check if an IPv4 or IPv6 UDP socket is bound to port, see parseNetUDP.
+ *  The service is not sent anything.
+ */
+func udpBound(root string, port uint32, bound func(net.IP) bool) bool {
+	for _, name := range []string{"udp", "udp6"} {
+		f, err := os.Open(filepath.Join(root, "net", name))
+		if err != nil {
+			// IPv6 disabled
+			continue
+		}
+
+		found, err := parseNetUDP(f, port, bound)
+		f.Close()
+		if err != nil {
+			log.Debug("Reading ", name, ": ", err)
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  Listening IPv4 and IPv6 sockets by inode, see parseNetTCP
+ */
+func listeningSockets(root string, bound func(net.IP) bool) (map[uint64]uint32, error) {
+	sockets := make(map[uint64]uint32)
+
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(root, "net", name))
+		if os.IsNotExist(err) {
+			// IPv6 disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = parseNetTCP(f, sockets, bound)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sockets, nil
+}
+
+/*
+ *  Process group of pid from /proc/pid/stat
+ */
+func processGroup(root string, pid string) (int, bool) {
+	stat, err := ioutil.ReadFile(filepath.Join(root, pid, "stat"))
+	if err != nil {
+		return 0, false
+	}
+
+	// comm may contain spaces, fields after it are state ppid pgrp
+	idx := strings.LastIndex(string(stat), ")")
+	if idx < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(string(stat[idx+1:]))
+	if len(fields) < 3 {
+		return 0, false
+	}
+
+	pgid, err := strconv.Atoi(fields[2])
+	return pgid, err == nil
+}
+
+/*
+ *  Socket inodes open in the processes of group pgid
+ */
+func groupInodes(root string, pgid int) map[uint64]bool {
+	inodes := make(map[uint64]bool)
+
+	procs, err := ioutil.ReadDir(root)
+	if err != nil {
+		log.Debug("Reading ", root, ": ", err)
+		return inodes
+	}
+
+	for _, proc := range procs {
+		pid := proc.Name()
+		if _, err := strconv.Atoi(pid); err != nil {
+			continue
+		}
+		if group, ok := processGroup(root, pid); !ok || group != pgid {
+			continue
+		}
+
+		// Processes may exit at any time, errors are skipped
+		fds, _ := ioutil.ReadDir(filepath.Join(root, pid, "fd"))
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(root, pid, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err == nil {
+				inodes[inode] = true
+			}
+		}
+	}
+
+	return inodes
+}
+
+/*
+ *  Ports listened on by process group pgid, see parseNetTCP
+ */
+func listeningPorts(root string, pgid int, bound func(net.IP) bool) (map[uint32]bool, error) {
+	sockets, err := listeningSockets(root, bound)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[uint32]bool)
+	for inode := range groupInodes(root, pgid) {
+		if port, ok := sockets[inode]; ok {
+			ports[port] = true
+		}
+	}
+	return ports, nil
+}
+
+/*
+ *  Watch the ports of process group pgid until ctx is done.
+ *  Opened and closed ports connect and disconnect wildcard exports like
+ *  the registrations of listener.so, sockets the router cannot reach are
+ *  skipped alike. Ports still open when ctx is done are disconnected.
+ */
+func (x *Exporter) WatchPorts(ctx context.Context, r *router.Router, auth client.Auth, pgid int) {
+	known := make(map[uint32]bool)
+
+	update := func(ports map[uint32]bool) {
+		for port := range ports {
+			if !known[port] {
+				log.Debug("Listening port opened by pgid=", pgid)
+				x.portOpened(r, auth, port, 0)
+				known[port] = true
+			}
+		}
+		for port := range known {
+			if !ports[port] {
+				log.Debug("Listening port closed by pgid=", pgid)
+				x.portClosed(r, port, 0)
+				delete(known, port)
+			}
+		}
+	}
+
+	bound := func(ip net.IP) bool {
+		return reachable(r, ip)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		ports, err := listeningPorts(procRoot, pgid, bound)
+		if err != nil {
+			log.Debug("Scanning listening ports: ", err)
+		} else {
+			update(ports)
+		}
+
+		select {
+		case <-ctx.Done():
+			update(nil)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+ *  Watch the ports of process group pgid with the Default exporter
+ */
+func WatchPorts(ctx context.Context, r *router.Router, auth client.Auth, pgid int) {
+	Default.WatchPorts(ctx, r, auth, pgid)
+}
@@ -0,0 +1,185 @@
+package Export
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/router"
+)
+
+const netTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+   3: 0200007F:1F91 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1005 1 0000000000000000 100 0 0 10 0
+`
+
+const netTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0BB8 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1004 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000001000000:0BB9 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1006 1 0000000000000000 100 0 0 10 0
+`
+
+/*
+ * Router the sockets of the fake /proc are bound to
+ */
+var procRouter = &router.Router{BindAddr: "127.0.0.1"}
+
+func bound(ip net.IP) bool {
+	return reachable(procRouter, ip)
+}
+
+/*
+ * Fake /proc with the given processes, pid -> pgid and socket inodes
+ */
+func fakeProc(t *testing.T, procs map[int][]uint64, pgids map[int]int) string {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(filepath.Join(root, "net"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "net", "tcp"), []byte(netTCP), 0644)
+	ioutil.WriteFile(filepath.Join(root, "net", "tcp6"), []byte(netTCP6), 0644)
+
+	for pid, inodes := range procs {
+		dir := filepath.Join(root, fmt.Sprint(pid))
+		os.MkdirAll(filepath.Join(dir, "fd"), 0755)
+
+		stat := fmt.Sprintf("%d (my app) S 1 %d %d 0 -1", pid, pgids[pid], pgids[pid])
+		ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644)
+
+		os.Symlink("/dev/null", filepath.Join(dir, "fd", "0"))
+		for n, inode := range inodes {
+			os.Symlink(fmt.Sprintf("socket:[%d]", inode), filepath.Join(dir, "fd", fmt.Sprint(n+3)))
+		}
+	}
+
+	return root
+}
+
+func TestParseNetTCP(t *testing.T) {
+	sockets := make(map[uint64]uint32)
+	if err := parseNetTCP(strings.NewReader(netTCP), sockets, bound); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseNetTCP(strings.NewReader(netTCP6), sockets, bound); err != nil {
+		t.Fatal(err)
+	}
+
+	// 127.0.0.2 and ::1 are not addresses of the router
+	expected := map[uint64]uint32{1001: 8080, 1002: 80, 1004: 3000}
+	if !reflect.DeepEqual(sockets, expected) {
+		t.Error(
+			"For", "listening sockets",
+			"expected", expected,
+			"got", sockets,
+		)
+	}
+}
+
+const netUDP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  100: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 2001 2 0000000000000000 0
+  101: 0200007F:0036 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 2002 2 0000000000000000 0
+  102: 0100007F:0037 0100007F:0035 01 00000000:00000000 00:00000000 00000000     0        0 2003 2 0000000000000000 0
+`
+
+func TestParseNetUDP(t *testing.T) {
+	for port, expected := range map[uint32]bool{
+		53: true,  // bound to the router
+		54: false, // bound to another address
+		55: false, // connected
+		56: false, // not bound
+	} {
+		found, err := parseNetUDP(strings.NewReader(netUDP), port, bound)
+		if err != nil || found != expected {
+			t.Error(
+				"For", port,
+				"expected", expected,
+				"got", found, err,
+			)
+		}
+	}
+}
+
+func TestListeningPorts(t *testing.T) {
+	// 100 leads the group, 101 is its child, 200 is another group
+	root := fakeProc(t,
+		map[int][]uint64{100: {1001, 1003}, 101: {1004}, 200: {1002}},
+		map[int]int{100: 100, 101: 100, 200: 200})
+	defer os.RemoveAll(root)
+
+	ports, err := listeningPorts(root, 100, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uint32]bool{8080: true, 3000: true}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Error(
+			"For", "pgid 100",
+			"expected", expected,
+			"got", ports,
+		)
+	}
+}
+
+func waitPort(t *testing.T, c <-chan events.Event, typ string) uint32 {
+	for {
+		select {
+		case e := <-c:
+			if e.Type == typ {
+				return e.Port
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", typ)
+			return 0
+		}
+	}
+}
+
+func TestWatchPorts(t *testing.T) {
+	root := fakeProc(t, map[int][]uint64{100: {1001}}, map[int]int{100: 100})
+	defer os.RemoveAll(root)
+
+	defer func(root string, interval time.Duration) {
+		procRoot, pollInterval = root, interval
+	}(procRoot, pollInterval)
+	procRoot, pollInterval = root, 10*time.Millisecond
+
+	c, unsubscribe := events.Subscribe(16)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchPorts(ctx, procRouter, client.Auth{}, 100)
+
+	if port := waitPort(t, c, events.PortRegistered); port != 8080 {
+		t.Error("For", "opened port", "expected", 8080, "got", port)
+	}
+
+	// Socket closed
+	os.Remove(filepath.Join(root, "100", "fd", "3"))
+	if port := waitPort(t, c, events.PortUnregistered); port != 8080 {
+		t.Error("For", "closed port", "expected", 8080, "got", port)
+	}
+
+	// Ports still open are disconnected when watching stops
+	os.Symlink("socket:[1002]", filepath.Join(root, "100", "fd", "4"))
+	if port := waitPort(t, c, events.PortRegistered); port != 80 {
+		t.Error("For", "opened port", "expected", 80, "got", port)
+	}
+	cancel()
+	if port := waitPort(t, c, events.PortUnregistered); port != 80 {
+		t.Error("For", "stopped watch", "expected", 80, "got", port)
+	}
+}
@@ -1,15 +1,25 @@
 package Import
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/common/log"
+	"github.com/microstacks/stack/endpoint/balancer"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/health"
+	"github.com/microstacks/stack/endpoint/metrics"
 	"github.com/microstacks/stack/endpoint/omap"
+	"github.com/microstacks/stack/endpoint/router"
 	"github.com/microstacks/stack/endpoint/server"
 	"github.com/microstacks/stack/endpoint/utils"
 )
@@ -18,36 +28,221 @@ import (
  *  opt struct
  */
 type Import struct {
-	opt   string        //option string
-	lhost string        //local hostname
-	lport string        //local port to connect
-	rhost string        //remote host that connects
-	rport string        //remote port to map to
-	user  string        //username
-	block bool          //Block process till service connects
-	lb    *net.Listener //Listener socket for load balancer
+	opt   string            //option string
+	lhost string            //local hostname
+	lport string            //local port to connect
+	rhost string            //remote host that connects
+	rport string            //remote port to map to
+	user  string            //username
+	block bool              //Block process till service connects
+	udp   bool              //Forward datagrams instead of connections
+	lb    io.Closer         //Listener socket for load balancer
+	opts  map[string]string //key=value options following the spec
+	m     *omap.OMap        //Connected backends
+
+	mu sync.RWMutex //Guards settings, Reload changes them in place
+	settings
+
+	mons     *monitors //Health monitors per backend ID
+	disabled *disabled //Backends disabled through the admin API
+
+	in     *Importer //Importer running the import
+	closed bool      //removed by Reload, guarded by in.mu
+}
+
+/*
+ * Settings of an import that Reload may change without closing its
+ * SSH sessions. Connections read them once through current().
+ */
+type settings struct {
+	bal balancer.Balancer //Backend selection strategy
+
+	retries  int           //Backends tried per incoming connection
+	timeout  time.Duration //Deadline for all attempts of a connection
+	cooldown time.Duration //Time a failed backend stays out of rotation
+	idle     time.Duration //Time a UDP flow may stay idle
+
+	checker *health.Checker //Active health check, nil if disabled
+
+	keys            string //authorized_keys of this service, overrides the global ones
+	onConnectCmd    string //on-connect hook, overrides the global one
+	onDisconnectCmd string //on-disconnect hook, overrides the global one
+}
+
+/*
+ * Current settings of the import
+ */
+func (i *Import) current() settings {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.settings
+}
+
+/*
+ * Import as listed by the admin API
+ */
+type Status struct {
+	Option   string          `json:"option"`
+	User     string          `json:"user"`
+	Listen   string          `json:"listen,omitempty"` //load balanced address
+	Backends []BackendStatus `json:"backends"`
+}
+
+/*
+ * Backend as listed by the admin API
+ */
+type BackendStatus struct {
+	*utils.Host
+	Enabled  bool `json:"enabled"`  //in rotation
+	Healthy  bool `json:"healthy"`  //always true without health checks
+	Disabled bool `json:"disabled"` //disabled through the admin API
+}
+
+/*
+ * Health monitors of an import keyed by backend ID
+ */
+type monitors struct {
+	sync.Mutex
+	m map[string]*health.Monitor
+}
+
+/*
+ * Backends of an import disabled through the admin API keyed by backend ID.
+ * They stay out of rotation until enabled again, whatever their health.
+ */
+type disabled struct {
+	sync.Mutex
+	m map[string]bool
 }
 
 type parsecb func(*Import)
 type callback func()
 
-var serverRegistered bool = false
-var asyncCB callback = nil
-var imports []Import
-var done bool = false
+/*
+ * Imports of a router, registered as service users of its SSH server
+ */
+type Importer struct {
+	srv   *server.Server
+	hooks bool //run the global hook scripts of utils
 
-func Cleanup() {
+	mu       sync.Mutex //guards the imports and their load balancer listeners
+	r        *router.Router
+	addr     net.Addr //address of the SSH server, nil until Process
+	asyncCB  callback
+	imports  []*Import
+	done     bool
+	inflight utils.WaitGroup //in-flight load balanced connections
 }
 
 /*
- * forEach parser callback
+ * Importer registering its service users with srv.
+ * Only the hooks of the imports run, not the global ones.
+ */
+func New(srv *server.Server) *Importer {
+	return &Importer{srv: srv}
+}
+
+/*
+ * Importer of the endpoint command, used by the package-level functions
+ */
+var Default = &Importer{srv: server.Default, hooks: true}
+
+/*
+ * Publish event on the bus of the router
+ */
+func (in *Importer) publish(e events.Event) {
+	in.mu.Lock()
+	r := in.r
+	in.mu.Unlock()
+
+	if r == nil {
+		events.Publish(e)
+		return
+	}
+	r.Publish(e)
+}
+
+/*
+ * Address the SSH server listens on, nil until Process
+ */
+func (in *Importer) Addr() net.Addr {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.addr
+}
+
+/*
+ * Stop accepting on all load balancer ports
  */
-func forEach(opts []string, cb parsecb) {
+func (in *Importer) closeListeners() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, i := range in.imports {
+		if i.lb != nil {
+			i.lb.Close()
+			i.lb = nil
+		}
+	}
+}
+
+/*
+ * Close load balancer ports, stop health checks and forget all imports
+ */
+func (in *Importer) Cleanup() {
+	in.closeListeners()
+	in.mu.Lock()
+	imports := in.imports
+	for _, i := range imports {
+		i.closed = true
+	}
+	in.imports = nil
+	in.asyncCB = nil
+	in.done = false
+	in.mu.Unlock()
+
+	for _, i := range imports {
+		stopChecks(i)
+	}
+}
+
+/*
+ * Drain imports.
+ * Load balancer ports and SSH forwards stop accepting, in-flight
+ * connections may finish until ctx is done.
+ */
+func (in *Importer) Drain(ctx context.Context) error {
+	in.closeListeners()
+
+	errs := make(chan error, 2)
+	go func() { errs <- in.srv.Drain(ctx) }()
+	go func() { errs <- in.inflight.Wait(ctx) }()
+
+	var err error
+	for n := 0; n < 2; n++ {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/*
+ * Parse import options, nothing is registered yet.
+ */
+func parseAll(opts []string) ([]*Import, error) {
+	parsed := make([]*Import, 0, len(opts))
 
-	// Prepare and store all require option in global context.
 	for _, opt := range opts {
-		var i Import
-		i.block, i.rhost, i.rport, i.lhost, i.lport = parse(opt)
+		i := &Import{opt: opt}
+		var spec string
+		spec, i.opts = utils.SplitOptions(opt)
+		if err := parse(i, spec); err != nil {
+			return nil, err
+		}
+		if err := parseOptions(i); err != nil {
+			return nil, err
+		}
 
 		i.user = i.rhost
 		log.Debug("i.user=", i.user)
@@ -55,39 +250,242 @@ func forEach(opts []string, cb parsecb) {
 		if i.rport != "*" {
 			i.user += "." + i.rport
 		}
+		if i.udp {
+			i.user += "/udp"
+		}
 
 		log.Debug("block=", i.block, ",",
 			"raddr=", i.rhost, ",",
 			"rport=", i.rport, ",",
 			"laddr=", i.lhost, ",",
-			"lport=", i.lport)
-		imports = append(imports, i)
+			"lport=", i.lport, ",",
+			"udp=", i.udp)
+		parsed = append(parsed, i)
 	}
 
+	return parsed, nil
+}
+
+/*
+ * forEach parser callback
+ * Options are all parsed first, on error none of them is added.
+ */
+func (in *Importer) forEach(opts []string, cb parsecb) error {
+	added, err := parseAll(opts)
+	if err != nil {
+		return err
+	}
+
+	in.mu.Lock()
+	for _, i := range added {
+		i.in = in
+	}
+	in.imports = append(in.imports, added...)
+	in.mu.Unlock()
+
 	// Trigger callback for each require option.
-	for idx, _ := range imports {
-		cb(&imports[idx])
+	for _, i := range added {
+		cb(i)
 	}
+	return nil
+}
+
+/*
+ * Validate --import options without registering them.
+ * Every malformed option is reported, errors are *utils.OptionError.
+ */
+func Validate(opts []string) []error {
+	var errs []error
+	for _, opt := range opts {
+		if _, err := parseAll([]string{opt}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+var ifaceName = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9]+|\*)$`)
+
+func optionError(i *Import, field string, value string, reason string) error {
+	return &utils.OptionError{Option: i.opt, Field: field, Value: value, Reason: reason}
 }
 
 /*
  * parse --import option
- * Formats rhost:rport             - one2one port mapping
- *         rhost:rport@lhost:lport - load balance rport to lport
+ * Formats app:port             - one2one port mapping
+ *         app:port>laddr:lport - load balance port to lport
+ *                                (app:port@laddr:lport is accepted too)
+ * A /udp suffix imports a UDP service.
+ * Options such as ,lb=leastconn are split off before parsing.
  */
-func parse(str string) (bool, string, string, string, string) {
-	var expr = regexp.MustCompile(`^(\^)?([^:]+):([0-9]+|\*)(@([a-zA-Z][a-zA-Z0-9]+|\*):([0-9]+))?$`)
-	parts := expr.FindStringSubmatch(str)
+func parse(i *Import, spec string) error {
+	if strings.HasPrefix(spec, "^") {
+		i.block = true
+		spec = spec[1:]
+	}
 
-	if len(parts) == 0 {
-		utils.Check(errors.New(fmt.Sprintf("Require option parse error: [%s]. Format rhost:rport[@lhost:lport]\n", str)))
+	if idx := strings.LastIndex(spec, "/"); idx >= 0 {
+		switch proto := spec[idx+1:]; proto {
+		case "udp":
+			i.udp = true
+		case "tcp":
+		default:
+			return optionError(i, "proto", proto, "must be tcp or udp")
+		}
+		spec = spec[:idx]
 	}
 
-	block := false
-	if parts[1] == "^" {
-		block = true
+	remote, local := spec, ""
+	if idx := strings.IndexAny(spec, "@>"); idx >= 0 {
+		remote, local = spec[:idx], spec[idx+1:]
+		if local == "" {
+			return optionError(i, "laddr:lport", local, "missing after "+spec[idx:idx+1])
+		}
 	}
-	return block, parts[2], parts[3], parts[5], parts[6]
+
+	idx := strings.LastIndex(remote, ":")
+	if idx < 0 {
+		return optionError(i, "app:port", remote, "missing :port")
+	}
+	i.rhost, i.rport = remote[:idx], remote[idx+1:]
+
+	if i.rhost == "" || strings.ContainsAny(i.rhost, ":^") {
+		return optionError(i, "app", i.rhost, "invalid host")
+	}
+	if i.rport == "*" {
+		if i.udp {
+			return optionError(i, "port", i.rport, "wildcard not supported for udp")
+		}
+	} else {
+		if _, err := utils.ParsePort(i.rport, 1); err != nil {
+			return optionError(i, "port", i.rport, err.Error())
+		}
+	}
+
+	if local == "" {
+		return nil
+	}
+
+	idx = strings.LastIndex(local, ":")
+	if idx < 0 {
+		return optionError(i, "laddr:lport", local, "missing :lport")
+	}
+	i.lhost, i.lport = local[:idx], local[idx+1:]
+
+	if !ifaceName.MatchString(i.lhost) {
+		return optionError(i, "laddr", i.lhost, "invalid interface name")
+	}
+	if _, err := utils.ParsePort(i.lport, 1); err != nil {
+		return optionError(i, "lport", i.lport, err.Error())
+	}
+	return nil
+}
+
+/*
+ * parse key=value options of --import
+ *   lb=rr|leastconn|wrr|p2c|hash    - load balancing strategy
+ *   retries=n                       - backends tried per connection, default 3
+ *   timeout=duration                - deadline for all attempts, default 10s
+ *   cooldown=duration               - failed backend out of rotation, default 10s
+ *   idle-timeout=duration           - idle UDP flows are closed, default 30s
+ *   check=tcp|http:/path|exec:cmd   - active health check of every backend,
+ *                                     exec only for udp
+ *   check-interval=duration         - time between health checks, default 5s
+ *   check-timeout=duration          - timeout of a health check, default 2s
+ *   rise=n                          - successes to rejoin rotation, default 2
+ *   fall=n                          - failures to leave rotation, default 3
+ *   authorized-keys=path            - authorized_keys of this service
+ *   on-connect=path                 - hook run when a backend connects
+ *   on-disconnect=path              - hook run when a backend disconnects
+ */
+func parseOptions(i *Import) error {
+	i.retries = 3
+	i.timeout = 10 * time.Second
+	i.cooldown = 10 * time.Second
+	i.idle = 30 * time.Second
+
+	checker := health.Checker{
+		Interval: 5 * time.Second,
+		Timeout:  2 * time.Second,
+		Rise:     2,
+		Fall:     3,
+	}
+
+	for key, value := range i.opts {
+		var err error
+
+		switch key {
+		case "lb":
+			_, err = balancer.New(value, omap.New())
+		case "retries":
+			i.retries, err = strconv.Atoi(value)
+			if err == nil && i.retries < 1 {
+				err = errors.New("must be at least 1")
+			}
+		case "timeout":
+			i.timeout, err = time.ParseDuration(value)
+			if err == nil && i.timeout <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "cooldown":
+			i.cooldown, err = time.ParseDuration(value)
+			if err == nil && i.cooldown <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "idle-timeout":
+			i.idle, err = time.ParseDuration(value)
+			if err == nil && !i.udp {
+				err = errors.New("only supported for udp")
+			} else if err == nil && i.idle <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "check":
+			checker.Probe, err = health.Parse(value)
+			if err == nil && i.udp && !strings.HasPrefix(value, "exec:") {
+				err = errors.New("only exec checks are supported for udp")
+			}
+		case "check-interval":
+			checker.Interval, err = time.ParseDuration(value)
+			if err == nil && checker.Interval <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "check-timeout":
+			checker.Timeout, err = time.ParseDuration(value)
+			if err == nil && checker.Timeout <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "rise":
+			checker.Rise, err = strconv.Atoi(value)
+			if err == nil && checker.Rise < 1 {
+				err = errors.New("must be at least 1")
+			}
+		case "fall":
+			checker.Fall, err = strconv.Atoi(value)
+			if err == nil && checker.Fall < 1 {
+				err = errors.New("must be at least 1")
+			}
+		case "authorized-keys":
+			i.keys = value
+		case "on-connect":
+			i.onConnectCmd = value
+		case "on-disconnect":
+			i.onDisconnectCmd = value
+		default:
+			err = errors.New("unknown option")
+		}
+
+		if err != nil {
+			return optionError(i, key, value, err.Error())
+		}
+	}
+
+	if checker.Probe != nil {
+		i.checker = &checker
+	}
+
+	i.mons = &monitors{m: make(map[string]*health.Monitor)}
+	i.disabled = &disabled{m: make(map[string]bool)}
+	return nil
 }
 
 /*
@@ -98,164 +496,788 @@ func ConnAddEv(m *omap.OMap, h *utils.Host) {
 
 	// If this is first connection then decrement callback ticker
 	i := m.Userdata.(*Import)
-	i.block = false
 
-	// TODO: Change key such that it is unique/connections.
-	// Currently it is based on random port assignment, which can overlap with
-	// different localhost/8 IP
-	m.Add(h.LocalPort, h)
+	// Key by backend identity, ports alone can overlap across the
+	// different localhost/8 IPs.
+	m.Add(h.ID, h)
+	updateBackends(i)
 
 	payload, err := json.Marshal(h)
 	utils.Check(err)
 	fmt.Println("Connected", string(payload))
+	i.in.publish(events.Event{Type: events.BackendConnected, Service: i.user, Host: h})
 
 	// trigger on-connect code block
-	utils.OnConnect(h.RemoteIP,
-		fmt.Sprint(h.RemotePort),
-		h.LocalIP,
-		fmt.Sprint(h.LocalPort))
+	onConnect(i, h)
+
+	// Start active health checks over the forwarded port
+	startCheck(i, h)
 
 	// If this is first connection start listening on load balanced port
-	if len(i.lhost) > 0 && i.lb == nil {
-		i.lb = listen(m, i.lhost, i.lport)
+	in := i.in
+	in.mu.Lock()
+	i.block = false
+	if len(i.lhost) > 0 && i.lb == nil && !i.closed {
+		lb, err := listen(i, i.lhost, i.lport)
+		if err != nil {
+			log.Error(err)
+		}
+		i.lb = lb
 	}
 
-	log.Debug("done=", done)
+	log.Debug("done=", in.done)
 	// Invoke callback after all required services are connected.
-	if !done {
-		// Are all service connected?
-		for _, i := range imports {
-			log.Debug("checking r=", i)
-			if i.block {
-				return
-			}
-		}
+	cb := in.unblocked()
+	in.mu.Unlock()
+
+	if cb != nil {
+		log.Debug("Invoking CB", cb)
+		cb()
+	}
+}
+
+/*
+ * Callback waiting for the blocking imports, nil until none of them
+ * blocks any more. Must be called with in.mu held.
+ */
+func (in *Importer) unblocked() callback {
+	if in.done || in.asyncCB == nil {
+		return nil
+	}
 
-		if asyncCB != nil {
-			done = true
-			log.Debug("Invoking CB", asyncCB)
-			asyncCB()
-			asyncCB = nil
+	// Are all service connected?
+	for _, i := range in.imports {
+		log.Debug("checking r=", i)
+		if i.block {
+			return nil
 		}
 	}
+
+	in.done = true
+	cb := in.asyncCB
+	in.asyncCB = nil
+	return cb
 }
 
 /*
  * Connection removed callback
  */
 func ConnRemoveEv(m *omap.OMap, h *utils.Host) {
-	m.Remove(h.LocalPort)
+	i := m.Userdata.(*Import)
+
+	stopCheck(i, h.ID)
+
+	i.disabled.Lock()
+	delete(i.disabled.m, h.ID)
+	m.Remove(h.ID)
+	i.disabled.Unlock()
+	updateBackends(i)
 
 	payload, err := json.Marshal(h)
 	utils.Check(err)
 	fmt.Println("Disconnected", string(payload))
+	i.in.publish(events.Event{Type: events.BackendDisconnected, Service: i.user, Host: h})
 
 	// trigger on-connect code block
-	utils.OnDisconnect(h.RemoteIP,
-		fmt.Sprint(h.RemotePort),
-		h.LocalIP,
-		fmt.Sprint(h.LocalPort))
+	onDisconnect(i, h)
+
+}
+
+/*
+ * Start the health monitor of backend h, replacing a running one.
+ * False if health checks are disabled.
+ */
+func startCheck(i *Import, h *utils.Host) bool {
+	checker := i.current().checker
+	stopCheck(i, h.ID)
+	if checker == nil {
+		return false
+	}
+
+	endpoint := utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}
+	mon := checker.Start(endpoint.String(), func(healthy bool) {
+		healthChanged(i, h, healthy)
+	})
+
+	i.mons.Lock()
+	if old, ok := i.mons.m[h.ID]; ok {
+		old.Stop()
+	}
+	i.mons.m[h.ID] = mon
+	i.mons.Unlock()
+	return true
+}
+
+/*
+ * Stop the health monitor of backend id, if any
+ */
+func stopCheck(i *Import, id string) {
+	i.mons.Lock()
+	defer i.mons.Unlock()
+
+	if mon, ok := i.mons.m[id]; ok {
+		mon.Stop()
+		delete(i.mons.m, id)
+	}
+}
 
+/*
+ * Stop the health monitors of all backends
+ */
+func stopChecks(i *Import) {
+	i.mons.Lock()
+	defer i.mons.Unlock()
+
+	for id, mon := range i.mons.m {
+		mon.Stop()
+		delete(i.mons.m, id)
+	}
 }
 
-func listen(m *omap.OMap, lhost string, lport string) *net.Listener {
+/*
+ * Listen on the load balanced port, nil if it cannot be bound
+ */
+func listen(i *Import, lhost string, lport string) (io.Closer, error) {
+	if i.udp {
+		return listenUDP(i, lhost, lport)
+	}
 
 	ipAddr := utils.GetIP(lhost)
 
-	addr := fmt.Sprintf("%s:%s", ipAddr.String(), lport)
+	addr := net.JoinHostPort(ipAddr.String(), lport)
 	log.Debug("addr=", addr)
 
-	fmt.Printf("Listening on %s\n", addr)
 	l, err := net.Listen("tcp", addr)
-	utils.Check(err)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Listening on %s\n", addr)
 
 	go func() {
 		for {
 			// Listen for an incoming connection.
 			conn, err := l.Accept()
-			utils.Check(err)
+			if err != nil {
+				log.Debug("Stop listening on ", addr, ": ", err)
+				return
+			}
 
 			// Handle connections in a new goroutine.
-			go handleRequest(m, conn)
+			i.in.inflight.Add(1)
+			go func() {
+				defer i.in.inflight.Done()
+				handleRequest(i, conn)
+			}()
 		}
 	}()
 
-	return &l
+	return l, nil
+}
+
+/*
+ * Take a failed backend out of rotation for the cooldown period.
+ */
+func markUnhealthy(i *Import, el *omap.Element) {
+	key := el.Key()
+
+	// Out of rotation before the next attempt picks it again,
+	// health checks decide when the backend comes back.
+	if mon := monitor(i, key); mon != nil {
+		if i.m.Disable(key) {
+			updateBackends(i)
+		}
+		mon.Fail()
+		return
+	}
+
+	if i.m.Disable(key) {
+		cooldown := i.current().cooldown
+		log.Debug("Backend unhealthy ", key, " for ", cooldown)
+		updateBackends(i)
+		time.AfterFunc(cooldown, func() {
+			if enable(i, key) {
+				log.Debug("Backend back in rotation ", key)
+				updateBackends(i)
+			}
+		})
+	}
+}
+
+/*
+ * Publish backend counts of the import, up counts backends in rotation.
+ */
+func updateBackends(i *Import) {
+	up := len(i.m.Elements())
+	metrics.Backends.WithLabelValues(i.user, "up").Set(float64(up))
+	metrics.Backends.WithLabelValues(i.user, "down").Set(float64(i.m.Len() - up))
+}
+
+/*
+ * Run on-connect hook of the import for backend h
+ */
+func onConnect(i *Import, h *utils.Host) {
+	hook := ""
+	if i.in.hooks {
+		hook = utils.OnConnectHook
+	}
+	if cmd := i.current().onConnectCmd; cmd != "" {
+		hook = cmd
+	}
+	utils.RunHook(hook, h.RemoteIP, fmt.Sprint(h.RemotePort), h.LocalIP, fmt.Sprint(h.LocalPort))
+}
+
+/*
+ * Run on-disconnect hook of the import for backend h
+ */
+func onDisconnect(i *Import, h *utils.Host) {
+	hook := ""
+	if i.in.hooks {
+		hook = utils.OnDisconnectHook
+	}
+	if cmd := i.current().onDisconnectCmd; cmd != "" {
+		hook = cmd
+	}
+	utils.RunHook(hook, h.RemoteIP, fmt.Sprint(h.RemotePort), h.LocalIP, fmt.Sprint(h.LocalPort))
+}
+
+/*
+ * Put backend back in rotation unless it was disabled through the admin API.
+ */
+func enable(i *Import, key string) bool {
+	i.disabled.Lock()
+	defer i.disabled.Unlock()
+
+	if i.disabled.m[key] {
+		return false
+	}
+	return i.m.Enable(key)
+}
+
+/*
+ * Backend key disabled through the admin API
+ */
+func adminDisabled(i *Import, key string) bool {
+	i.disabled.Lock()
+	defer i.disabled.Unlock()
+	return i.disabled.m[key]
+}
+
+/*
+ * Find import with backend id
+ */
+func (in *Importer) find(id string) *Import {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, i := range in.imports {
+		if i.m != nil && i.m.Get(id) != nil {
+			return i
+		}
+	}
+	return nil
+}
+
+/*
+ * List imports with their backends
+ */
+func (in *Importer) ListStatus() []Status {
+	in.mu.Lock()
+	list := append([]*Import(nil), in.imports...)
+	status := make([]Status, len(list))
+	for n, i := range list {
+		st := Status{Option: i.opt, User: i.user, Backends: []BackendStatus{}}
+		if len(i.lhost) > 0 {
+			st.Listen = fmt.Sprintf("%s:%s", i.lhost, i.lport)
+			if i.udp {
+				st.Listen += "/udp"
+			}
+		}
+		status[n] = st
+	}
+	in.mu.Unlock()
+
+	for n, i := range list {
+		st := &status[n]
+		if i.m != nil {
+			i.disabled.Lock()
+			for _, el := range i.m.All() {
+				h := el.Value.(*utils.Host)
+				healthy := true
+				if mon := monitor(i, h.ID); mon != nil {
+					healthy = mon.Healthy()
+				}
+				st.Backends = append(st.Backends, BackendStatus{
+					Host:     h,
+					Enabled:  i.m.Enabled(h.ID),
+					Healthy:  healthy,
+					Disabled: i.disabled.m[h.ID],
+				})
+			}
+			i.disabled.Unlock()
+		}
+	}
+
+	return status
+}
+
+/*
+ * Take backend id out of rotation until EnableBackend, false if unknown.
+ * In-flight connections are left running.
+ */
+func (in *Importer) DisableBackend(id string) bool {
+	i := in.find(id)
+	if i == nil {
+		return false
+	}
+
+	i.disabled.Lock()
+	i.disabled.m[id] = true
+	changed := i.m.Disable(id)
+	i.disabled.Unlock()
+
+	if changed {
+		log.Debug("Backend disabled ", id)
+		updateBackends(i)
+	}
+	return true
+}
+
+/*
+ * Undo DisableBackend, false if unknown.
+ * A backend failing its health checks rejoins once it is healthy again.
+ */
+func (in *Importer) EnableBackend(id string) bool {
+	i := in.find(id)
+	if i == nil {
+		return false
+	}
+
+	i.disabled.Lock()
+	delete(i.disabled.m, id)
+	i.disabled.Unlock()
+
+	if mon := monitor(i, id); mon != nil && !mon.Healthy() {
+		return true
+	}
+
+	if enable(i, id) {
+		log.Debug("Backend enabled ", id)
+		updateBackends(i)
+	}
+	return true
+}
+
+/*
+ * Health monitor of backend, nil if health checks are disabled.
+ */
+func monitor(i *Import, key string) *health.Monitor {
+	i.mons.Lock()
+	defer i.mons.Unlock()
+	return i.mons.m[key]
+}
+
+/*
+ * Health state transition of a backend.
+ * Backends leave and rejoin the rotation and the on-connect/on-disconnect
+ * hooks run as if the backend had disconnected or connected.
+ */
+func healthChanged(i *Import, h *utils.Host, healthy bool) {
+	payload, err := json.Marshal(h)
+	utils.Check(err)
+
+	if healthy {
+		if !enable(i, h.ID) {
+			return
+		}
+		updateBackends(i)
+		fmt.Println("Healthy", string(payload))
+		i.in.publish(events.Event{Type: events.BackendHealthy, Service: i.user, Host: h})
+		onConnect(i, h)
+	} else {
+		// Already out of rotation after a failed dial
+		if i.m.Disable(h.ID) {
+			updateBackends(i)
+		} else if adminDisabled(i, h.ID) {
+			return
+		}
+		fmt.Println("Unhealthy", string(payload))
+		i.in.publish(events.Event{Type: events.BackendUnhealthy, Service: i.user, Host: h})
+		onDisconnect(i, h)
+	}
 }
 
 /*
  * Data Handling
  * Handles incoming tcp requests and
- * route to next available connection.
+ * route to the connection picked by the balancer.
+ * Failed backends are taken out of rotation and the next one is tried
+ * until the attempts or the deadline are exhausted.
  */
-func handleRequest(m *omap.OMap, in net.Conn) {
+func handleRequest(i *Import, in net.Conn) {
 	defer in.Close()
 
-	for {
-		el := m.Next()
-		if el != nil {
+	s := i.current()
+	deadline := time.Now().Add(s.timeout)
+
+	for attempt := 0; attempt < s.retries; attempt++ {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			break
+		}
+
+		el := s.bal.Next(in.RemoteAddr())
+		if el == nil {
+			break
+		}
+
+		h := el.Value.(*utils.Host)
+
+		endpoint := utils.Endpoint{
+			Host: h.LocalIP,
+			Port: h.LocalPort,
+		}
+
+		log.Debug("Connecting to", endpoint.String())
+		out, err := net.DialTimeout("tcp", endpoint.String(), remaining)
+		if err != nil {
+			// Connection failed, try next backend
+			log.Error(err)
+			metrics.DialFailures.WithLabelValues("backend").Inc()
+			s.bal.Done(el)
+			markUnhealthy(i, el)
+			continue
+		}
+
+		log.Debug("Routing Data for ", h)
+		go io.Copy(metrics.CountWriter(out, "lb", metrics.In), in)
+		io.Copy(metrics.CountWriter(in, "lb", metrics.Out), out)
+		out.Close()
+		s.bal.Done(el)
+		return
+	}
+
+	log.Debug("No backend available for ", in.RemoteAddr())
+}
+
+/*
+ * Register import with the SSH server
+ */
+func register(i *Import) {
+	// Initialize Ordered map and server events.
+	m := omap.New()
+	m.Userdata = i
+	i.m = m
+
+	bal, err := balancer.New(i.opts["lb"], m)
+	utils.Check(err)
+	i.bal = bal
+
+	// Add user to ssh server
+	go i.in.srv.AddUserKeys(i.user, i.keys, m, ConnAddEv, ConnRemoveEv)
+}
+
+/*
+ * Stop a removed import.
+ * The load balancer port is closed and health checks stop. The SSH sessions
+ * of its service user are closed unless another import keeps the user.
+ */
+func unregister(i *Import) {
+	in := i.in
+	in.mu.Lock()
+	i.closed = true
+	if i.lb != nil {
+		i.lb.Close()
+		i.lb = nil
+	}
+
+	shared := false
+	for _, other := range in.imports {
+		if other.user == i.user {
+			shared = true
+		}
+	}
+	in.mu.Unlock()
+
+	stopChecks(i)
+
+	if !shared {
+		in.srv.RemoveUser(i.user)
+	}
+
+	metrics.Backends.DeleteLabelValues(i.user, "up")
+	metrics.Backends.DeleteLabelValues(i.user, "down")
+}
+
+/*
+ * Options of the active health check
+ */
+var checkOptions = []string{"check", "check-interval", "check-timeout", "rise", "fall"}
+
+/*
+ * Apply the options of n to the running import i of the same service user.
+ * Its SSH sessions and backends stay, the load balancer port moves if
+ * its address changed and health checks restart if their options did.
+ * Nothing changes if the new load balancer port cannot be bound.
+ */
+func update(i *Import, n *Import) error {
+	bal, err := balancer.New(n.opts["lb"], i.m)
+	if err != nil {
+		return err
+	}
+
+	recheck := false
+	for _, key := range checkOptions {
+		if i.opts[key] != n.opts[key] {
+			recheck = true
+		}
+	}
+
+	if err := relisten(i, n); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	old := i.settings
+	i.settings = n.settings
+	i.bal = bal
+	i.mu.Unlock()
+
+	if old.keys != n.keys {
+		go i.in.srv.AddUserKeys(i.user, n.keys, i.m, ConnAddEv, ConnRemoveEv)
+	}
+
+	// Backends start over in rotation, the new checks take them out
+	if recheck {
+		for _, el := range i.m.All() {
 			h := el.Value.(*utils.Host)
-			if h != nil {
+			if enable(i, h.ID) {
+				updateBackends(i)
+			}
+			startCheck(i, h)
+		}
+	}
+	return nil
+}
 
-				endpoint := utils.Endpoint{
-					Host: h.LocalIP,
-					Port: h.LocalPort,
-				}
+/*
+ * Move the load balancer port of i to the address of n and take over
+ * its option string. The new port is bound before the old one closes.
+ * Blocking only applies until the first backend connects.
+ */
+func relisten(i *Import, n *Import) error {
+	in := i.in
+	in.mu.Lock()
+	defer in.mu.Unlock()
 
-				log.Debug("Connecting to", endpoint.String())
-				out, err := net.Dial("tcp", endpoint.String())
-				// Connection failed, remove connection information from the list
-				if err != nil {
-					log.Error(err)
-					log.Debug("Connection failed removing ", el)
-					continue
-				}
-				defer out.Close()
+	if i.lhost != n.lhost || i.lport != n.lport {
+		var lb io.Closer
+		if len(n.lhost) > 0 && i.m.Len() > 0 && !i.closed {
+			var err error
+			if lb, err = listen(i, n.lhost, n.lport); err != nil {
+				return err
+			}
+		}
+
+		if i.lb != nil {
+			i.lb.Close()
+		}
+		i.lb = lb
+		i.lhost, i.lport = n.lhost, n.lport
+	}
+
+	i.opt, i.opts = n.opt, n.opts
+	i.block = n.block && i.m.Len() == 0
+	return nil
+}
+
+/*
+ * Reload imports from opts.
+ * Imports are matched by service user. Those whose user is gone are
+ * stopped, new ones are registered and the others keep their tunnels,
+ * changed options apply in place. Nothing changes if an option is
+ * malformed, the error of a load balancer port that cannot be bound
+ * is returned once the other imports are reloaded.
+ */
+func (in *Importer) Reload(opts []string) error {
+	log.Debug("Reloading imports ", opts)
+
+	parsed, err := parseAll(opts)
+	if err != nil {
+		return err
+	}
+
+	in.mu.Lock()
+	running := make(map[string][]*Import, len(in.imports))
+	for _, i := range in.imports {
+		running[i.user] = append(running[i.user], i)
+	}
+
+	seen := make(map[string]bool, len(parsed))
+	var next, added, removed []*Import
+	var changed [][2]*Import
+	for _, n := range parsed {
+		if seen[n.opt] {
+			continue
+		}
+		seen[n.opt] = true
 
-				log.Debug("Routing Data for ", h)
-				go io.Copy(out, in)
-				io.Copy(in, out)
+		if list := running[n.user]; len(list) > 0 {
+			i := list[0]
+			running[n.user] = list[1:]
+			next = append(next, i)
+			if i.opt != n.opt {
+				changed = append(changed, [2]*Import{i, n})
 			}
+		} else {
+			n.in = in
+			next = append(next, n)
+			added = append(added, n)
 		}
-		break
 	}
 
+	for _, i := range in.imports {
+		for _, left := range running[i.user] {
+			if left == i {
+				removed = append(removed, i)
+			}
+		}
+	}
+
+	// Users of kept imports are never removed from the SSH server
+	in.imports = next
+	in.mu.Unlock()
+
+	for _, i := range removed {
+		fmt.Println("Import removed", i.opt)
+		unregister(i)
+	}
+
+	// An import whose new port cannot be bound keeps its old options
+	for _, c := range changed {
+		was := c[0].opt
+		if e := update(c[0], c[1]); e != nil {
+			log.Error("Import ", c[1].opt, " not changed: ", e)
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		fmt.Println("Import changed", was, "to", c[1].opt)
+	}
+
+	for _, i := range added {
+		fmt.Println("Import added", i.opt)
+		register(i)
+	}
+
+	// Imports that blocked may be gone or not block any more
+	in.mu.Lock()
+	cb := in.unblocked()
+	in.mu.Unlock()
+	if cb != nil {
+		go cb()
+	}
+	return err
 }
 
 /*
- * Process require options
+ * Process require options, the SSH server is not started if an
+ * option is malformed. The first call listens on r.ListenAddr(),
+ * later ones accept forwards again after a drain.
  */
-func Process(passwd string, opts []string, cb callback) {
+func (in *Importer) Process(r *router.Router, auth server.Auth, opts []string, cb callback) error {
 	log.Debug(opts)
 
-	if !serverRegistered {
-		// Start SSH Server
-		go server.Listen()
-		serverRegistered = true
+	if _, err := parseAll(opts); err != nil {
+		return err
 	}
 
-	forEach(opts, func(i *Import) {
-		// Initialize Ordered map and server events.
-		m := omap.New()
-		m.Userdata = i
+	in.mu.Lock()
+	in.r = r
+	serving := in.addr != nil
+	in.mu.Unlock()
+
+	if !serving {
+		// Start SSH Server
+		ln, err := net.Listen("tcp", r.ListenAddr())
+		if err != nil {
+			return err
+		}
+		// Host key errors are reported here, only accepting runs in the background
+		if err := in.srv.Start(r, auth, ln); err != nil {
+			return err
+		}
 
-		// Add user to ssh server
-		go server.AddUser(i.user, m, ConnAddEv, ConnRemoveEv)
+		in.mu.Lock()
+		in.addr = ln.Addr()
+		in.mu.Unlock()
+	} else {
+		// Accept forwards again after a drain
+		in.srv.Resume()
+	}
 
-	})
+	if err := in.forEach(opts, register); err != nil {
+		return err
+	}
 
 	// Check if callback can be invoked or need to wait for specific services to connect.
-	for _, i := range imports {
+	in.mu.Lock()
+	for _, i := range in.imports {
 		if i.block {
-			asyncCB = cb
+			in.asyncCB = cb
 			cb = nil
 			break
 		}
 	}
+	in.mu.Unlock()
 
-	// Invoke callback
+	// Invoke callback, it may block for the lifetime of the command
 	if cb != nil {
-		cb()
+		go cb()
 	}
 
+	return nil
+}
+
+/*
+ * Close load balancer ports and forget all imports of the Default importer
+ */
+func Cleanup() {
+	Default.Cleanup()
+}
+
+/*
+ * Drain imports of the Default importer
+ */
+func Drain(ctx context.Context) error {
+	return Default.Drain(ctx)
+}
+
+/*
+ * List imports of the Default importer
+ */
+func ListStatus() []Status {
+	return Default.ListStatus()
+}
+
+func DisableBackend(id string) bool {
+	return Default.DisableBackend(id)
+}
+
+func EnableBackend(id string) bool {
+	return Default.EnableBackend(id)
+}
+
+/*
+ * Reload imports of the Default importer
+ */
+func Reload(opts []string) error {
+	return Default.Reload(opts)
+}
+
+/*
+ * Process require options with the Default importer and server
+ */
+func Process(r *router.Router, auth server.Auth, opts []string, cb callback) error {
+	return Default.Process(r, auth, opts, cb)
 }
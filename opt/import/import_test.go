@@ -0,0 +1,584 @@
+package Import
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"github.com/microstacks/stack/endpoint/balancer"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/omap"
+	"github.com/microstacks/stack/endpoint/router"
+	"github.com/microstacks/stack/endpoint/server"
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+func newImport(t *testing.T, opt string) *Import {
+	i := &Import{opt: opt, in: Default}
+	spec, opts := utils.SplitOptions(opt)
+	i.opts = opts
+	if err := parse(i, spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseOptions(i); err != nil {
+		t.Fatal(err)
+	}
+
+	i.m = omap.New()
+	i.m.Userdata = i
+
+	bal, err := balancer.New(i.opts["lb"], i.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.bal = bal
+
+	return i
+}
+
+func addBackend(i *Import, id string, addr net.Addr) {
+	tcpAddr := addr.(*net.TCPAddr)
+	h := &utils.Host{
+		ID:        id,
+		LocalIP:   tcpAddr.IP.String(),
+		LocalPort: uint32(tcpAddr.Port),
+	}
+	i.m.Add(h.ID, h)
+}
+
+/*
+ * Address nothing listens on
+ */
+func closedAddr(t *testing.T) net.Addr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr()
+	l.Close()
+	return addr
+}
+
+/*
+ * Echo server answering a single line
+ */
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}(conn)
+		}
+	}()
+
+	return l
+}
+
+func roundTrip(t *testing.T, i *Import) (string, error) {
+	in, out := net.Pipe()
+	go handleRequest(i, out)
+	defer in.Close()
+
+	in.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := in.Write([]byte("ping\n")); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(in).ReadString('\n')
+}
+
+func TestFailover(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	i := newImport(t, "app:80,retries=3,cooldown=1h")
+	addBackend(i, "dead", closedAddr(t))
+	addBackend(i, "alive", echo.Addr())
+
+	reply, err := roundTrip(t, i)
+	if err != nil || reply != "ping\n" {
+		t.Error(
+			"For", "dead backend first",
+			"expected", "ping",
+			"got", reply, err,
+		)
+	}
+
+	if i.m.Enabled("dead") || !i.m.Enabled("alive") {
+		t.Error(
+			"For", "dead backend",
+			"expected", "out of rotation",
+			"got", i.m.Enabled("dead"),
+		)
+	}
+}
+
+func TestFailoverExhausted(t *testing.T) {
+	i := newImport(t, "app:80,retries=2")
+	addBackend(i, "dead1", closedAddr(t))
+	addBackend(i, "dead2", closedAddr(t))
+
+	if reply, err := roundTrip(t, i); err == nil {
+		t.Error(
+			"For", "all backends dead",
+			"expected", "closed connection",
+			"got", reply,
+		)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	i := newImport(t, "app:80,cooldown=10ms")
+	addBackend(i, "dead", closedAddr(t))
+
+	markUnhealthy(i, i.m.Get("dead"))
+	if i.m.Enabled("dead") {
+		t.Fatal("backend still in rotation")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !i.m.Enabled("dead") {
+		t.Error(
+			"For", "cooldown",
+			"expected", "back in rotation",
+			"got", i.m.Enabled("dead"),
+		)
+	}
+}
+
+func TestHealthCheckFailover(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	i := newImport(t, "app:80,check=tcp,check-interval=1h,rise=1")
+	addBackend(i, "dead", closedAddr(t))
+	addBackend(i, "alive", echo.Addr())
+
+	for _, el := range i.m.All() {
+		h := el.Value.(*utils.Host)
+		i.mons.m[h.ID] = i.checker.Start("127.0.0.1:1", func(healthy bool) {
+			healthChanged(i, h, healthy)
+		})
+	}
+
+	c, unsubscribe := events.Subscribe(16)
+	defer unsubscribe()
+
+	if reply, err := roundTrip(t, i); err != nil || reply != "ping\n" {
+		t.Error(
+			"For", "dead backend first",
+			"expected", "ping",
+			"got", reply, err,
+		)
+	}
+
+	// Out of rotation as soon as the dial failed
+	if i.m.Enabled("dead") {
+		t.Error("For", "dead backend", "expected", "disabled", "got", "enabled")
+	}
+
+	mon := monitor(i, "dead")
+	if mon.Healthy() {
+		t.Error(
+			"For", "dead backend",
+			"expected", "unhealthy",
+			"got", mon.Healthy(),
+		)
+	}
+
+	// The monitor still reports the transition
+	for {
+		select {
+		case ev := <-c:
+			if ev.Type == events.BackendUnhealthy && ev.Service == i.user {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", events.BackendUnhealthy)
+		}
+	}
+}
+
+func TestDisableBackend(t *testing.T) {
+	i := newImport(t, "app:80,cooldown=10ms")
+	addBackend(i, "b1", closedAddr(t))
+	Default.imports = append(Default.imports, i)
+	defer Cleanup()
+
+	if Default.find("b1") != i {
+		t.Fatal("backend not found")
+	}
+
+	if DisableBackend("unknown") {
+		t.Error(
+			"For", "unknown backend",
+			"expected", false,
+			"got", true,
+		)
+	}
+
+	DisableBackend("b1")
+	markUnhealthy(i, i.m.Get("b1"))
+	time.Sleep(100 * time.Millisecond)
+
+	// Cooldown must not bring it back
+	if i.m.Enabled("b1") {
+		t.Error(
+			"For", "disabled backend after cooldown",
+			"expected", false,
+			"got", true,
+		)
+	}
+
+	st := ListStatus()
+	if len(st) != 1 || len(st[0].Backends) != 1 || !st[0].Backends[0].Disabled {
+		t.Error(
+			"For", "ListStatus",
+			"expected", "one disabled backend",
+			"got", st,
+		)
+	}
+
+	EnableBackend("b1")
+	if !i.m.Enabled("b1") {
+		t.Error(
+			"For", "enabled backend",
+			"expected", true,
+			"got", false,
+		)
+	}
+}
+
+func TestReload(t *testing.T) {
+	in := New(server.New())
+	defer in.Cleanup()
+
+	in.Reload([]string{"db:3306", "app:80,lb=rr", "old:80"})
+	if len(in.imports) != 3 {
+		t.Fatal("expected 3 imports, got", len(in.imports))
+	}
+	db, app, old := in.imports[0], in.imports[1], in.imports[2]
+
+	in.Reload([]string{"db:3306", "app:80,lb=leastconn,retries=1", "cache:6379"})
+
+	users := make(map[string]*Import)
+	for _, i := range in.imports {
+		users[i.user] = i
+	}
+
+	if users["db.3306"] != db {
+		t.Error(
+			"For", "unchanged import",
+			"expected", "same import",
+			"got", users["db.3306"],
+		)
+	}
+
+	// Same service user, options apply in place
+	if users["app.80"] != app || app.closed || app.opt != "app:80,lb=leastconn,retries=1" || app.current().retries != 1 {
+		t.Error(
+			"For", "changed import",
+			"expected", "same import updated",
+			"got", users["app.80"], app.closed,
+		)
+	}
+
+	if _, ok := users["old.80"]; ok || !old.closed {
+		t.Error(
+			"For", "removed import",
+			"expected", "closed",
+			"got", old.closed,
+		)
+	}
+
+	if i := users["cache.6379"]; i == nil || i.m == nil {
+		t.Error(
+			"For", "cache:6379",
+			"expected", "registered import",
+			"got", i,
+		)
+	}
+}
+
+func TestReloadBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := server.New()
+	defer srv.Close()
+	in := New(srv)
+	defer in.Cleanup()
+
+	r := &router.Router{BindAddr: "127.0.0.1", Password: "secret", SSHAddr: "127.0.0.1:0"}
+	auth := server.Auth{HostKey: filepath.Join(dir, "ssh_host_ed25519_key")}
+	called := make(chan bool, 1)
+	if err := in.Process(r, auth, []string{"db:3306"}, func() { called <- true }); err != nil {
+		t.Fatal(err)
+	}
+	<-called
+
+	in.Reload([]string{"^db:3306"})
+	if db := in.imports[0]; !db.block {
+		t.Error(
+			"For", "^db:3306",
+			"expected", "blocking",
+			"got", db.block,
+		)
+	}
+
+	// The command waiting for the import starts once it stops blocking
+	in.mu.Lock()
+	in.done = false
+	in.asyncCB = func() { called <- true }
+	in.mu.Unlock()
+
+	in.Reload([]string{"db:3306"})
+	if db := in.imports[0]; db.block {
+		t.Error(
+			"For", "db:3306",
+			"expected", "not blocking",
+			"got", db.block,
+		)
+	}
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Error(
+			"For", "callback",
+			"expected", "invoked",
+			"got", "waiting",
+		)
+	}
+}
+
+func TestReloadBindError(t *testing.T) {
+	in := New(server.New())
+	defer in.Cleanup()
+
+	in.Reload([]string{"app:80"})
+	app := in.imports[0]
+	addBackend(app, "a", closedAddr(t))
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, port, _ := net.SplitHostPort(busy.Addr().String())
+
+	if err := in.Reload([]string{"app:80>lo:" + port + ",retries=1"}); err == nil {
+		t.Error(
+			"For", "port in use",
+			"expected", "error",
+			"got", err,
+		)
+	}
+
+	if app.opt != "app:80" || app.lb != nil || app.current().retries != 3 {
+		t.Error(
+			"For", "import after failed bind",
+			"expected", "app:80",
+			"got", app.opt, app.lb, app.current().retries,
+		)
+	}
+
+	// The importer is not left locked
+	busy.Close()
+	if err := in.Reload([]string{"app:80>lo:" + port}); err != nil || app.lb == nil {
+		t.Error(
+			"For", "reload after failed bind",
+			"expected", "listening",
+			"got", err, app.lb,
+		)
+	}
+}
+
+/*
+ * Start the SSH server of the imports on a local port
+ */
+func startServer(t *testing.T, srv *server.Server) string {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &router.Router{BindAddr: "127.0.0.1", Password: "secret"}
+	auth := server.Auth{HostKey: filepath.Join(dir, "ssh_host_ed25519_key")}
+	go srv.Listen(r, auth, "127.0.0.1:0")
+
+	for wait := 0; srv.Addr() == nil; wait++ {
+		if wait == 500 {
+			t.Fatal("timeout waiting for server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return srv.Addr().String()
+}
+
+func TestReloadKeepsForward(t *testing.T) {
+	srv := server.New()
+	defer srv.Close()
+	addr := startServer(t, srv)
+
+	in := New(srv)
+	defer in.Cleanup()
+	defer in.Reload(nil)
+
+	in.Reload([]string{"app:80,lb=rr"})
+	app := in.imports[0]
+
+	// Backend exporting app:80, the user is registered asynchronously
+	var client *ssh.Client
+	for wait := 0; client == nil; wait++ {
+		var err error
+		client, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "app.80",
+			Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil && wait == 500 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer client.Close()
+
+	rl, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := rl.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}(conn)
+		}
+	}()
+
+	for wait := 0; app.m.Len() == 0; wait++ {
+		if wait == 500 {
+			t.Fatal("timeout waiting for backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	in.Reload([]string{"app:80,lb=leastconn"})
+
+	if in.imports[0] != app || app.m.Len() != 1 {
+		t.Error(
+			"For", "lb change",
+			"expected", "backend kept",
+			"got", in.imports[0], app.m.Len(),
+		)
+	}
+
+	if reply, err := roundTrip(t, in.imports[0]); err != nil || reply != "ping\n" {
+		t.Error(
+			"For", "forward after lb change",
+			"expected", "ping",
+			"got", reply, err,
+		)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for opt, field := range map[string]string{
+		"db":                       "app:port",
+		":3306":                    "app",
+		"db:70000":                 "port",
+		"db:http":                  "port",
+		"app:80>eth-0:80":          "laddr",
+		"app:80>eth0:0":            "lport",
+		"app:80>eth0":              "laddr:lport",
+		"app:80,retries=0":         "retries",
+		"app:80,lb=fastest":        "lb",
+		"app:80,check=udp":         "check",
+		"app:80,balance=rr":        "balance",
+		"app:80,timeout=soon":      "timeout",
+		"dns:53/sctp":              "proto",
+		"dns:*/udp":                "port",
+		"dns:53/udp,check=tcp":     "check",
+		"app:80,idle-timeout=1m":   "idle-timeout",
+		"app:80,check-timeout=0":   "check-timeout",
+		"app:80,check-timeout=-1s": "check-timeout",
+		"app:80,timeout=0s":        "timeout",
+		"app:80,timeout=-1s":       "timeout",
+		"app:80,cooldown=0":        "cooldown",
+		"app:80,cooldown=-10s":     "cooldown",
+	} {
+		errs := Validate([]string{opt})
+		if len(errs) != 1 {
+			t.Error(
+				"For", opt,
+				"expected", "1 error",
+				"got", errs,
+			)
+			continue
+		}
+
+		err, ok := errs[0].(*utils.OptionError)
+		if !ok || err.Field != field || err.Option != opt {
+			t.Error(
+				"For", opt,
+				"expected", field,
+				"got", errs[0],
+			)
+		}
+	}
+
+	if errs := Validate([]string{"^db:3306", "app:*", "app:80>eth0:80,lb=leastconn", "dns:53>eth0:53/udp,idle-timeout=1m"}); len(errs) != 0 {
+		t.Error(
+			"For", "valid options",
+			"expected", "no errors",
+			"got", errs,
+		)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	in := New(server.New())
+	defer in.Cleanup()
+
+	in.Reload([]string{"db:3306"})
+	if err := in.Reload([]string{"cache:6379", "app:http"}); err == nil {
+		t.Error(
+			"For", "app:http",
+			"expected", "error",
+			"got", err,
+		)
+	}
+
+	if len(in.imports) != 1 || in.imports[0].opt != "db:3306" || in.imports[0].closed {
+		t.Error(
+			"For", "imports after failed reload",
+			"expected", "db:3306",
+			"got", in.imports,
+		)
+	}
+}
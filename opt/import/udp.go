@@ -0,0 +1,183 @@
+package Import
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/microstacks/stack/endpoint/metrics"
+	"github.com/microstacks/stack/endpoint/omap"
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+/*
+ * Datagrams of one client address, pinned to the backend picked
+ * for its first datagram until the flow is idle for idle.
+ */
+type udpFlow struct {
+	out   *net.UDPConn
+	el    *omap.Element
+	in    io.Writer // counts datagrams towards the backend
+	idle  time.Duration
+	timer *time.Timer
+	once  sync.Once
+	done  func()
+}
+
+func (fl *udpFlow) close() {
+	fl.once.Do(func() {
+		fl.out.Close()
+		fl.done()
+	})
+}
+
+/*
+ * Listen for datagrams on the load balanced UDP port
+ */
+func listenUDP(i *Import, lhost string, lport string) (io.Closer, error) {
+
+	ipAddr := utils.GetIP(lhost)
+
+	addr := net.JoinHostPort(ipAddr.String(), lport)
+	log.Debug("addr=", addr)
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Listening on %s/udp\n", addr)
+
+	go serveUDP(i, pc)
+	return pc, nil
+}
+
+/*
+ * Read datagrams until the port is closed and pass them to the flow
+ * of their source address. Flows end with the port.
+ */
+func serveUDP(i *Import, pc net.PacketConn) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	defer func() {
+		mu.Lock()
+		all := flows
+		flows = make(map[string]*udpFlow)
+		mu.Unlock()
+
+		for _, fl := range all {
+			fl.close()
+		}
+	}()
+
+	buf := make([]byte, utils.MaxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Debug("Stop listening on ", pc.LocalAddr(), "/udp: ", err)
+			return
+		}
+
+		key := addr.String()
+		mu.Lock()
+		fl := flows[key]
+		mu.Unlock()
+
+		if fl == nil {
+			fl = openFlow(i, pc, addr, func() {
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			})
+			if fl == nil {
+				log.Debug("No backend available for ", addr)
+				continue
+			}
+
+			mu.Lock()
+			flows[key] = fl
+			mu.Unlock()
+		}
+
+		fl.timer.Reset(fl.idle)
+		if _, err := fl.in.Write(buf[:n]); err != nil {
+			log.Debug("Write to backend failed: ", err)
+			fl.close()
+		}
+	}
+}
+
+/*
+ * Pick a backend for a new flow from addr, replies are sent back to addr.
+ * Backends refusing datagrams are taken out of rotation and the flow ends,
+ * the next datagram of the client opens a flow to another backend.
+ */
+func openFlow(i *Import, pc net.PacketConn, addr net.Addr, done func()) *udpFlow {
+	s := i.current()
+	for attempt := 0; attempt < s.retries; attempt++ {
+		el := s.bal.Next(addr)
+		if el == nil {
+			return nil
+		}
+
+		h := el.Value.(*utils.Host)
+		raddr := &net.UDPAddr{IP: net.ParseIP(h.LocalIP), Port: int(h.LocalPort)}
+
+		log.Debug("Routing datagrams of ", addr, " to ", raddr)
+		out, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			// Flow failed, try next backend
+			log.Error(err)
+			metrics.DialFailures.WithLabelValues("backend").Inc()
+			s.bal.Done(el)
+			markUnhealthy(i, el)
+			continue
+		}
+
+		i.in.inflight.Add(1)
+		fl := &udpFlow{out: out, el: el, in: metrics.CountWriter(out, "lb", metrics.In), idle: s.idle}
+		fl.done = func() {
+			done()
+			s.bal.Done(el)
+			i.in.inflight.Done()
+		}
+		fl.timer = time.AfterFunc(fl.idle, fl.close)
+
+		go replyUDP(i, fl, pc, addr)
+		return fl
+	}
+	return nil
+}
+
+/*
+ * Pass replies of the backend of a flow back to the client
+ */
+func replyUDP(i *Import, fl *udpFlow, pc net.PacketConn, addr net.Addr) {
+	defer fl.close()
+
+	buf := make([]byte, utils.MaxDatagram)
+	for {
+		n, err := fl.out.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// Forward of the backend is gone
+			metrics.DialFailures.WithLabelValues("backend").Inc()
+			markUnhealthy(i, fl.el)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		fl.timer.Reset(fl.idle)
+		if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+			log.Debug("Reply to ", addr, " failed: ", err)
+			return
+		}
+		metrics.AddBytes("lb", metrics.Out, n)
+	}
+}
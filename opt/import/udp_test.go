@@ -0,0 +1,153 @@
+package Import
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+/*
+ * UDP server answering every datagram with its name
+ */
+func udpServer(t *testing.T, name string) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, utils.MaxDatagram)
+		for {
+			_, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo([]byte(name), addr)
+		}
+	}()
+
+	return pc
+}
+
+func addUDPBackend(i *Import, id string, addr net.Addr) {
+	udpAddr := addr.(*net.UDPAddr)
+	h := &utils.Host{
+		ID:        id,
+		LocalIP:   udpAddr.IP.String(),
+		LocalPort: uint32(udpAddr.Port),
+	}
+	i.m.Add(h.ID, h)
+}
+
+/*
+ * Send ping from conn and wait for the reply
+ */
+func ping(t *testing.T, conn net.Conn) (string, error) {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func dialImport(t *testing.T, lb net.PacketConn) net.Conn {
+	conn, err := net.Dial("udp", lb.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestUDPFlow(t *testing.T) {
+	a := udpServer(t, "a")
+	defer a.Close()
+	b := udpServer(t, "b")
+	defer b.Close()
+
+	i := newImport(t, "dns:53/udp,idle-timeout=50ms")
+	addUDPBackend(i, "a", a.LocalAddr())
+	addUDPBackend(i, "b", b.LocalAddr())
+
+	l, err := listenUDP(i, "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := l.(net.PacketConn)
+	defer lb.Close()
+
+	conn := dialImport(t, lb)
+	defer conn.Close()
+
+	// Datagrams of a client stay with the backend of its flow
+	first, err := ping(t, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 3; n++ {
+		if reply, err := ping(t, conn); err != nil || reply != first {
+			t.Error(
+				"For", "same flow",
+				"expected", first,
+				"got", reply, err,
+			)
+		}
+	}
+
+	// Idle flows end, the next datagram opens a flow to the next backend
+	time.Sleep(200 * time.Millisecond)
+	if reply, err := ping(t, conn); err != nil || reply == first {
+		t.Error(
+			"For", "flow after idle timeout",
+			"expected", "other backend",
+			"got", reply, err,
+		)
+	}
+}
+
+func TestUDPFailover(t *testing.T) {
+	dead := udpServer(t, "dead")
+	dead.Close()
+	alive := udpServer(t, "alive")
+	defer alive.Close()
+
+	i := newImport(t, "dns:53/udp,cooldown=1h")
+	addUDPBackend(i, "dead", dead.LocalAddr())
+	addUDPBackend(i, "alive", alive.LocalAddr())
+
+	l, err := listenUDP(i, "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := l.(net.PacketConn)
+	defer lb.Close()
+
+	conn := dialImport(t, lb)
+	defer conn.Close()
+
+	// The datagram to the dead backend is lost, the client retries
+	var reply string
+	for n := 0; n < 3 && reply != "alive"; n++ {
+		reply, _ = ping(t, conn)
+	}
+
+	if reply != "alive" {
+		t.Error(
+			"For", "dead backend first",
+			"expected", "alive",
+			"got", reply,
+		)
+	}
+
+	if i.m.Enabled("dead") || !i.m.Enabled("alive") {
+		t.Error(
+			"For", "dead backend",
+			"expected", "out of rotation",
+			"got", i.m.Enabled("dead"),
+		)
+	}
+}
@@ -0,0 +1,295 @@
+package register
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+/*
+ * Registration of listening ports between listener.so and the router.
+ *
+ * The router listens on a unix socket only its user can open and passes
+ * the path and a token generated per run to the command through SocketEnv
+ * and TokenEnv. Every registration is a connection carrying one Message as
+ * a JSON line, answered by one Reply. Messages without the token or with a
+ * pid other than the one of the sending process are rejected.
+ */
+
+/*
+ * Version of Message, bumped on incompatible changes
+ */
+const Version = 1
+
+/*
+ * Environment of the command
+ */
+const (
+	SocketEnv = "ENDPOINT_REGISTER_SOCKET"
+	TokenEnv  = "ENDPOINT_REGISTER_TOKEN"
+)
+
+/*
+ * Message actions
+ */
+const (
+	ActionListen = "listen" // port opened
+	ActionClose  = "close"  // port closed
+)
+
+/*
+ * Registration of a port
+ */
+type Message struct {
+	Version  int    `json:"version"`
+	Token    string `json:"token"`
+	Action   string `json:"action"`   // ActionListen or ActionClose
+	Pid      int    `json:"pid"`      // process sending the message
+	BindAddr string `json:"bindaddr"` // address the socket is bound to
+	Proto    string `json:"proto"`    // tcp or udp
+	Port     uint32 `json:"port"`
+}
+
+/*
+ * Answer to a Message, Error is empty on success
+ */
+type Reply struct {
+	Version int    `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+/*
+ * Handler applies a registration, errors are returned to the sender
+ */
+type Handler func(m Message) error
+
+/*
+ * Registration server
+ */
+type Server struct {
+	l       net.Listener
+	path    string
+	token   string
+	handler Handler
+}
+
+/*
+ * Time a sender gets to send its message
+ */
+var timeout = 5 * time.Second
+
+/*
+ * Listen on unix socket path with a new token.
+ * A socket left behind by a previous run is replaced, one another router
+ * still listens on is left alone.
+ */
+func Listen(path string, handler Handler) (*Server, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := &Server{l: l, path: path, token: hex.EncodeToString(b), handler: handler}
+	go s.serve()
+	return s, nil
+}
+
+/*
+ * Remove the socket at path unless it answers
+ */
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another router", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+ * Environment passing the socket and token to the command
+ */
+func (s *Server) Env() []string {
+	return []string{SocketEnv + "=" + s.path, TokenEnv + "=" + s.token}
+}
+
+/*
+ * Stop accepting registrations and remove the socket
+ */
+func (s *Server) Close() error {
+	err := s.l.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			log.Debug("Registration socket closed: ", err)
+			return
+		}
+		go s.handle(conn.(*net.UnixConn))
+	}
+}
+
+func (s *Server) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	reply := Reply{Version: Version}
+	if err := s.receive(conn); err != nil {
+		log.Debug("Registration rejected: ", err)
+		reply.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(reply); err != nil {
+		log.Debug("Registration reply failed: ", err)
+	}
+}
+
+/*
+ * Read, check and apply the message of conn
+ */
+func (s *Server) receive(conn *net.UnixConn) error {
+	var m Message
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, &m); err != nil {
+		return fmt.Errorf("invalid message: %s", err)
+	}
+
+	if m.Version != Version {
+		return fmt.Errorf("unsupported version %d", m.Version)
+	}
+	if subtle.ConstantTimeCompare([]byte(m.Token), []byte(s.token)) != 1 {
+		return errors.New("invalid token")
+	}
+
+	pid, err := peerPid(conn)
+	if err != nil {
+		return err
+	}
+	if m.Pid != pid {
+		return fmt.Errorf("pid %d sent by pid %d", m.Pid, pid)
+	}
+
+	if m.Action != ActionListen && m.Action != ActionClose {
+		return fmt.Errorf("unknown action %q", m.Action)
+	}
+	if m.Proto != "tcp" && m.Proto != "udp" {
+		return fmt.Errorf("unknown protocol %q", m.Proto)
+	}
+	if m.Port == 0 || m.Port > 65535 {
+		return fmt.Errorf("port %d out of range", m.Port)
+	}
+	if net.ParseIP(m.BindAddr) == nil {
+		return fmt.Errorf("invalid bind address %q", m.BindAddr)
+	}
+
+	return s.handler(m)
+}
+
+/*
+ * Pid of the process at the other end of conn
+ */
+func peerPid(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.Pid), nil
+}
+
+/*
+ * Send m to the router with the socket and token of the environment.
+ * Version and Token are filled in.
+ */
+func Send(m Message) error {
+	path, token := os.Getenv(SocketEnv), os.Getenv(TokenEnv)
+	if path == "" || token == "" {
+		return errors.New("registration socket not set")
+	}
+
+	m.Version = Version
+	m.Token = token
+
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(m); err != nil {
+		return err
+	}
+
+	var reply Reply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
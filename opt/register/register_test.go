@@ -0,0 +1,162 @@
+package register
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * Registration server in a temporary directory passing messages to c
+ */
+func startServer(t *testing.T) (*Server, chan Message) {
+	dir, err := ioutil.TempDir("", "register")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan Message, 1)
+	s, err := Listen(filepath.Join(dir, "sub", "register.sock"), func(m Message) error {
+		c <- m
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Senders find the socket through the environment
+	for _, kv := range s.Env() {
+		idx := strings.Index(kv, "=")
+		os.Setenv(kv[:idx], kv[idx+1:])
+	}
+
+	return s, c
+}
+
+func stopServer(s *Server) {
+	s.Close()
+	os.RemoveAll(filepath.Dir(filepath.Dir(s.path)))
+	os.Unsetenv(SocketEnv)
+	os.Unsetenv(TokenEnv)
+}
+
+func TestSend(t *testing.T) {
+	s, c := startServer(t)
+	defer stopServer(s)
+
+	info, err := os.Stat(s.path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Error(
+			"For", "socket permissions",
+			"expected", os.FileMode(0600),
+			"got", info, err,
+		)
+	}
+
+	sent := Message{Action: ActionListen, Pid: os.Getpid(), BindAddr: "127.0.0.2", Proto: "tcp", Port: 8080}
+	if err := Send(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-c
+	if m.Version != Version || m.Action != ActionListen || m.Pid != os.Getpid() || m.BindAddr != "127.0.0.2" || m.Port != 8080 {
+		t.Error(
+			"For", "message",
+			"expected", sent,
+			"got", m,
+		)
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	s, c := startServer(t)
+	defer stopServer(s)
+
+	valid := Message{Action: ActionListen, Pid: os.Getpid(), BindAddr: "0.0.0.0", Proto: "tcp", Port: 80}
+
+	for name, m := range map[string]Message{
+		"pid":      {Action: ActionListen, Pid: 1, BindAddr: "0.0.0.0", Proto: "tcp", Port: 80},
+		"action":   {Action: "bind", Pid: os.Getpid(), BindAddr: "0.0.0.0", Proto: "tcp", Port: 80},
+		"protocol": {Action: ActionListen, Pid: os.Getpid(), BindAddr: "0.0.0.0", Proto: "sctp", Port: 80},
+		"port":     {Action: ActionListen, Pid: os.Getpid(), BindAddr: "0.0.0.0", Proto: "tcp", Port: 0},
+		"address":  {Action: ActionListen, Pid: os.Getpid(), BindAddr: "localhost", Proto: "tcp", Port: 80},
+	} {
+		if err := Send(m); err == nil || !strings.Contains(err.Error(), name) {
+			t.Error(
+				"For", name,
+				"expected", "error",
+				"got", err,
+			)
+		}
+	}
+
+	// Token of another run
+	os.Setenv(TokenEnv, "00")
+	if err := Send(valid); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Error(
+			"For", "token",
+			"expected", "invalid token",
+			"got", err,
+		)
+	}
+
+	// Message of a future version
+	conn, err := net.Dial("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	future := valid
+	future.Version = Version + 1
+	future.Token = s.token
+	json.NewEncoder(conn).Encode(future)
+
+	var reply Reply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil || !strings.Contains(reply.Error, "version") {
+		t.Error(
+			"For", "version",
+			"expected", "unsupported version",
+			"got", reply, err,
+		)
+	}
+
+	select {
+	case m := <-c:
+		t.Error("For", "rejected messages", "expected", "none handled", "got", m)
+	default:
+	}
+}
+
+func TestListenInUse(t *testing.T) {
+	s, _ := startServer(t)
+	defer stopServer(s)
+
+	// Socket of a running router
+	if other, err := Listen(s.path, func(m Message) error { return nil }); err == nil {
+		other.Close()
+		t.Fatal("For", "live socket", "expected", "error", "got", nil)
+	}
+	if err := Send(Message{Action: ActionListen, Pid: os.Getpid(), BindAddr: "0.0.0.0", Proto: "tcp", Port: 80}); err != nil {
+		t.Error("For", "live socket", "expected", "still served", "got", err)
+	}
+
+	// Socket left behind by a killed router
+	stale := filepath.Join(filepath.Dir(s.path), "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	replaced, err := Listen(stale, func(m Message) error { return nil })
+	if err != nil {
+		t.Fatal("For", "stale socket", "expected", "replaced", "got", err)
+	}
+	replaced.Close()
+}
@@ -0,0 +1,75 @@
+package router
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/microstacks/stack/endpoint/events"
+)
+
+/*
+ * Router settings shared by the client, server, Import and Export packages.
+ * They are passed explicitly, so routers of the same process do not read
+ * each other's settings from the environment.
+ */
+type Router struct {
+	BindAddr  string // loopback address of this instance, the child binds its services to it
+	BindAddr6 string // IPv6 loopback address of this instance, empty if IPv6 is not routed
+	Password  string // shared password of all services, empty disables password authentication
+	Interval  int    // seconds between checks of wildcard exports
+	Debug     bool
+
+	SSHAddr string      // address the SSH server listens on, ":22" if empty
+	SSHPort uint32      // SSH port of remote routers, 22 if 0
+	Events  *events.Bus // bus of the router events, events.Default if nil
+}
+
+/*
+ * Address the SSH server of the router listens on
+ */
+func (r *Router) ListenAddr() string {
+	if r.SSHAddr == "" {
+		return ":22"
+	}
+	return r.SSHAddr
+}
+
+/*
+ * SSH port the router connects to on remote routers
+ */
+func (r *Router) RemotePort() uint32 {
+	if r.SSHPort == 0 {
+		return 22
+	}
+	return r.SSHPort
+}
+
+/*
+ * True if a remote router at ip is this router itself,
+ * i.e. ip is a local address and the ports are the same
+ */
+func (r *Router) IsSelf(ip net.IP) bool {
+	_, port, err := net.SplitHostPort(r.ListenAddr())
+	if err != nil || port != strconv.Itoa(int(r.RemotePort())) {
+		return false
+	}
+
+	laddrs, _ := net.InterfaceAddrs()
+	for _, address := range laddrs {
+		if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Publish event on the bus of the router
+ */
+func (r *Router) Publish(e events.Event) {
+	if r.Events == nil {
+		events.Publish(e)
+		return
+	}
+	r.Events.Publish(e)
+}
@@ -0,0 +1,573 @@
+package server
+
+import (
+	"fmt"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+    "context"
+    "encoding/binary"
+
+	"golang.org/x/crypto/ssh"
+    "github.com/microstacks/stack/endpoint/metrics"
+    "github.com/microstacks/stack/endpoint/router"
+    "github.com/microstacks/stack/endpoint/utils"
+    "github.com/prometheus/common/log"
+)
+
+/*
+ * Accept backoff for temporary errors
+ */
+const (
+    minAcceptDelay = 5 * time.Millisecond
+    maxAcceptDelay = 1 * time.Second
+)
+
+/*
+ * Remote port forward of a SSH connection.
+ * The forward lives until its context is cancelled, either by
+ * "cancel-tcpip-forward" or by the end of the SSH connection.
+ */
+type forward struct {
+    addr   string      // requested host:port, port may be 0
+    key    string      // bound host:port
+    ln     net.Listener
+    pc     net.PacketConn // bound UDP socket, ln is nil for UDP forwards
+    host   *utils.Host
+    u      user        // service user at the time of the request
+    c      *connState
+    origin string      // originator address of forwarded channels
+    added  chan struct{} // closed once the connect callback returned
+    ctx    context.Context
+    cancel context.CancelFunc
+}
+
+/*
+ * Forward state per SSH connection
+ */
+type connState struct {
+    sync.Mutex
+    s        *Server
+    conn     ssh.Conn
+    ctx      context.Context     // cancelled when the connection ends
+    forwards map[string]*forward // keyed by bound host:port
+    weight   uint32              // load balancing weight announced by the client
+}
+
+/*
+ * Drain forwards of all connections.
+ * Forward listeners are closed and new forwards rejected, in-flight
+ * connections may finish until ctx is done, then the SSH connections
+ * are closed so their clients connect and forward again after Resume.
+ */
+func (s *Server) Drain(ctx context.Context) error {
+    s.conns.Lock()
+    s.conns.draining = true
+    cs := make([]*connState, 0, len(s.conns.m))
+    for _, c := range s.conns.m {
+        cs = append(cs, c)
+    }
+    s.conns.Unlock()
+
+    for _, c := range cs {
+        c.cancelAll()
+    }
+
+    err := s.active.Wait(ctx)
+
+    for _, c := range cs {
+        c.conn.Close()
+    }
+
+    return err
+}
+
+/*
+ * Accept new forwards again after Drain.
+ */
+func (s *Server) Resume() {
+    s.conns.Lock()
+    s.conns.draining = false
+    s.conns.Unlock()
+}
+
+/*
+ * Get state of SSH connection, created on first use.
+ * All forwards of the connection are cancelled when it ends.
+ */
+func (s *Server) getConnState(sshConn ssh.Conn) *connState {
+    id := string(sshConn.SessionID())
+
+    s.conns.Lock()
+    defer s.conns.Unlock()
+
+    c, ok := s.conns.m[id]
+    if !ok {
+        ctx, cancel := context.WithCancel(context.Background())
+        c = &connState{s: s, conn: sshConn, ctx: ctx, forwards: make(map[string]*forward)}
+        s.conns.m[id] = c
+        metrics.ServerConnections.Inc()
+
+        go func() {
+            sshConn.Wait()
+            cancel()
+            metrics.ServerConnections.Dec()
+
+            s.conns.Lock()
+            delete(s.conns.m, id)
+            s.conns.Unlock()
+
+            c.cancelAll()
+        }()
+    }
+
+    return c
+}
+
+/*
+ * Stop listening and notify the service user about the disconnect.
+ */
+func (f *forward) stop() {
+    log.Debug("Stop forwarding/listening on ", f.key)
+    f.cancel()
+    if f.pc != nil {
+        f.pc.Close()
+    } else {
+        f.ln.Close()
+    }
+    metrics.Forwards.WithLabelValues(f.u.user).Dec()
+
+    // The service user learns about the disconnect after the connect
+    go func() {
+        <-f.added
+        f.u.dcb(f.u.m, f.host)
+    }()
+}
+
+/*
+ * Accept connections until the forward is cancelled.
+ * Temporary errors are retried with exponential backoff, any other
+ * error tears the forward down.
+ */
+func (f *forward) serve() {
+    var delay time.Duration
+
+    for {
+        conn, err := f.ln.Accept()
+        if err != nil {
+            if f.ctx.Err() != nil {
+                return
+            }
+
+            if ne, ok := err.(net.Error); ok && ne.Temporary() {
+                if delay == 0 {
+                    delay = minAcceptDelay
+                } else if delay *= 2; delay > maxAcceptDelay {
+                    delay = maxAcceptDelay
+                }
+                log.Debug("Accept error on ", f.ln.Addr(), ": ", err, " retrying in ", delay)
+
+                select {
+                case <-f.ctx.Done():
+                    return
+                case <-time.After(delay):
+                }
+                continue
+            }
+
+            log.Debug("Accept failed on ", f.ln.Addr(), ": ", err)
+            if f.c.removeForward(f) {
+                f.stop()
+            }
+            return
+        }
+
+        delay = 0
+        f.c.s.active.Add(1)
+        go f.handle(conn)
+    }
+}
+
+/*
+ * Route accepted connection through a "forwarded-tcpip" channel.
+ */
+func (f *forward) handle(conn net.Conn) {
+    sshConn := f.c.conn
+
+    // Released by close once both directions are done
+    var once sync.Once
+    release := func() { once.Do(f.c.s.active.Done) }
+
+    fmt.Println("SSH Server: New Connection request local port ", conn.LocalAddr())
+
+	p := directForward{}
+	var err error
+
+	var portnum int
+	p.Host1 = f.host.LocalIP
+	p.Port1 = f.host.LocalPort
+	p.Host2, portnum, err = utils.GetHostPort(conn.RemoteAddr())
+	if err != nil {
+        fmt.Println(err)
+		conn.Close()
+		release()
+		return
+	}
+
+    p.Host2 = f.origin
+
+	p.Port2 = uint32(portnum)
+	ch, reqs, err := sshConn.OpenChannel(ForwardedTCPReturnRequest, ssh.Marshal(p))
+	if err != nil {
+		log.Debug("Open forwarded Channel: ", err.Error())
+		conn.Close()
+		release()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+    fmt.Println("SSH Server: Routing Data between ", conn.RemoteAddr(), "<-->", conn.LocalAddr(), "@", sshConn.RemoteAddr().String())
+
+	close := func() {
+		ch.Close()
+		conn.Close()
+		release()
+
+		log.Debug("forwarding closed")
+	}
+
+	utils.CopyReadWriters(conn, ch, close)
+}
+
+/*
+ * Remove forward from the connection, false if it was already removed.
+ */
+func (c *connState) removeForward(f *forward) bool {
+    c.Lock()
+    defer c.Unlock()
+
+    if c.forwards[f.key] != f {
+        return false
+    }
+    delete(c.forwards, f.key)
+    return true
+}
+
+/*
+ * Cancel all forwards of the connection
+ */
+func (c *connState) cancelAll() {
+    c.Lock()
+    forwards := c.forwards
+    c.forwards = make(map[string]*forward)
+    c.Unlock()
+
+    for _, f := range forwards {
+        f.stop()
+    }
+}
+
+/*
+ * Remove forward matching a cancel request.
+ * Port 0 matches a dynamically allocated forward on the same host.
+ */
+func (c *connState) remove(host string, port uint32) *forward {
+    c.Lock()
+    defer c.Unlock()
+
+    key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+    f, ok := c.forwards[key]
+
+    if !ok {
+        requested := net.JoinHostPort(host, "0")
+        for k, fwd := range c.forwards {
+            if fwd.addr == key || (port == 0 && fwd.addr == requested) {
+                key, f, ok = k, fwd, true
+                break
+            }
+        }
+    }
+
+    if !ok {
+        return nil
+    }
+
+    delete(c.forwards, key)
+    return f
+}
+
+/*
+ * Forward listener as listed by the admin API
+ */
+type ForwardStatus struct {
+    User   string      `json:"user"`
+    Addr   string      `json:"addr"`   // bound host:port
+    Remote string      `json:"remote"` // address of the SSH client
+    Host   *utils.Host `json:"host"`
+}
+
+/*
+ * List forward listeners of all SSH connections
+ */
+func (s *Server) Forwards() []ForwardStatus {
+    s.conns.Lock()
+    cs := make([]*connState, 0, len(s.conns.m))
+    for _, c := range s.conns.m {
+        cs = append(cs, c)
+    }
+    s.conns.Unlock()
+
+    status := []ForwardStatus{}
+    for _, c := range cs {
+        c.Lock()
+        for _, f := range c.forwards {
+            status = append(status, ForwardStatus{
+                User:   f.u.user,
+                Addr:   f.key,
+                Remote: c.conn.RemoteAddr().String(),
+                Host:   f.host,
+            })
+        }
+        c.Unlock()
+    }
+
+    return status
+}
+
+/*
+ * Find forward of backend id
+ */
+func (s *Server) find(id string) *forward {
+    s.conns.Lock()
+    defer s.conns.Unlock()
+
+    for _, c := range s.conns.m {
+        c.Lock()
+        for _, f := range c.forwards {
+            if f.host.ID == id {
+                c.Unlock()
+                return f
+            }
+        }
+        c.Unlock()
+    }
+
+    return nil
+}
+
+/*
+ * CancelForward stops the forward of backend id as if the client had
+ * cancelled it. In-flight connections are left running.
+ */
+func (s *Server) CancelForward(id string) bool {
+    f := s.find(id)
+    if f == nil || !f.c.removeForward(f) {
+        return false
+    }
+
+    f.stop()
+    return true
+}
+
+/*
+ * Disconnect closes the SSH connection owning backend id, all forwards
+ * and in-flight connections of that connection are torn down.
+ */
+func (s *Server) Disconnect(id string) bool {
+    f := s.find(id)
+    if f == nil {
+        return false
+    }
+
+    f.c.conn.Close()
+    return true
+}
+
+// TCPIPForwardRequest fulfills RFC 4254 7.1 "tcpip-forward" request of router r
+func (s *Server) TCPIPForwardRequest(r *router.Router, req *ssh.Request, sshConn ssh.Conn) {
+
+	t := tcpipForward{}
+	if err := ssh.Unmarshal(req.Payload, &t); err != nil {
+		log.Debug("Invalid tcpip-forward payload: ", err)
+		req.Reply(false, nil)
+		return
+	}
+	requested := t.Port
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port)))
+
+    u, ok := s.forwardUser(sshConn, addr)
+    if !ok {
+        req.Reply(false, nil)
+        return
+    }
+
+	ln, err := net.Listen("tcp", addr) //tie to the client connection
+	if err != nil {
+		log.Debug("Unable to listen on address: ", addr)
+		req.Reply(false, nil)
+		return
+	}
+
+    _, lport, err := utils.GetHostPort(ln.Addr())
+    if err != nil {
+        log.Debug("Unable to get listening port: ", err)
+        ln.Close()
+        req.Reply(false, nil)
+        return
+    }
+    t.Port = uint32(lport)
+
+    fmt.Println("SSH Server: Remote Port Forward request for ", ln.Addr().String(), 
+                " from ", sshConn.RemoteAddr().String())
+
+    c := s.getConnState(sshConn)
+
+    h := &utils.Host{}
+    h.ID = utils.HostID(sshConn.RemoteAddr(), sshConn.SessionID(), t.Port)
+    h.LocalIP = t.Host
+    h.LocalPort = t.Port
+    tcpAddr, _ := sshConn.RemoteAddr().(*net.TCPAddr)
+    h.RemoteIP = tcpAddr.IP.String()
+    h.RemotePort = t.Port
+
+    f := &forward{
+        addr:   addr,
+        key:    net.JoinHostPort(t.Host, strconv.Itoa(lport)),
+        ln:     ln,
+        host:   h,
+        u:      u,
+        c:      c,
+        origin: r.BindAddr,
+    }
+    f.ctx, f.cancel = context.WithCancel(c.ctx)
+
+    if !c.addForward(f) {
+        ln.Close()
+        req.Reply(false, nil)
+        return
+    }
+    replyForward(req, requested, t.Port)
+    go f.serve()
+}
+
+/*
+ * Accept a forward request once it is registered.
+ * A client that sent port 0 learns which port is actually being used.
+ */
+func replyForward(req *ssh.Request, requested uint32, port uint32) {
+    if requested == 0 && req.WantReply {
+        b := make([]byte, 4)
+        binary.BigEndian.PutUint32(b, port)
+        req.Reply(true, b)
+        return
+    }
+    req.Reply(true, nil)
+}
+
+/*
+ * Service user of a forward request, false if the user is unknown
+ * or forwards are rejected while draining.
+ */
+func (s *Server) forwardUser(sshConn ssh.Conn, addr string) (user, bool) {
+    s.users.RLock()
+    u, ok := s.userDB[sshConn.User()]
+    s.users.RUnlock()
+    if !ok {
+        log.Debug("Unknown user: ", sshConn.User())
+        return u, false
+    }
+
+    s.conns.Lock()
+    draining := s.conns.draining
+    s.conns.Unlock()
+    if draining {
+        log.Debug("Draining, rejecting forward for ", addr)
+        return u, false
+    }
+
+    return u, true
+}
+
+/*
+ * Register forward with its connection and notify the service user.
+ * False if the connection ended while the forward was set up.
+ */
+func (c *connState) addForward(f *forward) bool {
+    c.Lock()
+    if c.ctx.Err() != nil {
+        c.Unlock()
+        f.cancel()
+        return false
+    }
+    f.host.Weight = c.weight
+    f.added = make(chan struct{})
+    c.forwards[f.key] = f
+    c.Unlock()
+    metrics.Forwards.WithLabelValues(f.u.user).Inc()
+
+    go func() {
+        f.u.ccb(f.u.m, f.host)
+        close(f.added)
+    }()
+    return true
+}
+
+// TCPIPCancelRequest fulfills RFC 4254 7.1 "cancel-tcpip-forward" request
+func (s *Server) TCPIPCancelRequest(req *ssh.Request, sshConn ssh.Conn) {
+	t := tcpipForward{}
+	if err := ssh.Unmarshal(req.Payload, &t); err != nil {
+		log.Debug("Invalid cancel-tcpip-forward payload: ", err)
+		req.Reply(false, nil)
+		return
+	}
+
+    f := s.getConnState(sshConn).remove(t.Host, t.Port)
+    if f == nil {
+        log.Debug("No forward to cancel for ", t.Host, ":", t.Port)
+        req.Reply(false, nil)
+        return
+    }
+
+    f.stop()
+    req.Reply(true, nil)
+}
+
+// BackendWeightRequest stores the load balancing weight for forwards of this connection
+func (s *Server) BackendWeightRequest(req *ssh.Request, sshConn ssh.Conn) {
+    w := struct{ Weight uint32 }{}
+    if err := ssh.Unmarshal(req.Payload, &w); err != nil {
+        req.Reply(false, nil)
+        return
+    }
+
+    c := s.getConnState(sshConn)
+    c.Lock()
+    c.weight = w.Weight
+    c.Unlock()
+
+    req.Reply(true, nil)
+}
+
+/*
+ * Package-level functions of the Default server
+ */
+func Drain(ctx context.Context) error {
+    return Default.Drain(ctx)
+}
+
+func Resume() {
+    Default.Resume()
+}
+
+func Forwards() []ForwardStatus {
+    return Default.Forwards()
+}
+
+func CancelForward(id string) bool {
+    return Default.CancelForward(id)
+}
+
+func Disconnect(id string) bool {
+    return Default.Disconnect(id)
+}
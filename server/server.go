@@ -2,29 +2,36 @@ package server
 
 import (
 	"fmt"
+    "errors"
     "net"
     "os"
-    "crypto/rsa" 
+    "bytes"
+    "io/ioutil"
+    "path/filepath"
+    "crypto/subtle"
+    "sync"
+    "crypto/ed25519"
     "crypto/rand" 
     "encoding/pem"
-    "encoding/binary"
     "crypto/x509" 
+    "strconv"
+    "strings"
+    "time"
 
 	"golang.org/x/crypto/ssh"
-    "dev.justinjudd.org/justin/easyssh"
     "github.com/microstacks/stack/endpoint/omap"
+    "github.com/microstacks/stack/endpoint/router"
     "github.com/microstacks/stack/endpoint/utils"
     "github.com/prometheus/common/log"
 )
 
-var rfwds map[string]net.Listener = make(map[string]net.Listener)
-
 type Callback func(*omap.OMap, *utils.Host)
 
 const (
 	RemoteForwardRequest       = "tcpip-forward"        
 	ForwardedTCPReturnRequest  = "forwarded-tcpip"      
 	CancelRemoteForwardRequest = "cancel-tcpip-forward" 
+	DirectForwardRequest       = "direct-tcpip"
 )
 
 // tcpipForward is structure for RFC 4254 7.1 "tcpip-forward" request
@@ -46,221 +53,489 @@ type directForward struct {
  */
 type user struct {
     user string
+    keys string // authorized_keys of the service, empty for the global ones
     ccb Callback
     dcb Callback
     m   *omap.OMap
 }
 
 /*
- * User DB
+ * Authentication settings of the SSH server, the password is the one of
+ * the router. An empty AuthorizedKeys disables public key authentication,
+ * except for service users added with their own authorized keys.
  */
-var userDB map[string]user = make(map[string]user, 1)
+type Auth struct {
+    AuthorizedKeys string // authorized_keys file, or directory with one file per service user
+    HostKey        string // Host key file, generated on first start
+}
 
 /*
- * MakeSSHKeyPair make a pair of public and private keys for SSH access.
- * Public key is encoded in the format for inclusion in an OpenSSH authorized_keys file.
- * Private Key generated is PEM encoded
+ * Name of the authorized keys file of user in a directory, the protocol
+ * suffix of UDP services becomes part of the name: dns.53/udp reads dns.53.udp
  */
-func MakeSSHKeyPair() ([]byte, []byte, error) {
-    privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+func keysFile(uname string) string {
+    return strings.Replace(uname, "/", ".", -1)
+}
+
+/*
+ * Load authorized keys for user.
+ * If path is a directory, keys are read from the file named after the user,
+ * see keysFile, otherwise the single authorized_keys file is used for all users.
+ */
+func authorizedKeys(path string, uname string) ([]ssh.PublicKey, error) {
+    fi, err := os.Stat(path)
     if err != nil {
-        return nil, nil, err
+        return nil, err
     }
 
-    privateKeyBlock := pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
-    privateKeyPEM := pem.EncodeToMemory(&privateKeyBlock)
-    
-    // generate and write public key
-    pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+    if fi.IsDir() {
+        path = filepath.Join(path, keysFile(uname))
+    }
+
+    data, err := ioutil.ReadFile(path)
     if err != nil {
-        return nil, nil, err
+        return nil, err
     }
-    
-    return privateKeyPEM, ssh.MarshalAuthorizedKey(pub), nil
+
+    var keys []ssh.PublicKey
+    for len(bytes.TrimSpace(data)) > 0 {
+        key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", path, err)
+        }
+        keys = append(keys, key)
+        data = rest
+    }
+
+    return keys, nil
 }
 
+/*
+ * LoadHostKey loads the SSH host key stored at path.
+ * A new Ed25519 key is generated and saved when the file does not exist yet,
+ * so the host key, and therefore its fingerprint, survives restarts.
+ * The public key is written next to it with a .pub suffix.
+ */
+func LoadHostKey(path string) (ssh.Signer, error) {
+    data, err := ioutil.ReadFile(path)
+    if err == nil {
+        return ssh.ParsePrivateKey(data)
+    }
 
-// TCPIPForwardRequest fulfills RFC 4254 7.1 "tcpip-forward" request
-//
-// TODO: Need to add state to handle "cancel-tcpip-forward"
-func TCPIPForwardRequest(req *ssh.Request, sshConn ssh.Conn) {
+    if !os.IsNotExist(err) {
+        return nil, err
+    }
 
-	t := tcpipForward{}
-	reply := (t.Port == 0) && req.WantReply
-	ssh.Unmarshal(req.Payload, &t)
-	addr := fmt.Sprintf("%s:%d", t.Host, t.Port)
-    
-	ln, err := net.Listen("tcp", addr) //tie to the client connection
-	if err != nil {
-		log.Debug("Unable to listen on address: ", addr)
-		return
-	}
-    
-    //Store in listener map
-    rfwds[addr] = ln
-    
-    fmt.Println("SSH Server: Remote Port Forward request for ", ln.Addr().String(), 
-                " from ", sshConn.RemoteAddr().String())
-
-	quit := make(chan bool)
-
-	if reply { // Client sent port 0. let them know which port is actually being used
-
-		_, port, err := utils.GetHostPort(ln.Addr())
-		if err != nil {
-			return
-		}
-
-		b := make([]byte, 4)
-		binary.BigEndian.PutUint32(b, uint32(port))
-		t.Port = uint32(port)
-		req.Reply(true, b)
-	} else {
-		req.Reply(true, nil)
-	}
-
-    u := userDB[sshConn.User()]
-    h := &utils.Host{}
-    h.LocalIP = t.Host
-    h.LocalPort = t.Port
-    tcpAddr, _ := sshConn.RemoteAddr().(*net.TCPAddr)
-    h.RemoteIP = tcpAddr.IP.String()
-    h.RemotePort = t.Port
-
-    go u.ccb(u.m, h)    
-    
-	go func() { // Handle incoming connections on this new listener
-		for {
-			select {
-			case <-quit:
-
-				return
-			default:
-				conn, err := ln.Accept()
-				if err != nil { // Unable to accept new connection - listener likely closed
-					continue
-				}
-
-                fmt.Println("SSH Server: New Connection request local port ", conn.LocalAddr())
-    
-                go func(conn net.Conn) {
-					p := directForward{}
-					var err error
+    _, privateKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
 
-					var portnum int
-					p.Host1 = t.Host
-					p.Port1 = t.Port
-					p.Host2, portnum, err = utils.GetHostPort(conn.RemoteAddr())
-					if err != nil {
-                        fmt.Println(err)
-						return
-					}
+    der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+    if err != nil {
+        return nil, err
+    }
+
+    signer, err := ssh.NewSignerFromKey(privateKey)
+    if err != nil {
+        return nil, err
+    }
 
-                    p.Host2 = os.Getenv("BINDADDR")
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, err
+    }
 
-					p.Port2 = uint32(portnum)
-					ch, reqs, err := sshConn.OpenChannel(ForwardedTCPReturnRequest, ssh.Marshal(p))
-					if err != nil {
-						log.Debug("Open forwarded Channel: ", err.Error())
-						return
-					}
-					go ssh.DiscardRequests(reqs)
+    privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+    if err := ioutil.WriteFile(path, privateKeyPEM, 0600); err != nil {
+        return nil, err
+    }
 
-                    fmt.Println("SSH Server: Routing Data between ", conn.RemoteAddr(), "<-->", conn.LocalAddr(), "@", sshConn.RemoteAddr().String())
-					go func(ch ssh.Channel, conn net.Conn) {
+    if err := ioutil.WriteFile(path + ".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+        return nil, err
+    }
 
-						close := func() {
-							ch.Close()
-							conn.Close()
+    log.Debug("Generated host key ", path)
+    return signer, nil
+}
 
-							log.Debug("forwarding closed")
-						}
 
-						go utils.CopyReadWriters(conn, ch, close)
+/*
+ * Host key of the endpoint command, also used when none is configured
+ */
+const DefaultHostKey = "/var/lib/dupper/ssh_host_ed25519_key"
 
-					}(ch, conn)
+/*
+ * Errors of Listen and Serve
+ */
+var (
+    ErrListening    = errors.New("ssh server: already listening")
+    ErrServerClosed = errors.New("ssh server: closed")
+)
 
-				}(conn)
-			}
+/*
+ * SSH server of a router.
+ * Service users, SSH connections and forwards belong to the server, so
+ * routers of the same process do not see each other's services.
+ */
+type Server struct {
+    users  sync.RWMutex
+    userDB map[string]user
+
+    // Active SSH connections keyed by session ID
+    conns struct {
+        sync.Mutex
+        m        map[string]*connState
+        draining bool // reject new forwards
+    }
 
-		}
+    active utils.WaitGroup // in-flight forwarded connections
 
-	}()
-    
-    sshConn.Wait()
-    u = userDB[sshConn.User()]
-    go u.dcb(u.m, h)    
-    
-    log.Debug("Stop forwarding/listening on ", ln.Addr())
-    ln.Close()
-    quit <- true        
+    mu     sync.Mutex
+    ln     net.Listener
+    closed bool
+}
 
+func New() *Server {
+    s := &Server{userDB: make(map[string]user, 1)}
+    s.conns.m = make(map[string]*connState)
+    return s
 }
 
-func TCPIPCancelRequest(req *ssh.Request, sshConn ssh.Conn) {
-	t := tcpipForward{}
-	reply := (t.Port == 0) && req.WantReply
-	ssh.Unmarshal(req.Payload, &t)
-	addr := fmt.Sprintf("%s:%d", t.Host, t.Port)
-    
-    ln, ok := rfwds[addr]
-    
-    if ok {
-        if reply { // Client sent port 0. let them know which port is actually being used
-            _, port, err := utils.GetHostPort(ln.Addr())
-            if err != nil {
-                return
+/*
+ * Server of the endpoint command, used by the package-level functions
+ */
+var Default = New()
+
+/*
+ * SSH server configuration of router r
+ */
+func (s *Server) config(r *router.Router, auth Auth) (*ssh.ServerConfig, error) {
+
+    // Handle Authentication
+    config := &ssh.ServerConfig{}
+
+    if r.Password != "" {
+        config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+            s.users.RLock()
+            u, ok := s.userDB[c.User()]
+            s.users.RUnlock()
+            if ok && subtle.ConstantTimeCompare(pass, []byte(r.Password)) == 1 {
+                return &ssh.Permissions{Extensions: map[string]string{"user": u.user}}, nil
+            }
+            return nil, fmt.Errorf("password rejected for %q", c.User())
+        }
+    }
+
+    // Service users may bring their own keys, so the callback is always installed.
+    config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+        s.users.RLock()
+        u, ok := s.userDB[c.User()]
+        s.users.RUnlock()
+        if !ok {
+            return nil, fmt.Errorf("unknown user %q", c.User())
+        }
+
+        path := u.keys
+        if path == "" {
+            path = auth.AuthorizedKeys
+        }
+        if path == "" {
+            return nil, fmt.Errorf("public key authentication disabled for %q", c.User())
+        }
+
+        // Re-read keys on every attempt so keys can be rotated without restart.
+        keys, err := authorizedKeys(path, c.User())
+        if err != nil {
+            log.Debug("Unable to load authorized keys: ", err)
+            return nil, fmt.Errorf("public key rejected for %q", c.User())
+        }
+
+        for _, k := range keys {
+            if bytes.Equal(k.Marshal(), key.Marshal()) {
+                return &ssh.Permissions{Extensions: map[string]string{
+                    "user": u.user,
+                    "pubkey-fp": ssh.FingerprintSHA256(key),
+                }}, nil
             }
+        }
+        return nil, fmt.Errorf("public key rejected for %q", c.User())
+    }
+
+    if r.Password == "" && auth.AuthorizedKeys == "" {
+        log.Warn("SSH Server: Only services with their own authorized keys can connect")
+    }
+
+    private, err := LoadHostKey(auth.HostKey)
+    if err != nil {
+        return nil, fmt.Errorf("ssh server: unable to load host key %s: %s", auth.HostKey, err)
+    }
+
+    fmt.Println("SSH Server: Host key fingerprint ", ssh.FingerprintSHA256(private.PublicKey()))
+    config.AddHostKey(private)
+
+    return config, nil
+}
+
+/*
+ * Start SSH server of router r on addr, blocks while serving.
+ * See Serve.
+ */
+func (s *Server) Listen(r *router.Router, auth Auth, addr string) error {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    return s.Serve(r, auth, ln)
+}
+
+/*
+ * Error if the server is closed or already listening,
+ * otherwise ln, if any, becomes its listener
+ */
+func (s *Server) serving(ln net.Listener) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    switch {
+    case s.closed:
+        return ErrServerClosed
+    case s.ln != nil:
+        return ErrListening
+    }
+    if ln != nil {
+        s.ln = ln
+    }
+    return nil
+}
+
+/*
+ * Serve SSH connections of router r accepted on ln until Close, which
+ * makes Serve return nil. A server serves a single listener.
+ * Forwards are bound by services but originate from r.BindAddr.
+ */
+func (s *Server) Serve(r *router.Router, auth Auth, ln net.Listener) error {
+    config, err := s.prepare(r, auth, ln)
+    if err != nil {
+        return err
+    }
+    return s.accept(r, ln, config)
+}
 
-            b := make([]byte, 4)
-            binary.BigEndian.PutUint32(b, uint32(port))
-            t.Port = uint32(port)
-            req.Reply(true, b)
-        } else {
-            req.Reply(true, nil)
+/*
+ * Like Serve, but returns once the host key is loaded and ln became the
+ * listener of the server. Connections are accepted in the background,
+ * errors of the accept loop are logged.
+ */
+func (s *Server) Start(r *router.Router, auth Auth, ln net.Listener) error {
+    config, err := s.prepare(r, auth, ln)
+    if err != nil {
+        return err
+    }
+
+    go func() {
+        if err := s.accept(r, ln, config); err != nil {
+            log.Error(err)
         }
+    }()
+    return nil
+}
 
+/*
+ * SSH server configuration of router r, ln becomes the listener of the
+ * server. ln is closed on error.
+ */
+func (s *Server) prepare(r *router.Router, auth Auth, ln net.Listener) (*ssh.ServerConfig, error) {
+    if err := s.serving(nil); err != nil {
+        ln.Close()
+        return nil, err
+    }
+
+    config, err := s.config(r, auth)
+    if err != nil {
         ln.Close()
-        delete(rfwds, addr)        
+        return nil, err
     }
+
+    if err := s.serving(ln); err != nil {
+        ln.Close()
+        return nil, err
+    }
+
+    fmt.Println("SSH Server: Listening on ", ln.Addr())
+    return config, nil
 }
 
-func Listen() (error) {
+/*
+ * Accept SSH connections on ln until Close
+ */
+func (s *Server) accept(r *router.Router, ln net.Listener, config *ssh.ServerConfig) error {
+    var delay time.Duration
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            if s.isClosed() {
+                return nil
+            }
 
-    // Handle Authentication
-    config := &ssh.ServerConfig{
-        PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-            log.Debug("C.User()=", c.User(), "Users=", userDB)
-            if u, ok := userDB[c.User()]; ok && string(pass) == "123456789" {
-                return &ssh.Permissions{Extensions: map[string]string{"user": u.user}}, nil
+            if ne, ok := err.(net.Error); ok && ne.Temporary() {
+                if delay == 0 {
+                    delay = minAcceptDelay
+                } else if delay *= 2; delay > maxAcceptDelay {
+                    delay = maxAcceptDelay
+                }
+                log.Debug("SSH Server: Accept error: ", err, " retrying in ", delay)
+                time.Sleep(delay)
+                continue
             }
-            return nil, fmt.Errorf("password rejected for %q", c.User())
-        },
+            return err
+        }
+
+        delay = 0
+        go s.serveConn(r, conn, config)
     }
+}
+
+/*
+ * Address the server listens on, nil until Listen loaded the host key
+ */
+func (s *Server) Addr() net.Addr {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.ln == nil {
+        return nil
+    }
+    return s.ln.Addr()
+}
+
+func (s *Server) isClosed() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.closed
+}
+
+/*
+ * Stop listening and close all SSH connections, their forwards end
+ * with them. Service users are kept.
+ */
+func (s *Server) Close() error {
+    s.mu.Lock()
+    s.closed = true
+    ln := s.ln
+    s.mu.Unlock()
+
+    var err error
+    if ln != nil {
+        err = ln.Close()
+    }
+
+    s.conns.Lock()
+    var closing []ssh.Conn
+    for _, c := range s.conns.m {
+        closing = append(closing, c.conn)
+    }
+    s.conns.Unlock()
 
-    priv, _, err := MakeSSHKeyPair()
+    for _, conn := range closing {
+        conn.Close()
+    }
+    return err
+}
 
-    private, err := ssh.ParsePrivateKey(priv)
+/*
+ * Handshake and dispatch requests and channels of one SSH connection
+ */
+func (s *Server) serveConn(r *router.Router, conn net.Conn, config *ssh.ServerConfig) {
+    sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
     if err != nil {
-        log.Error("Failed to parse private key: ", err)
+        log.Debug("SSH Server: Handshake with ", conn.RemoteAddr(), " failed: ", err)
+        conn.Close()
+        return
     }
 
-    config.AddHostKey(private)
-        
-    easyssh.EnableLogging(os.Stderr)
-    easyssh.HandleChannel(easyssh.SessionRequest, easyssh.SessionHandler())
-	easyssh.HandleChannel(easyssh.DirectForwardRequest, easyssh.DirectPortForwardHandler())
-	easyssh.HandleRequestFunc(easyssh.RemoteForwardRequest, easyssh.GlobalRequestHandlerFunc(TCPIPForwardRequest))
-	easyssh.HandleRequestFunc(easyssh.CancelRemoteForwardRequest, easyssh.GlobalRequestHandlerFunc(TCPIPCancelRequest))
-    
-    // Listen & Accept connections
-    easyssh.ListenAndServe(":22", config, nil)
-    return nil
+    // Tracked before checking for Close, so Close either sees it or it sees Close
+    s.getConnState(sshConn)
+    if s.isClosed() {
+        sshConn.Close()
+    }
+
+    go s.handleRequests(r, reqs, sshConn)
+
+    for newCh := range chans {
+        switch newCh.ChannelType() {
+        case DirectForwardRequest:
+            go directTCPIP(newCh)
+        default:
+            newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+        }
+    }
 }
 
-func AddUser(uname string, m *omap.OMap, ccb Callback, dcb Callback) {
+/*
+ * Global requests of a connection, handled in order so the weight
+ * announced by an exporter applies to the forwards that follow.
+ */
+func (s *Server) handleRequests(r *router.Router, reqs <-chan *ssh.Request, sshConn ssh.Conn) {
+    for req := range reqs {
+        switch req.Type {
+        case RemoteForwardRequest:
+            s.TCPIPForwardRequest(r, req, sshConn)
+        case CancelRemoteForwardRequest:
+            s.TCPIPCancelRequest(req, sshConn)
+        case utils.BackendWeightRequest:
+            s.BackendWeightRequest(req, sshConn)
+        case utils.UDPForwardRequest:
+            s.UDPForwardRequest(r, req, sshConn)
+        default:
+            if req.WantReply {
+                req.Reply(false, nil)
+            }
+        }
+    }
+}
+
+/*
+ * RFC 4254 7.2 "direct-tcpip" channel, a local port forward of the client
+ */
+func directTCPIP(newCh ssh.NewChannel) {
+    p := directForward{}
+    if err := ssh.Unmarshal(newCh.ExtraData(), &p); err != nil {
+        newCh.Reject(ssh.ConnectionFailed, "invalid payload")
+        return
+    }
+
+    conn, err := net.Dial("tcp", net.JoinHostPort(p.Host1, strconv.Itoa(int(p.Port1))))
+    if err != nil {
+        newCh.Reject(ssh.ConnectionFailed, err.Error())
+        return
+    }
+
+    ch, reqs, err := newCh.Accept()
+    if err != nil {
+        conn.Close()
+        return
+    }
+    go ssh.DiscardRequests(reqs)
+
+    utils.CopyReadWriters(conn, ch, func() {
+        ch.Close()
+        conn.Close()
+    })
+}
+
+func (s *Server) AddUser(uname string, m *omap.OMap, ccb Callback, dcb Callback) {
+    s.AddUserKeys(uname, "", m, ccb, dcb)
+}
+
+/*
+ * Add user authenticated with its own authorized_keys file, an empty
+ * keys path falls back to the global authorized keys.
+ * Adding a known user replaces its record, its SSH sessions stay.
+ */
+func (s *Server) AddUserKeys(uname string, keys string, m *omap.OMap, ccb Callback, dcb Callback) {
     u := user{}
     u.user = uname
+    u.keys = keys
     u.m = m
     u.ccb = ccb
     u.dcb = dcb
@@ -268,7 +543,50 @@ func AddUser(uname string, m *omap.OMap, ccb Callback, dcb Callback) {
     log.Debug("Adding User=", u)
     
     // Add user to database
-    userDB[uname] = u
-    
-    log.Debug("Users=", userDB)
-}
\ No newline at end of file
+    s.users.Lock()
+    s.userDB[uname] = u
+    s.users.Unlock()
+}
+
+/*
+ * Remove user, its SSH sessions are closed and new ones are rejected.
+ */
+func (s *Server) RemoveUser(uname string) {
+    log.Debug("Removing User=", uname)
+
+    s.users.Lock()
+    delete(s.userDB, uname)
+    s.users.Unlock()
+
+    s.conns.Lock()
+    var closing []ssh.Conn
+    for _, c := range s.conns.m {
+        if c.conn.User() == uname {
+            closing = append(closing, c.conn)
+        }
+    }
+    s.conns.Unlock()
+
+    for _, conn := range closing {
+        conn.Close()
+    }
+}
+
+/*
+ * Start SSH server of router r on r.ListenAddr() with the Default server
+ */
+func Listen(r *router.Router, auth Auth) error {
+    return Default.Listen(r, auth, r.ListenAddr())
+}
+
+func AddUser(uname string, m *omap.OMap, ccb Callback, dcb Callback) {
+    Default.AddUser(uname, m, ccb, dcb)
+}
+
+func AddUserKeys(uname string, keys string, m *omap.OMap, ccb Callback, dcb Callback) {
+    Default.AddUserKeys(uname, keys, m, ccb, dcb)
+}
+
+func RemoveUser(uname string) {
+    Default.RemoveUser(uname)
+}
@@ -0,0 +1,949 @@
+package server
+
+import (
+    "bufio"
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "github.com/microstacks/stack/endpoint/omap"
+    "github.com/microstacks/stack/endpoint/router"
+    "github.com/microstacks/stack/endpoint/utils"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+    pub, _, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    key, err := ssh.NewPublicKey(pub)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func TestAuthorizedKeysFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "authkeys")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    k1 := newPublicKey(t)
+    k2 := newPublicKey(t)
+    data := append(ssh.MarshalAuthorizedKey(k1), '\n')
+    data = append(data, ssh.MarshalAuthorizedKey(k2)...)
+
+    path := filepath.Join(dir, "authorized_keys")
+    if err := ioutil.WriteFile(path, data, 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    keys, err := authorizedKeys(path, "app.8000")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(keys) != 2 {
+        t.Error(
+            "For", path,
+            "expected", 2,
+            "got", len(keys),
+        )
+    }
+}
+
+func TestAuthorizedKeysDir(t *testing.T) {
+    dir, err := ioutil.TempDir("", "authkeys")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    k := newPublicKey(t)
+    if err := ioutil.WriteFile(filepath.Join(dir, "app.8000"), ssh.MarshalAuthorizedKey(k), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    keys, err := authorizedKeys(dir, "app.8000")
+    if err != nil || len(keys) != 1 {
+        t.Error(
+            "For", "app.8000",
+            "expected", 1,
+            "got", len(keys), err,
+        )
+    }
+
+    // Keys of one service must not be valid for another.
+    keys, err = authorizedKeys(dir, "db.3306")
+    if err == nil {
+        t.Error(
+            "For", "db.3306",
+            "expected", "error",
+            "got", keys,
+        )
+    }
+
+    // UDP services have their own file, not one named "udp"
+    if err := ioutil.WriteFile(filepath.Join(dir, "udp"), ssh.MarshalAuthorizedKey(k), 0600); err != nil {
+        t.Fatal(err)
+    }
+    keys, err = authorizedKeys(dir, "dns.53/udp")
+    if err == nil {
+        t.Error(
+            "For", "dns.53/udp without dns.53.udp",
+            "expected", "error",
+            "got", keys,
+        )
+    }
+
+    if err := ioutil.WriteFile(filepath.Join(dir, "dns.53.udp"), ssh.MarshalAuthorizedKey(k), 0600); err != nil {
+        t.Fatal(err)
+    }
+    keys, err = authorizedKeys(dir, "dns.53/udp")
+    if err != nil || len(keys) != 1 {
+        t.Error(
+            "For", "dns.53/udp",
+            "expected", 1,
+            "got", len(keys), err,
+        )
+    }
+}
+
+func TestLoadHostKeyPersistent(t *testing.T) {
+    dir, err := ioutil.TempDir("", "hostkey")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "keys", "ssh_host_ed25519_key")
+
+    first, err := LoadHostKey(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    second, err := LoadHostKey(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    fp1 := ssh.FingerprintSHA256(first.PublicKey())
+    fp2 := ssh.FingerprintSHA256(second.PublicKey())
+    if fp1 != fp2 {
+        t.Error(
+            "For", path,
+            "expected", fp1,
+            "got", fp2,
+        )
+    }
+
+    if first.PublicKey().Type() != ssh.KeyAlgoED25519 {
+        t.Error(
+            "For", path,
+            "expected", ssh.KeyAlgoED25519,
+            "got", first.PublicKey().Type(),
+        )
+    }
+}
+
+/*
+ * Server listening on a free localhost port, forwarded channels
+ * originate from localhost.
+ */
+func startServer(t *testing.T) *Server {
+    return startRouter(t, &router.Router{BindAddr: "127.0.0.1", Password: "secret"})
+}
+
+func startRouter(t *testing.T, r *router.Router) *Server {
+    dir, err := ioutil.TempDir("", "hostkey")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    s := New()
+    auth := Auth{HostKey: filepath.Join(dir, "ssh_host_ed25519_key")}
+    go func() {
+        if err := s.Listen(r, auth, "127.0.0.1:0"); err != nil {
+            t.Error(err)
+        }
+    }()
+
+    // Listening once the host key is loaded
+    for wait := 0; s.Addr() == nil; wait++ {
+        if wait == 500 {
+            t.Fatal("timeout waiting for server")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    return s
+}
+
+/*
+ * Register service user reporting connect/disconnect events
+ */
+func addTestUser(s *Server, name string) (chan *utils.Host, chan *utils.Host) {
+    connected := make(chan *utils.Host, 100)
+    disconnected := make(chan *utils.Host, 100)
+
+    s.AddUser(name, omap.New(), func(m *omap.OMap, h *utils.Host) {
+        connected <- h
+    }, func(m *omap.OMap, h *utils.Host) {
+        disconnected <- h
+    })
+
+    return connected, disconnected
+}
+
+func dialServer(t *testing.T, s *Server, name string) *ssh.Client {
+    client, err := ssh.Dial("tcp", s.Addr().String(), &ssh.ClientConfig{
+        User:            name,
+        Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return client
+}
+
+func waitHost(t *testing.T, c chan *utils.Host) *utils.Host {
+    select {
+    case h := <-c:
+        return h
+    case <-time.After(5 * time.Second):
+        t.Fatal("timeout waiting for callback")
+    }
+    return nil
+}
+
+func TestForwardCancel(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "cancel.80")
+    client := dialServer(t, s, "cancel.80")
+    defer client.Close()
+
+    // Dynamic port, the reply carries the allocated port
+    rl, err := client.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    h := waitHost(t, connected)
+    _, port, _ := utils.GetHostPort(rl.Addr())
+    if h.LocalPort == 0 || h.LocalPort != uint32(port) {
+        t.Error(
+            "For", "port 0",
+            "expected", port,
+            "got", h.LocalPort,
+        )
+    }
+
+    // Closing the remote listener sends cancel-tcpip-forward
+    rl.Close()
+    if d := waitHost(t, disconnected); d.ID != h.ID {
+        t.Error(
+            "For", "cancel",
+            "expected", h.ID,
+            "got", d.ID,
+        )
+    }
+
+    if conn, err := net.Dial("tcp", (&utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}).String()); err == nil {
+        conn.Close()
+        t.Error(
+            "For", "cancelled forward",
+            "expected", "listener closed",
+            "got", nil,
+        )
+    }
+}
+
+func TestForwardCancelPortZero(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "cancel0.80")
+    client := dialServer(t, s, "cancel0.80")
+    defer client.Close()
+
+    if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    h := waitHost(t, connected)
+
+    ok, _, err := client.SendRequest(CancelRemoteForwardRequest, true, ssh.Marshal(tcpipForward{"127.0.0.1", 0}))
+    if err != nil || !ok {
+        t.Fatal("cancel rejected ", err)
+    }
+
+    if d := waitHost(t, disconnected); d.ID != h.ID {
+        t.Error(
+            "For", "cancel port 0",
+            "expected", h.ID,
+            "got", d.ID,
+        )
+    }
+
+    // Nothing left to cancel
+    ok, _, _ = client.SendRequest(CancelRemoteForwardRequest, true, ssh.Marshal(tcpipForward{"127.0.0.1", 0}))
+    if ok {
+        t.Error(
+            "For", "second cancel",
+            "expected", false,
+            "got", ok,
+        )
+    }
+}
+
+func TestForwardCallbackOrder(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    // Slow connect callback, the forward is cancelled meanwhile
+    calls := make(chan string, 4)
+    s.AddUser("order.80", omap.New(), func(m *omap.OMap, h *utils.Host) {
+        time.Sleep(50 * time.Millisecond)
+        calls <- "connect"
+    }, func(m *omap.OMap, h *utils.Host) {
+        calls <- "disconnect"
+    })
+
+    client := dialServer(t, s, "order.80")
+    defer client.Close()
+
+    rl, err := client.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Registered once the request is answered
+    if len(s.Forwards()) != 1 {
+        t.Error("For", "answered forward", "expected", 1, "got", s.Forwards())
+    }
+    rl.Close()
+
+    for _, expected := range []string{"connect", "disconnect"} {
+        select {
+        case call := <-calls:
+            if call != expected {
+                t.Error("For", "callbacks", "expected", expected, "got", call)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("timeout waiting for", expected)
+        }
+    }
+}
+
+func TestForwardConnectionClose(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "close.80")
+    client := dialServer(t, s, "close.80")
+
+    for i := 0; i < 3; i++ {
+        if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+            t.Fatal(err)
+        }
+        waitHost(t, connected)
+    }
+
+    // All forwards go away with the connection
+    client.Close()
+    for i := 0; i < 3; i++ {
+        waitHost(t, disconnected)
+    }
+}
+
+func TestForwardGoroutineLeak(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "leak.80")
+
+    // Warm up one cycle so lazily started runtime goroutines are counted.
+    cycle := func() {
+        client := dialServer(t, s, "leak.80")
+        for i := 0; i < 2; i++ {
+            rl, err := client.Listen("tcp", "127.0.0.1:0")
+            if err != nil {
+                t.Fatal(err)
+            }
+            waitHost(t, connected)
+
+            // Exercise the accept loop
+            if conn, err := net.Dial("tcp", rl.Addr().String()); err == nil {
+                conn.Close()
+            }
+        }
+        client.Close()
+        for i := 0; i < 2; i++ {
+            waitHost(t, disconnected)
+        }
+    }
+
+    cycle()
+    time.Sleep(100 * time.Millisecond)
+    before := runtime.NumGoroutine()
+
+    for i := 0; i < 50; i++ {
+        cycle()
+    }
+
+    var after int
+    for wait := 0; wait < 50; wait++ {
+        after = runtime.NumGoroutine()
+        if after <= before {
+            break
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    if after > before {
+        buf := make([]byte, 1 << 16)
+        t.Log(string(buf[:runtime.Stack(buf, true)]))
+        t.Error(
+            "For", "50 connect/disconnect cycles",
+            "expected", before,
+            "got", after,
+        )
+    }
+}
+
+func TestDrain(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+    defer s.Resume()
+
+    connected, disconnected := addTestUser(s, "drain.80")
+    client := dialServer(t, s, "drain.80")
+    defer client.Close()
+
+    rl, err := client.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    h := waitHost(t, connected)
+    addr := (&utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}).String()
+
+    // Echo service behind the tunnel
+    go func() {
+        for {
+            conn, err := rl.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                for {
+                    line, err := r.ReadString('\n')
+                    if err != nil {
+                        return
+                    }
+                    conn.Write([]byte(line))
+                }
+            }(conn)
+        }
+    }()
+
+    inflight, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := bufio.NewReader(inflight)
+    inflight.Write([]byte("before\n"))
+    if line, _ := r.ReadString('\n'); line != "before\n" {
+        t.Fatal("no echo before drain ", line)
+    }
+
+    drained := make(chan error, 1)
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        drained <- s.Drain(ctx)
+    }()
+
+    waitHost(t, disconnected)
+
+    // No new connections, no new forwards
+    if conn, err := net.Dial("tcp", addr); err == nil {
+        conn.Close()
+        t.Error(
+            "For", "drained forward",
+            "expected", "listener closed",
+            "got", nil,
+        )
+    }
+    if _, err := client.Listen("tcp", "127.0.0.1:0"); err == nil {
+        t.Error(
+            "For", "forward while draining",
+            "expected", "rejected",
+            "got", nil,
+        )
+    }
+
+    // In-flight connection keeps working
+    inflight.Write([]byte("during\n"))
+    if line, _ := r.ReadString('\n'); line != "during\n" {
+        t.Error(
+            "For", "in-flight connection",
+            "expected", "during",
+            "got", line,
+        )
+    }
+
+    select {
+    case err := <-drained:
+        t.Fatal("drain finished with connection in flight ", err)
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    inflight.Close()
+    select {
+    case err := <-drained:
+        if err != nil {
+            t.Error(
+                "For", "drain",
+                "expected", nil,
+                "got", err,
+            )
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("drain did not finish")
+    }
+
+    // The client connects and forwards again after Resume
+    closed := make(chan error, 1)
+    go func() { closed <- client.Wait() }()
+    select {
+    case <-closed:
+    case <-time.After(5 * time.Second):
+        t.Error(
+            "For", "SSH connection after drain",
+            "expected", "closed",
+            "got", "open",
+        )
+    }
+}
+
+func TestCancelForwardByID(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "admin.80")
+    client := dialServer(t, s, "admin.80")
+    defer client.Close()
+
+    if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    h := waitHost(t, connected)
+
+    found := false
+    for _, f := range s.Forwards() {
+        if f.Host.ID == h.ID && f.User == "admin.80" {
+            found = true
+        }
+    }
+    if !found {
+        t.Error(
+            "For", "Forwards",
+            "expected", h.ID,
+            "got", s.Forwards(),
+        )
+    }
+
+    if !s.CancelForward(h.ID) {
+        t.Fatal("forward not found")
+    }
+    if d := waitHost(t, disconnected); d.ID != h.ID {
+        t.Error(
+            "For", "CancelForward",
+            "expected", h.ID,
+            "got", d.ID,
+        )
+    }
+
+    if s.CancelForward(h.ID) {
+        t.Error(
+            "For", "cancelled forward",
+            "expected", false,
+            "got", true,
+        )
+    }
+}
+
+func TestDisconnectByID(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "kick.80")
+    client := dialServer(t, s, "kick.80")
+    defer client.Close()
+
+    if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    h := waitHost(t, connected)
+
+    if !s.Disconnect(h.ID) {
+        t.Fatal("forward not found")
+    }
+    waitHost(t, disconnected)
+
+    if err := client.Wait(); err == nil {
+        t.Error(
+            "For", "Disconnect",
+            "expected", "connection closed",
+            "got", nil,
+        )
+    }
+}
+
+func TestRemoveUser(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "removed.80")
+    client := dialServer(t, s, "removed.80")
+    defer client.Close()
+
+    if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    waitHost(t, connected)
+
+    s.RemoveUser("removed.80")
+    waitHost(t, disconnected)
+
+    if err := client.Wait(); err == nil {
+        t.Error(
+            "For", "RemoveUser",
+            "expected", "connection closed",
+            "got", nil,
+        )
+    }
+
+    s.users.RLock()
+    _, ok := s.userDB["removed.80"]
+    s.users.RUnlock()
+    if ok {
+        t.Error(
+            "For", "RemoveUser",
+            "expected", "user removed",
+            "got", ok,
+        )
+    }
+}
+
+func TestForwardOrigin(t *testing.T) {
+    for n, bindAddr := range []string{"127.0.0.2", "127.0.0.3"} {
+        s := startRouter(t, &router.Router{BindAddr: bindAddr, Password: "secret"})
+        defer s.Close()
+
+        name := fmt.Sprintf("origin%d.80", n)
+        connected, _ := addTestUser(s, name)
+
+        client := dialServer(t, s, name)
+        defer client.Close()
+
+        rl, err := client.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        h := waitHost(t, connected)
+
+        conn, err := net.Dial("tcp", (&utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}).String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+
+        forwarded, err := rl.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer forwarded.Close()
+
+        host, _, _ := net.SplitHostPort(forwarded.RemoteAddr().String())
+        if host != bindAddr {
+            t.Error(
+                "For", bindAddr,
+                "expected", bindAddr,
+                "got", host,
+            )
+        }
+    }
+}
+
+func TestServersIndependent(t *testing.T) {
+    first := startServer(t)
+    defer first.Close()
+    second := startServer(t)
+    defer second.Close()
+
+    connected, disconnected := addTestUser(first, "app.80")
+    client := dialServer(t, first, "app.80")
+    defer client.Close()
+
+    if _, err := client.Listen("tcp", "127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    h := waitHost(t, connected)
+
+    // Users and forwards of one server are unknown to the other
+    if _, err := ssh.Dial("tcp", second.Addr().String(), &ssh.ClientConfig{
+        User:            "app.80",
+        Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+    }); err == nil {
+        t.Error(
+            "For", "user of the first server",
+            "expected", "rejected by the second",
+            "got", nil,
+        )
+    }
+    if second.CancelForward(h.ID) || len(second.Forwards()) != 0 {
+        t.Error(
+            "For", "forward of the first server",
+            "expected", "unknown to the second",
+            "got", second.Forwards(),
+        )
+    }
+
+    // A server serves one listener
+    if err := first.Listen(&router.Router{}, Auth{}, "127.0.0.1:0"); err != ErrListening {
+        t.Error(
+            "For", "second Listen",
+            "expected", ErrListening,
+            "got", err,
+        )
+    }
+
+    // Close stops listening and ends the connections of that server only
+    addr := first.Addr().String()
+    first.Close()
+    waitHost(t, disconnected)
+
+    if conn, err := net.Dial("tcp", addr); err == nil {
+        conn.Close()
+        t.Error(
+            "For", "closed server",
+            "expected", "not listening",
+            "got", nil,
+        )
+    }
+
+    addTestUser(second, "app.80")
+    other := dialServer(t, second, "app.80")
+    other.Close()
+}
+
+/*
+ * Accept the channel of a UDP flow and echo its datagrams
+ */
+func echoUDP(newCh ssh.NewChannel) {
+    ch, reqs, err := newCh.Accept()
+    if err != nil {
+        return
+    }
+    go ssh.DiscardRequests(reqs)
+    defer ch.Close()
+
+    buf := make([]byte, utils.MaxDatagram)
+    for {
+        b, err := utils.ReadDatagram(ch, buf)
+        if err != nil {
+            return
+        }
+        utils.WriteDatagram(ch, b)
+    }
+}
+
+/*
+ * Send msg on conn and check it comes back
+ */
+func echoDatagram(t *testing.T, conn net.Conn, msg string) {
+    if _, err := conn.Write([]byte(msg)); err != nil {
+        t.Fatal(err)
+    }
+
+    buf := make([]byte, 64)
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    n, err := conn.Read(buf)
+    if err != nil || string(buf[:n]) != msg {
+        t.Error(
+            "For", msg,
+            "expected", msg,
+            "got", string(buf[:n]), err,
+        )
+    }
+}
+
+func TestUDPForward(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, disconnected := addTestUser(s, "dns.53/udp")
+
+    client := dialServer(t, s, "dns.53/udp")
+    defer client.Close()
+
+    // Echo datagrams of every flow
+    chans := client.HandleChannelOpen(utils.ForwardedUDPChannel)
+    go func() {
+        for newCh := range chans {
+            go echoUDP(newCh)
+        }
+    }()
+
+    req := tcpipForward{Host: "127.0.0.1", Port: 0}
+    ok, _, err := client.SendRequest(utils.UDPForwardRequest, true, ssh.Marshal(req))
+    if err != nil || !ok {
+        t.Fatal("udp forward rejected", err)
+    }
+    h := waitHost(t, connected)
+
+    conn, err := net.Dial("udp", (&utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}).String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    for _, msg := range []string{"ping", "pong"} {
+        echoDatagram(t, conn, msg)
+    }
+
+    // The port is released with the SSH connection
+    client.Close()
+    if gone := waitHost(t, disconnected); gone.ID != h.ID {
+        t.Error(
+            "For", "disconnect",
+            "expected", h.ID,
+            "got", gone.ID,
+        )
+    }
+}
+
+func TestUDPFlowIdle(t *testing.T) {
+    old := udpIdleTimeout
+    udpIdleTimeout = 20 * time.Millisecond
+    defer func() { udpIdleTimeout = old }()
+
+    s := startServer(t)
+    defer s.Close()
+
+    connected, _ := addTestUser(s, "dns.53/udp")
+
+    client := dialServer(t, s, "dns.53/udp")
+    defer client.Close()
+
+    chans := client.HandleChannelOpen(utils.ForwardedUDPChannel)
+    go func() {
+        for newCh := range chans {
+            go echoUDP(newCh)
+        }
+    }()
+
+    req := tcpipForward{Host: "127.0.0.1", Port: 0}
+    ok, _, err := client.SendRequest(utils.UDPForwardRequest, true, ssh.Marshal(req))
+    if err != nil || !ok {
+        t.Fatal("udp forward rejected", err)
+    }
+    h := waitHost(t, connected)
+
+    conn, err := net.Dial("udp", (&utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}).String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    // Datagrams arriving as the flow times out go to a new flow
+    for n := 0; n < 50 && !t.Failed(); n++ {
+        echoDatagram(t, conn, fmt.Sprint("ping ", n))
+        time.Sleep(udpIdleTimeout)
+    }
+}
+
+func TestUDPFlowOpening(t *testing.T) {
+    s := startServer(t)
+    defer s.Close()
+
+    connected, _ := addTestUser(s, "dns.53/udp")
+
+    client := dialServer(t, s, "dns.53/udp")
+    defer client.Close()
+
+    req := tcpipForward{Host: "127.0.0.1", Port: 0}
+    ok, _, err := client.SendRequest(utils.UDPForwardRequest, true, ssh.Marshal(req))
+    if err != nil || !ok {
+        t.Fatal("udp forward rejected", err)
+    }
+    h := waitHost(t, connected)
+    addr := (&utils.Endpoint{Host: h.LocalIP, Port: h.LocalPort}).String()
+
+    slow, err := net.Dial("udp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer slow.Close()
+    slowPort := uint32(slow.LocalAddr().(*net.UDPAddr).Port)
+
+    // The channel of the slow client is accepted once released
+    release := make(chan bool)
+    chans := client.HandleChannelOpen(utils.ForwardedUDPChannel)
+    go func() {
+        for newCh := range chans {
+            var p directForward
+            ssh.Unmarshal(newCh.ExtraData(), &p)
+            if p.Port2 != slowPort {
+                go echoUDP(newCh)
+                continue
+            }
+            go func(newCh ssh.NewChannel) {
+                <-release
+                echoUDP(newCh)
+            }(newCh)
+        }
+    }()
+    slow.Write([]byte("queued"))
+
+    // Other clients are served while the first flow opens
+    fast, err := net.Dial("udp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fast.Close()
+    echoDatagram(t, fast, "ping")
+
+    // Datagrams queued meanwhile are delivered once the channel is open
+    close(release)
+    buf := make([]byte, 64)
+    slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+    n, err := slow.Read(buf)
+    if err != nil || string(buf[:n]) != "queued" {
+        t.Error(
+            "For", "queued datagram",
+            "expected", "queued",
+            "got", string(buf[:n]), err,
+        )
+    }
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+
+	"golang.org/x/crypto/ssh"
+    "github.com/microstacks/stack/endpoint/router"
+    "github.com/microstacks/stack/endpoint/utils"
+    "github.com/prometheus/common/log"
+)
+
+/*
+ * Time a UDP flow may stay idle before its channel is closed
+ */
+var udpIdleTimeout = 60 * time.Second
+
+/*
+ * Datagrams queued per flow, more are dropped while the channel opens
+ * or the client falls behind
+ */
+const udpQueue = 64
+
+/*
+ * Flows of a forwarded port by client address. A flow is removed in the
+ * same critical section that closes it, so flows in m are never closed.
+ */
+type udpFlows struct {
+    sync.Mutex
+    m map[string]*udpFlow
+}
+
+/*
+ * Datagrams of one client address, passed to the channel of the flow
+ * by its own goroutine so the forwarded port is never blocked
+ */
+type udpFlow struct {
+    flows  *udpFlows
+    key    string
+    queue  chan []byte
+    closed chan struct{}
+    timer  *time.Timer
+    once   sync.Once
+    done   func()
+}
+
+func (fl *udpFlow) close() {
+    fl.once.Do(func() {
+        fl.flows.Lock()
+        close(fl.closed)
+        if fl.flows.m[fl.key] == fl {
+            delete(fl.flows.m, fl.key)
+        }
+        fl.flows.Unlock()
+        fl.done()
+    })
+}
+
+// UDPForwardRequest binds a UDP port for the client, see utils.UDPForwardRequest
+func (s *Server) UDPForwardRequest(r *router.Router, req *ssh.Request, sshConn ssh.Conn) {
+    t := tcpipForward{}
+    if err := ssh.Unmarshal(req.Payload, &t); err != nil {
+        log.Debug("Invalid udp-forward payload: ", err)
+        req.Reply(false, nil)
+        return
+    }
+    addr := net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port)))
+
+    u, ok := s.forwardUser(sshConn, addr)
+    if !ok {
+        req.Reply(false, nil)
+        return
+    }
+
+    pc, err := net.ListenPacket("udp", addr)
+    if err != nil {
+        log.Debug("Unable to bind udp address: ", addr)
+        req.Reply(false, nil)
+        return
+    }
+    port := uint32(pc.LocalAddr().(*net.UDPAddr).Port)
+
+    fmt.Println("SSH Server: Remote UDP Forward request for ", pc.LocalAddr().String(),
+                " from ", sshConn.RemoteAddr().String())
+
+    c := s.getConnState(sshConn)
+
+    h := &utils.Host{}
+    h.ID = utils.HostID(sshConn.RemoteAddr(), sshConn.SessionID(), port) + "/udp"
+    h.LocalIP = t.Host
+    h.LocalPort = port
+    tcpAddr, _ := sshConn.RemoteAddr().(*net.TCPAddr)
+    h.RemoteIP = tcpAddr.IP.String()
+    h.RemotePort = port
+
+    f := &forward{
+        addr:   addr + "/udp",
+        key:    net.JoinHostPort(t.Host, strconv.Itoa(int(port))) + "/udp",
+        pc:     pc,
+        host:   h,
+        u:      u,
+        c:      c,
+        origin: r.BindAddr,
+    }
+    f.ctx, f.cancel = context.WithCancel(c.ctx)
+
+    if !c.addForward(f) {
+        pc.Close()
+        req.Reply(false, nil)
+        return
+    }
+    replyForward(req, t.Port, port)
+    go f.serveUDP()
+}
+
+/*
+ * Read datagrams until the forward is cancelled and pass them to the flow
+ * of their source address. Flows end with the forward.
+ */
+func (f *forward) serveUDP() {
+    flows := &udpFlows{m: make(map[string]*udpFlow)}
+
+    defer func() {
+        flows.Lock()
+        all := flows.m
+        flows.m = make(map[string]*udpFlow)
+        flows.Unlock()
+
+        for _, fl := range all {
+            fl.close()
+        }
+    }()
+
+    buf := make([]byte, utils.MaxDatagram)
+    for {
+        n, addr, err := f.pc.ReadFrom(buf)
+        if err != nil {
+            if f.ctx.Err() == nil {
+                log.Debug("Read failed on ", f.key, ": ", err)
+                if f.c.removeForward(f) {
+                    f.stop()
+                }
+            }
+            return
+        }
+
+        // Queued while the flow cannot close, a closed flow is replaced
+        key := addr.String()
+        flows.Lock()
+        fl := flows.m[key]
+        if fl == nil {
+            fl = f.newFlow(flows, key)
+            flows.m[key] = fl
+            go f.runFlow(fl, addr)
+        }
+
+        fl.timer.Reset(udpIdleTimeout)
+        select {
+        case fl.queue <- append([]byte(nil), buf[:n]...):
+        default:
+            log.Debug("Dropped datagram of ", addr, " on ", f.key)
+        }
+        flows.Unlock()
+    }
+}
+
+/*
+ * New flow, its channel is opened by runFlow in the background.
+ * Datagrams queue meanwhile, if the channel fails to open the flow ends
+ * and the next datagram of the client opens a new one.
+ */
+func (f *forward) newFlow(flows *udpFlows, key string) *udpFlow {
+    f.c.s.active.Add(1)
+    fl := &udpFlow{
+        flows:  flows,
+        key:    key,
+        queue:  make(chan []byte, udpQueue),
+        closed: make(chan struct{}),
+        done:   f.c.s.active.Done,
+    }
+    fl.timer = time.AfterFunc(udpIdleTimeout, fl.close)
+    return fl
+}
+
+/*
+ * Open the channel of flow fl from addr and pass datagrams both ways
+ * until the flow is closed, replies are sent back to addr.
+ */
+func (f *forward) runFlow(fl *udpFlow, addr net.Addr) {
+    defer fl.close()
+
+    src := addr.(*net.UDPAddr)
+    p := directForward{
+        Host1: f.host.LocalIP,
+        Port1: f.host.LocalPort,
+        Host2: f.origin,
+        Port2: uint32(src.Port),
+    }
+
+    ch, reqs, err := f.c.conn.OpenChannel(utils.ForwardedUDPChannel, ssh.Marshal(p))
+    if err != nil {
+        log.Debug("Open forwarded udp channel: ", err.Error())
+        return
+    }
+    defer ch.Close()
+    go ssh.DiscardRequests(reqs)
+
+    log.Debug("SSH Server: New udp flow from ", addr, " on ", f.key)
+
+    go func() {
+        defer fl.close()
+
+        buf := make([]byte, utils.MaxDatagram)
+        for {
+            b, err := utils.ReadDatagram(ch, buf)
+            if err != nil {
+                return
+            }
+            fl.timer.Reset(udpIdleTimeout)
+            if _, err := f.pc.WriteTo(b, addr); err != nil {
+                log.Debug("Reply to ", addr, " failed: ", err)
+                return
+            }
+        }
+    }()
+
+    for {
+        select {
+        case b := <-fl.queue:
+            if err := utils.WriteDatagram(ch, b); err != nil {
+                log.Debug("Forwarded udp channel closed: ", err)
+                return
+            }
+        case <-fl.closed:
+            return
+        }
+    }
+}
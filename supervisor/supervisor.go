@@ -0,0 +1,380 @@
+package supervisor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/microstacks/stack/endpoint/events"
+)
+
+/*
+ * Supervision of the processes run by the router.
+ * Every process leads its own process group, the whole group is killed
+ * when the process is stopped. Exited processes are started again as
+ * their restart policy says, after a delay doubling on every restart.
+ * A process running longer than the maximum delay starts over with the
+ * minimum one.
+ */
+
+/*
+ * Restart policies
+ */
+const (
+	Always    = "always"     // restart whenever the process exits
+	OnFailure = "on-failure" // restart unless the process exits 0
+	Never     = "never"      // leave the process stopped
+)
+
+/*
+ * Default delays before a restart
+ */
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+/*
+ * Check restart policy, empty is Never
+ */
+func CheckPolicy(policy string) error {
+	switch policy {
+	case "", Always, OnFailure, Never:
+		return nil
+	}
+	return fmt.Errorf("invalid restart policy %q, expected always, on-failure or never", policy)
+}
+
+/*
+ * Returned by Run once Stop was called
+ */
+var ErrStopped = errors.New("processes stopped")
+
+/*
+ * Supervised process
+ */
+type Process struct {
+	Name    string   // prefix of the output lines, may be empty
+	Command []string // command and arguments
+	Restart string   // restart policy, Never if empty
+	Env     []string // environment, the one of the router if nil
+}
+
+/*
+ * Restart after exit code
+ */
+func (p Process) restarts(code int) bool {
+	switch p.Restart {
+	case Always:
+		return true
+	case OnFailure:
+		return code != 0
+	}
+	return false
+}
+
+/*
+ * Supervisor settings
+ */
+type Supervisor struct {
+	Processes  []Process
+	MinBackoff time.Duration // delay before the first restart
+	MaxBackoff time.Duration // delays double up to this one
+
+	// Called with the context of Run when a process started and when
+	// it exited, not when it is killed because ctx is done or it is
+	// stopped.
+	Up   func(ctx context.Context, p Process, pid int)
+	Down func(ctx context.Context, p Process, pid int, code int)
+
+	once     sync.Once
+	restarts []chan bool
+	stopped  chan struct{}
+
+	mu      sync.Mutex
+	running map[int]chan struct{} // closed when the process exited
+}
+
+func (s *Supervisor) init() {
+	s.once.Do(func() {
+		if s.MinBackoff <= 0 {
+			s.MinBackoff = DefaultMinBackoff
+		}
+		if s.MaxBackoff < s.MinBackoff {
+			s.MaxBackoff = DefaultMaxBackoff
+		}
+
+		s.restarts = make([]chan bool, len(s.Processes))
+		for n := range s.restarts {
+			s.restarts[n] = make(chan bool, 1)
+		}
+		s.stopped = make(chan struct{})
+		s.running = make(map[int]chan struct{})
+	})
+}
+
+/*
+ * Run the processes until none is left to restart, ctx is done or
+ * Stop is called. Returns the first non-zero exit code of the processes,
+ * 0 if all exited 0, ctx.Err() if ctx is done and ErrStopped if stopped.
+ */
+func (s *Supervisor) Run(ctx context.Context) (int, error) {
+	s.init()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := 0
+
+	for n := range s.Processes {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			code := s.supervise(ctx, n)
+
+			mu.Lock()
+			if result == 0 {
+				result = code
+			}
+			mu.Unlock()
+		}(n)
+	}
+
+	wg.Wait()
+	if s.isStopped() {
+		return result, ErrStopped
+	}
+	return result, ctx.Err()
+}
+
+/*
+ * Stop restarting the processes and send sig to their process groups.
+ * Waits for the processes to exit, those still running when ctx is done
+ * are killed.
+ */
+func (s *Supervisor) Stop(ctx context.Context, sig syscall.Signal) error {
+	s.init()
+
+	s.mu.Lock()
+	if !s.isStopped() {
+		close(s.stopped)
+	}
+	running := make(map[int]chan struct{}, len(s.running))
+	for pid, exited := range s.running {
+		log.Debug("Stopping process ", pid, " with ", sig)
+		syscall.Kill(-pid, sig)
+		running[pid] = exited
+	}
+	s.mu.Unlock()
+
+	var err error
+	for pid, exited := range running {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			log.Debug("Killing process ", pid)
+			syscall.Kill(-pid, syscall.SIGKILL)
+			<-exited
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+func (s *Supervisor) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Kill all running processes and start them again without delay,
+ * regardless of their restart policy. Processes waiting for a restart
+ * start right away.
+ */
+func (s *Supervisor) Restart() {
+	s.init()
+
+	for _, c := range s.restarts {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+}
+
+/*
+ * Run process n until its policy stops restarting it, ctx is done or
+ * the supervisor is stopped
+ */
+func (s *Supervisor) supervise(ctx context.Context, n int) int {
+	p := s.Processes[n]
+	backoff := s.MinBackoff
+
+	for {
+		started := time.Now()
+		code, restarted := s.run(ctx, n)
+		if ctx.Err() != nil || s.isStopped() {
+			return code
+		}
+		if restarted {
+			backoff = s.MinBackoff
+			continue
+		}
+		if !p.restarts(code) {
+			log.Debug("Process ", p.Command[0], " stopped, exit status ", code)
+			return code
+		}
+
+		// Ran long enough to count as healthy
+		if time.Since(started) > s.MaxBackoff {
+			backoff = s.MinBackoff
+		}
+
+		log.Debug("Restarting ", p.Command[0], " in ", backoff)
+		events.Publish(events.Event{Type: events.ChildBackoff, Process: p.Name, Message: backoff.String()})
+
+		select {
+		case <-ctx.Done():
+			return code
+		case <-s.stopped:
+			return code
+		case <-s.restarts[n]:
+			backoff = s.MinBackoff
+			continue
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+/*
+ * Run process n once, restarted is set if it was killed by Restart
+ */
+func (s *Supervisor) run(ctx context.Context, n int) (code int, restarted bool) {
+	p := s.Processes[n]
+
+	log.Debug("Executing ", p.Command)
+	proc := exec.Command(p.Command[0], p.Command[1:]...)
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	proc.Env = p.Env
+
+	prefix := ""
+	if p.Name != "" {
+		prefix = p.Name + " "
+	}
+
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		log.Error(err)
+		return 1, false
+	}
+	stderr, err := proc.StderrPipe()
+	if err != nil {
+		log.Error(err)
+		return 1, false
+	}
+
+	// Not started once stopped, Stop waits for every started process
+	s.mu.Lock()
+	if s.isStopped() {
+		s.mu.Unlock()
+		return 0, false
+	}
+	if err := proc.Start(); err != nil {
+		s.mu.Unlock()
+		log.Error(err)
+		// Like a shell, the command cannot be run
+		return 127, false
+	}
+	pid := proc.Process.Pid
+	done := make(chan struct{})
+	s.running[pid] = done
+	s.mu.Unlock()
+
+	go stream(prefix+"stdout:", stdout)
+	go stream(prefix+"stderr:", stderr)
+
+	events.Publish(events.Event{Type: events.ChildStarted, Pid: pid, Process: p.Name, Message: p.Command[0]})
+	if s.Up != nil {
+		s.Up(ctx, p, pid)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- proc.Wait() }()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		log.Debug("Terminating process ", pid)
+		syscall.Kill(-pid, syscall.SIGKILL)
+		err = <-exited
+	case <-s.restarts[n]:
+		log.Debug("Restarting process ", pid)
+		events.Publish(events.Event{Type: events.ChildRestarted, Pid: pid, Process: p.Name})
+		syscall.Kill(-pid, syscall.SIGKILL)
+		err = <-exited
+		restarted = true
+	}
+
+	s.mu.Lock()
+	delete(s.running, pid)
+	close(done)
+	s.mu.Unlock()
+
+	fmt.Println(prefix + "Process Terminated")
+	code = exitCode(err)
+	msg := "exit status 0"
+	if err != nil {
+		msg = err.Error()
+	}
+	events.Publish(events.Event{Type: events.ChildExited, Pid: pid, Process: p.Name, Message: msg})
+
+	if ctx.Err() == nil && !s.isStopped() && s.Down != nil {
+		s.Down(ctx, p, pid, code)
+	}
+	return code, restarted
+}
+
+/*
+ * Print lines of out with prefix
+ */
+func stream(prefix string, out io.Reader) {
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		fmt.Println(prefix, scanner.Text())
+	}
+}
+
+/*
+ * Exit code of a process as reported by a shell,
+ * 128 plus the signal number if it was killed.
+ */
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
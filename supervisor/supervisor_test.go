@@ -0,0 +1,322 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/events"
+)
+
+/*
+ * Shell script failing until it ran n times, counting runs in dir
+ */
+func flaky(dir string, n int) []string {
+	script := `echo >> "$0.runs"; test $(wc -l < "$0.runs") -ge ` + fmt.Sprint(n)
+	return []string{"sh", "-c", script, filepath.Join(dir, "flaky")}
+}
+
+func runs(t *testing.T, dir string) int {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "flaky.runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(data)
+}
+
+func TestPolicies(t *testing.T) {
+	for policy, expected := range map[string]struct {
+		code int
+		runs int
+	}{
+		Never:     {1, 1},
+		OnFailure: {0, 3},
+	} {
+		dir, err := ioutil.TempDir("", "supervisor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := &Supervisor{
+			Processes:  []Process{{Command: flaky(dir, 3), Restart: policy}},
+			MinBackoff: time.Millisecond,
+			MaxBackoff: 10 * time.Millisecond,
+		}
+
+		code, err := s.Run(context.Background())
+		if err != nil || code != expected.code || runs(t, dir) != expected.runs {
+			t.Error(
+				"For", policy,
+				"expected", expected,
+				"got", code, runs(t, dir), err,
+			)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	s := &Supervisor{Processes: []Process{
+		{Name: "ok", Command: []string{"true"}},
+		{Name: "failed", Command: []string{"sh", "-c", "exit 3"}},
+		{Name: "killed", Command: []string{"sh", "-c", "sleep 0.1; kill -9 $$"}},
+		{Name: "missing", Command: []string{"/nonexistent"}},
+	}}
+
+	// Processes failing to start are never up or down
+	expected := map[string]int{"ok": 0, "failed": 3, "killed": 137}
+	var mu sync.Mutex
+	got := make(map[string]int)
+	s.Down = func(ctx context.Context, p Process, pid int, code int) {
+		mu.Lock()
+		got[p.Name] = code
+		mu.Unlock()
+	}
+
+	code, err := s.Run(context.Background())
+	if err != nil || code == 0 {
+		t.Error(
+			"For", "Run",
+			"expected", "failure",
+			"got", code, err,
+		)
+	}
+
+	for name, code := range expected {
+		if got[name] != code {
+			t.Error(
+				"For", name,
+				"expected", code,
+				"got", got[name],
+			)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	s := &Supervisor{Processes: []Process{{Command: []string{"sleep", "60"}, Restart: Never}}}
+
+	pids := make(chan int, 2)
+	s.Up = func(ctx context.Context, p Process, pid int) {
+		pids <- pid
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.Run(ctx)
+		result <- err
+	}()
+
+	first := <-pids
+	s.Restart()
+
+	// Started again regardless of the policy
+	select {
+	case second := <-pids:
+		if second == first {
+			t.Error("For", "restart", "expected", "new pid", "got", second)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for restart")
+	}
+
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Error(
+			"For", "cancelled Run",
+			"expected", context.Canceled,
+			"got", err,
+		)
+	}
+}
+
+func TestAlways(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Supervisor{
+		Processes:  []Process{{Command: flaky(dir, 3), Restart: Always}},
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Started again after exiting 0 on the third run
+	started := make(chan bool, 8)
+	s.Up = func(ctx context.Context, p Process, pid int) {
+		started <- true
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.Run(ctx)
+		result <- err
+	}()
+
+	for n := 0; n < 4; n++ {
+		select {
+		case <-started:
+		case err := <-result:
+			t.Fatal("For", Always, "expected", "restarts", "got", err, runs(t, dir))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for restart")
+		}
+	}
+
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Error(
+			"For", "cancelled Run",
+			"expected", context.Canceled,
+			"got", err,
+		)
+	}
+}
+
+func TestStop(t *testing.T) {
+	s := &Supervisor{
+		Processes: []Process{
+			{Name: "term", Command: []string{"sh", "-c", `trap "exit 3" TERM; while :; do sleep 0.1; done`}, Restart: Always},
+			{Name: "ignore", Command: []string{"sh", "-c", `trap "" TERM; while :; do sleep 0.1; done`}, Restart: Always},
+		},
+		MinBackoff: time.Millisecond,
+	}
+
+	var mu sync.Mutex
+	up := 0
+	started := make(chan bool, 4)
+	s.Up = func(ctx context.Context, p Process, pid int) {
+		mu.Lock()
+		up++
+		mu.Unlock()
+		started <- true
+	}
+	s.Down = func(ctx context.Context, p Process, pid int, code int) {
+		t.Error("For", p.Name, "expected", "no Down", "got", code)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.Run(context.Background())
+		result <- err
+	}()
+	for n := 0; n < 2; n++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for start")
+		}
+	}
+
+	// The process ignoring the signal is killed once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx, syscall.SIGTERM); err != context.DeadlineExceeded {
+		t.Error("For", "Stop", "expected", context.DeadlineExceeded, "got", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != ErrStopped {
+			t.Error("For", "stopped Run", "expected", ErrStopped, "got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Run")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if up != 2 {
+		t.Error("For", "stopped processes", "expected", 2, "starts", "got", up)
+	}
+}
+
+/*
+ * First n delays before restarting the process named name
+ */
+func backoffs(t *testing.T, s *Supervisor, name string, n int) []string {
+	c, unsubscribe := events.Subscribe(16)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.Run(ctx)
+		result <- err
+	}()
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	var delays []string
+	for len(delays) < n {
+		select {
+		case ev := <-c:
+			if ev.Type == events.ChildBackoff && ev.Process == name {
+				delays = append(delays, ev.Message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", events.ChildBackoff, "got", delays)
+		}
+	}
+	return delays
+}
+
+func TestBackoff(t *testing.T) {
+	s := &Supervisor{
+		Processes:  []Process{{Name: "backoff", Command: []string{"false"}, Restart: OnFailure}},
+		MinBackoff: 25 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	}
+
+	// Doubling up to MaxBackoff
+	expected := "[25ms 50ms 100ms 100ms]"
+	if got := fmt.Sprint(backoffs(t, s, "backoff", 4)); got != expected {
+		t.Error(
+			"For", "failing process",
+			"expected", expected,
+			"got", got,
+		)
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Fails right away three times, then after running longer than MaxBackoff
+	script := `echo >> "$0.runs"; test $(wc -l < "$0.runs") -ge 4 && sleep 1; exit 1`
+	s := &Supervisor{
+		Processes: []Process{{
+			Name:    "reset",
+			Command: []string{"sh", "-c", script, filepath.Join(dir, "flaky")},
+			Restart: OnFailure,
+		}},
+		MinBackoff: 50 * time.Millisecond,
+		MaxBackoff: 200 * time.Millisecond,
+	}
+
+	expected := "[50ms 100ms 200ms 50ms]"
+	if got := fmt.Sprint(backoffs(t, s, "reset", 4)); got != expected {
+		t.Error(
+			"For", "process running longer than MaxBackoff",
+			"expected", expected,
+			"got", got,
+		)
+	}
+}
@@ -0,0 +1,286 @@
+package trafficrouter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/dns"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/opt/export"
+	"github.com/microstacks/stack/endpoint/opt/import"
+	"github.com/microstacks/stack/endpoint/router"
+	"github.com/microstacks/stack/endpoint/server"
+)
+
+/*
+ * Embeddable traffic router, the library counterpart of the endpoint command.
+ *
+ *   r, err := trafficrouter.New(trafficrouter.Config{Exports: []string{"app:80@lb"}})
+ *   err = r.Start(ctx)
+ *   for e := range r.Events() { ... }
+ *
+ * Every Router has its own SSH server, clients, imports, exports and
+ * events, so several Routers may run in one process on different
+ * SSH addresses. Hook scripts of the endpoint command do not run,
+ * Events replaces them.
+ */
+
+/*
+ * Router settings
+ */
+type Config struct {
+	Instance     int    // selects the loopback bind address, see dns.GenerateIP
+	IPv6         bool   // route the IPv6 loopback prefix on Start, see dns.RouteLoopback6
+	Password     string // shared password, empty disables password authentication
+	Interval     int    // seconds between checks of wildcard exports, default 10
+	SSHAddr      string // address the SSH server listens on, default ":22"
+	SSHPort      uint32 // SSH port of remote routers, default 22
+	Debug        bool
+	DrainTimeout time.Duration // time in-flight connections get to finish on Close, default 30s
+	EventBuffer  int           // events buffered for Events, default 64
+
+	Server server.Auth // authentication of imported services, HostKey defaults to server.DefaultHostKey
+	Client client.Auth // authentication of exports with remote routers
+
+	Imports []string // --import options
+	Exports []string // --export options
+}
+
+/*
+ * Traffic router
+ */
+type Router struct {
+	mu      sync.Mutex
+	cfg     Config
+	rt      *router.Router
+	imports []string
+	exports []string
+	started bool
+	closed  bool
+
+	server   *server.Server
+	importer *Import.Importer
+	exporter *Export.Exporter
+
+	events      <-chan events.Event
+	unsubscribe func()
+}
+
+/*
+ * Errors
+ */
+var (
+	ErrStarted = errors.New("trafficrouter: already started")
+	ErrClosed  = errors.New("trafficrouter: closed")
+)
+
+/*
+ * Validate options and create a router, nothing is started yet.
+ * Option errors are *utils.OptionError.
+ */
+func New(cfg Config) (*Router, error) {
+	if errs := Import.Validate(cfg.Imports); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if errs := Export.Validate(cfg.Exports); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+	if cfg.EventBuffer <= 0 {
+		cfg.EventBuffer = 64
+	}
+	if cfg.Server.HostKey == "" {
+		cfg.Server.HostKey = server.DefaultHostKey
+	}
+
+	bus := events.NewBus()
+	srv := server.New()
+	r := &Router{
+		cfg: cfg,
+		rt: &router.Router{
+			BindAddr: dns.GenerateIP(uint32(cfg.Instance)).String(),
+			Password: cfg.Password,
+			Interval: cfg.Interval,
+			Debug:    cfg.Debug,
+			SSHAddr:  cfg.SSHAddr,
+			SSHPort:  cfg.SSHPort,
+			Events:   bus,
+		},
+		imports:  append([]string(nil), cfg.Imports...),
+		exports:  append([]string(nil), cfg.Exports...),
+		server:   srv,
+		importer: Import.New(srv),
+		exporter: Export.New(client.New()),
+	}
+
+	if cfg.IPv6 {
+		r.rt.BindAddr6 = dns.GenerateIP6(uint32(cfg.Instance)).String()
+	}
+
+	// Subscribe right away so no event of Start is missed
+	r.events, r.unsubscribe = bus.Subscribe(cfg.EventBuffer)
+	return r, nil
+}
+
+/*
+ * Loopback address the services of this router bind to
+ */
+func (r *Router) BindAddr() string {
+	return r.rt.BindAddr
+}
+
+/*
+ * IPv6 loopback address the services of this router bind to,
+ * empty unless Config.IPv6 is set
+ */
+func (r *Router) BindAddr6() string {
+	return r.rt.BindAddr6
+}
+
+/*
+ * Address the SSH server listens on, nil until Start
+ */
+func (r *Router) SSHAddr() net.Addr {
+	return r.importer.Addr()
+}
+
+/*
+ * Connection events, the channel is closed by Close.
+ * Events are dropped while the buffer is full.
+ */
+func (r *Router) Events() <-chan events.Event {
+	return r.events
+}
+
+/*
+ * Start the SSH server, imports and exports.
+ * The router is closed when ctx is done.
+ */
+func (r *Router) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	if r.started {
+		return ErrStarted
+	}
+
+	if r.cfg.IPv6 {
+		if err := dns.RouteLoopback6(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.exporter.Process(r.rt, r.cfg.Client, r.exports); err != nil {
+		return err
+	}
+	if err := r.importer.Process(r.rt, r.cfg.Server, r.imports, nil); err != nil {
+		r.exporter.Reload(r.rt, r.cfg.Client, nil)
+		r.exporter.Cleanup()
+		return err
+	}
+	r.started = true
+
+	go func() {
+		<-ctx.Done()
+		r.Close()
+	}()
+
+	return nil
+}
+
+/*
+ * Add an import, registered right away if the router is started.
+ */
+func (r *Router) Import(spec string) error {
+	if errs := Import.Validate([]string{spec}); len(errs) > 0 {
+		return errs[0]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+
+	r.imports = append(r.imports, spec)
+	if !r.started {
+		return nil
+	}
+	return r.importer.Reload(r.imports)
+}
+
+/*
+ * Add an export, connected right away if the router is started.
+ */
+func (r *Router) Export(spec string) error {
+	if errs := Export.Validate([]string{spec}); len(errs) > 0 {
+		return errs[0]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+
+	r.exports = append(r.exports, spec)
+	if !r.started {
+		return nil
+	}
+	return r.exporter.Reload(r.rt, r.cfg.Client, r.exports)
+}
+
+/*
+ * Drain and stop imports and exports, stop the SSH server, then close
+ * the event channel. In-flight connections get DrainTimeout to finish.
+ * Closing twice is a no-op.
+ */
+func (r *Router) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	var err error
+	if r.started {
+		ctx, cancel := context.WithTimeout(context.Background(), r.cfg.DrainTimeout)
+		defer cancel()
+
+		errs := make(chan error, 2)
+		go func() { errs <- r.importer.Drain(ctx) }()
+		go func() { errs <- r.exporter.Drain(ctx) }()
+		for n := 0; n < 2; n++ {
+			if e := <-errs; e != nil {
+				err = e
+			}
+		}
+
+		// Remove service users and their sessions
+		r.importer.Reload(nil)
+		r.exporter.Reload(r.rt, r.cfg.Client, nil)
+		r.exporter.Cleanup()
+		r.importer.Cleanup()
+	}
+	r.server.Close()
+
+	r.unsubscribe()
+	return err
+}
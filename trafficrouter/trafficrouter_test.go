@@ -0,0 +1,369 @@
+package trafficrouter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"github.com/microstacks/stack/endpoint/client"
+	"github.com/microstacks/stack/endpoint/events"
+	"github.com/microstacks/stack/endpoint/server"
+	"github.com/microstacks/stack/endpoint/utils"
+)
+
+func TestNew(t *testing.T) {
+	r, err := New(Config{Instance: 2, Imports: []string{"db:3306"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.BindAddr() != "127.0.0.2" {
+		t.Error(
+			"For", "instance 2",
+			"expected", "127.0.0.2",
+			"got", r.BindAddr(),
+		)
+	}
+
+	if r.cfg.Interval != 10 || r.cfg.EventBuffer != 64 || r.cfg.Server.HostKey != server.DefaultHostKey {
+		t.Error(
+			"For", "defaults",
+			"expected", "interval 10, event buffer 64, default host key",
+			"got", r.cfg,
+		)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	if _, err := New(Config{Exports: []string{"web:80"}}); err == nil {
+		t.Error(
+			"For", "web:80",
+			"expected", "error",
+			"got", err,
+		)
+	}
+
+	r, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = r.Import("db:99999")
+	if e, ok := err.(*utils.OptionError); !ok || e.Field != "port" {
+		t.Error(
+			"For", "db:99999",
+			"expected", "port error",
+			"got", err,
+		)
+	}
+
+	if err := r.Import("db:3306"); err != nil || len(r.imports) != 1 {
+		t.Error(
+			"For", "db:3306",
+			"expected", "import added",
+			"got", err, r.imports,
+		)
+	}
+}
+
+func TestClose(t *testing.T) {
+	r, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	if _, ok := <-r.Events(); ok {
+		t.Error(
+			"For", "events after Close",
+			"expected", "closed channel",
+			"got", ok,
+		)
+	}
+
+	if err := r.Export("web:80@lb"); err != ErrClosed {
+		t.Error(
+			"For", "Export after Close",
+			"expected", ErrClosed,
+			"got", err,
+		)
+	}
+}
+
+/*
+ * Wait for an event of type typ for service on c
+ */
+func waitEvent(t *testing.T, c <-chan events.Event, typ string, service string) events.Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-c:
+			if e.Type == typ && e.Service == service {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for", typ, service)
+		}
+	}
+}
+
+/*
+ * Echo service of the exporting router, bound to its loopback address
+ */
+func echoService(t *testing.T) net.Listener {
+	service, err := net.Listen("tcp", "127.0.0.11:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}(conn)
+		}
+	}()
+	return service
+}
+
+/*
+ * Router a importing app:port exported by router b, both on
+ * SSH servers of their own
+ */
+func startRouters(t *testing.T, ctx context.Context, dir string, port int) (*Router, *Router) {
+	// Router importing the service
+	a, err := New(Config{
+		Instance: 10,
+		Password: "secret",
+		SSHAddr:  "127.0.0.1:0",
+		Server:   server.Auth{HostKey: filepath.Join(dir, "a_host_key")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Import(fmt.Sprintf("app:%d", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Host key of a generated on Start, pinned by b
+	key, err := server.LoadHostKey(filepath.Join(dir, "a_host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Second router of the process, its SSH server listens elsewhere
+	b, err := New(Config{
+		Instance: 11,
+		Password: "secret",
+		Interval: 1,
+		SSHAddr:  "127.0.0.1:0",
+		SSHPort:  uint32(a.SSHAddr().(*net.TCPAddr).Port),
+		Server:   server.Auth{HostKey: filepath.Join(dir, "b_host_key")},
+		Client:   client.Auth{Fingerprints: []string{ssh.FingerprintSHA256(key.PublicKey())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Export(fmt.Sprintf("app:%d@127.0.0.1:0", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b
+}
+
+/*
+ * Send a line through the forward of backend h
+ */
+func echo(h *utils.Host) (string, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(h.LocalIP, fmt.Sprint(h.LocalPort)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping\n"))
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestRouters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trafficrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	service := echoService(t)
+	defer service.Close()
+	port := service.Addr().(*net.TCPAddr).Port
+	user := fmt.Sprintf("app.%d", port)
+
+	a, b := startRouters(t, ctx, dir, port)
+	defer a.Close()
+	defer b.Close()
+
+	waitEvent(t, b.Events(), events.ExportConnected, user)
+	h := waitEvent(t, a.Events(), events.BackendConnected, user).Host
+
+	// Connections to the forward reach the service through both routers
+	if reply, err := echo(h); err != nil || reply != "ping\n" {
+		t.Error(
+			"For", "forwarded connection",
+			"expected", "ping",
+			"got", reply, err,
+		)
+	}
+
+	// The SSH server stops with its router
+	addr := a.SSHAddr().String()
+	a.Close()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error(
+			"For", "closed router",
+			"expected", "SSH server stopped",
+			"got", addr,
+		)
+	}
+}
+
+func TestDrainResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trafficrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	service := echoService(t)
+	defer service.Close()
+	port := service.Addr().(*net.TCPAddr).Port
+	user := fmt.Sprintf("app.%d", port)
+
+	a, b := startRouters(t, ctx, dir, port)
+	defer a.Close()
+	defer b.Close()
+
+	waitEvent(t, b.Events(), events.ExportConnected, user)
+	waitEvent(t, a.Events(), events.BackendConnected, user)
+
+	// Reboot of the importing router as on SIGUSR2
+	drain, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	if err := a.importer.Drain(drain); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, a.Events(), events.BackendDisconnected, user)
+
+	a.importer.Cleanup()
+	if err := a.importer.Process(a.rt, a.cfg.Server, a.imports, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exporter reconnects and forwards again, once its end of the
+	// forward accepts connections
+	h := waitEvent(t, a.Events(), events.BackendConnected, user).Host
+	waitEvent(t, b.Events(), events.ExportConnected, user)
+
+	if st := a.importer.ListStatus(); len(st) != 1 || len(st[0].Backends) != 1 || st[0].Backends[0].Host.ID != h.ID {
+		t.Error(
+			"For", "backends after resume",
+			"expected", h.ID,
+			"got", st,
+		)
+	}
+	if reply, err := echo(h); err != nil || reply != "ping\n" {
+		t.Error(
+			"For", "forward after resume",
+			"expected", "ping",
+			"got", reply, err,
+		)
+	}
+}
+
+func TestSSHAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r, err := New(Config{SSHAddr: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.Start(context.Background()); err == nil {
+		t.Error(
+			"For", "SSH address in use",
+			"expected", "error",
+			"got", err,
+		)
+	}
+}
+
+func TestBadHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trafficrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "host_key")
+	if err := ioutil.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(Config{SSHAddr: "127.0.0.1:0", Server: server.Auth{HostKey: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.Start(context.Background()); err == nil {
+		t.Error(
+			"For", "bad host key",
+			"expected", "error",
+			"got", err,
+		)
+	}
+	if addr := r.SSHAddr(); addr != nil {
+		t.Error(
+			"For", "bad host key",
+			"expected", "no SSH server",
+			"got", addr,
+		)
+	}
+}
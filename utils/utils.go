@@ -1,26 +1,156 @@
 package utils
 
 import (
+    "encoding/binary"
     "fmt"
     "os"
     "os/exec"
     "net"
     "strconv"
+    "strings"
     "io"
     "sync"
+    "context"
 
     "github.com/prometheus/common/log"
+    "github.com/microstacks/stack/endpoint/metrics"
 )
 
 
+/*
+ * Global request sent by exporters before "tcpip-forward" to announce the
+ * load balancing weight of their backends. Payload is a uint32.
+ */
+const BackendWeightRequest = "backend-weight@trafficrouter"
+
+/*
+ * UDP forwarding.
+ * UDPForwardRequest asks the router to bind a UDP port, payload and reply
+ * are those of "tcpip-forward". Each client address sending to the port is
+ * a flow carried by a ForwardedUDPChannel, opened by the router with a
+ * "forwarded-tcpip" payload. Datagrams are framed, see WriteDatagram.
+ */
+const (
+    UDPForwardRequest   = "udp-forward@trafficrouter"
+    ForwardedUDPChannel = "forwarded-udp@trafficrouter"
+)
+
+/*
+ * Largest datagram carried over a channel
+ */
+const MaxDatagram = 65535
+
+
 /*
  *  Host Struct is passed from forceCmd to server
  */
 type Host struct {
+    ID          string `json:"id"`      // Unique backend identity, see HostID
     LocalIP     string `json:"laddr"`   // Remote IP 
     LocalPort   uint32 `json:"lport"` // Localhost listening port of reverse tunnel
     RemoteIP    string `json:"raddr"`   // Remote IP 
-    RemotePort  uint32 `json:"rport"`   // Port on which remote host connected
+    RemotePort  uint32 `json:"rport"`   // Port forwarded by the remote host, kept across reconnects
+    Weight      uint32 `json:"weight,omitempty"` // Load balancing weight announced by the exporter
+}
+
+
+/*
+ * HostID builds the unique identity of a forwarded backend from the remote
+ * address of the SSH connection, its session ID and the forwarded port.
+ */
+func HostID(raddr net.Addr, sessionID []byte, port uint32) string {
+    return fmt.Sprintf("%s/%x/%d", raddr.String(), sessionID, port)
+}
+
+
+/*
+ * SplitOptions splits an option of the form spec[,key=value...] into the spec
+ * and its key/value options. Keys without value map to an empty string.
+ */
+func SplitOptions(str string) (string, map[string]string) {
+    parts := strings.Split(str, ",")
+    opts := make(map[string]string, len(parts) - 1)
+
+    for _, kv := range parts[1:] {
+        if kv == "" {
+            continue
+        }
+        idx := strings.Index(kv, "=")
+        if idx < 0 {
+            opts[kv] = ""
+        } else {
+            opts[kv[:idx]] = kv[idx+1:]
+        }
+    }
+
+    return parts[0], opts
+}
+
+
+/*
+ * OptionError reports the field of an --import or --export option at fault.
+ * Field is a part of the spec such as lport or the key of a key=value option.
+ */
+type OptionError struct {
+    Option string // option string as given
+    Field  string
+    Value  string
+    Reason string
+}
+
+func (e *OptionError) Error() string {
+    return fmt.Sprintf("option [%s]: %s %q: %s", e.Option, e.Field, e.Value, e.Reason)
+}
+
+
+/*
+ * ParsePort parses a TCP port, min is the lowest port accepted.
+ * The error is the reason only, callers wrap it into an OptionError.
+ */
+func ParsePort(value string, min int) (uint32, error) {
+    port, err := strconv.Atoi(value)
+    if err != nil {
+        return 0, fmt.Errorf("not a number")
+    }
+    if port < min || port > 65535 {
+        return 0, fmt.Errorf("out of range %d-65535", min)
+    }
+    return uint32(port), nil
+}
+
+
+/*
+ * WriteDatagram writes b as a frame of a UDP channel,
+ * a 2 byte big endian length followed by the datagram.
+ */
+func WriteDatagram(w io.Writer, b []byte) error {
+    if len(b) > MaxDatagram {
+        return fmt.Errorf("datagram of %d bytes too large", len(b))
+    }
+
+    frame := make([]byte, 2 + len(b))
+    binary.BigEndian.PutUint16(frame, uint16(len(b)))
+    copy(frame[2:], b)
+
+    _, err := w.Write(frame)
+    return err
+}
+
+
+/*
+ * ReadDatagram reads the next frame of a UDP channel into buf, which must
+ * hold MaxDatagram bytes, and returns the datagram.
+ */
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+    if _, err := io.ReadFull(r, buf[:2]); err != nil {
+        return nil, err
+    }
+
+    n := int(binary.BigEndian.Uint16(buf))
+    if _, err := io.ReadFull(r, buf[:n]); err != nil {
+        return nil, err
+    }
+    return buf[:n], nil
 }
 
 
@@ -47,27 +177,82 @@ type Endpoint struct {
 }
 
 func (endpoint *Endpoint) String() string {
-	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(int(endpoint.Port)))
 }
 
 
 /* 
  * CopyReadWriters copies biderectionally - output from a to b, and output of b into a. 
+ * a is the connecting peer, bytes are counted as forward traffic.
  * Calls the close function when unable to copy in either direction
  */
 func CopyReadWriters(a, b io.ReadWriter, close func()) {
 	var once sync.Once
 	go func() {
-		io.Copy(a, b)
+		io.Copy(metrics.CountWriter(a, "forward", metrics.Out), b)
 		once.Do(close)
 	}()
 
 	go func() {
-		io.Copy(b, a)
+		io.Copy(metrics.CountWriter(b, "forward", metrics.In), a)
 		once.Do(close)
 	}()
 }
 
+/*
+ * Counter of in-flight connections.
+ * Unlike sync.WaitGroup it is waited for with a context and may be
+ * incremented again at any time, also while a timed out Wait is pending,
+ * so it survives repeated Drain and Resume. The zero value is ready to use.
+ */
+type WaitGroup struct {
+    mu   sync.Mutex
+    n    int
+    idle chan struct{} // closed when n drops to 0
+}
+
+func (wg *WaitGroup) Add(delta int) {
+    wg.mu.Lock()
+    defer wg.mu.Unlock()
+
+    if wg.n == 0 && delta > 0 {
+        wg.idle = make(chan struct{})
+    }
+
+    wg.n += delta
+    if wg.n < 0 {
+        panic("utils: negative WaitGroup counter")
+    }
+    if wg.n == 0 && wg.idle != nil {
+        close(wg.idle)
+        wg.idle = nil
+    }
+}
+
+func (wg *WaitGroup) Done() {
+    wg.Add(-1)
+}
+
+/*
+ * Wait until the counter is 0 or ctx is done, whatever comes first.
+ */
+func (wg *WaitGroup) Wait(ctx context.Context) error {
+    wg.mu.Lock()
+    idle := wg.idle
+    wg.mu.Unlock()
+
+    if idle == nil {
+        return nil
+    }
+
+    select {
+    case <-idle:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
 /* 
  * Extract port from Address
  */
@@ -103,7 +288,8 @@ func GetIP(iface string) (*net.IPAddr) {
     ip := []byte{127,0,0,1}
 
     if iface == "*" {
-        ip = []byte{0,0,0,0}
+        // Unspecified IPv6 address listens on IPv4 too
+        ip = net.IPv6unspecified
     } else if len(iface) > 0 {
         ief, err := net.InterfaceByName(iface)
 
@@ -123,37 +309,33 @@ func GetIP(iface string) (*net.IPAddr) {
     return ipAddr
 }
 
+/*
+ * Hook scripts run on service connect and disconnect, skipped when missing
+ */
+var OnConnectHook = "/var/lib/dupper/onconnect"
+var OnDisconnectHook = "/var/lib/dupper/ondisconnect"
+
 /*
  * Execute on-connect code
  */
 func OnConnect(rhost string, rport string, lhost string, lport string) {
-    if _, err := os.Stat("/var/lib/dupper/onconnect"); !os.IsNotExist(err) {
-        cmd := "bash"
-        args := []string{"/var/lib/dupper/onconnect",}
-
-        c := exec.Command(cmd, args...)
-        env := os.Environ()
-        env = append(env, fmt.Sprintf("REMOTEHOST=%s", rhost))
-        env = append(env, fmt.Sprintf("REMOTEPORT=%s", rport))
-        env = append(env, fmt.Sprintf("LOCALHOST=%s", lhost))
-        env = append(env, fmt.Sprintf("LOCALPORT=%s", lport))
-        c.Env = env
-        c.Stdout = os.Stdout
-        c.Stderr = os.Stderr
-        err = c.Run()
-        if err != nil {
-            log.Error(err)
-        }
-    }
+    RunHook(OnConnectHook, rhost, rport, lhost, lport)
 }
 
 /*
  * Execute on-disconnect code
  */
 func OnDisconnect(rhost string, rport string, lhost string, lport string) {
-    if _, err := os.Stat("/var/lib/dupper/ondisconnect"); !os.IsNotExist(err) {
+    RunHook(OnDisconnectHook, rhost, rport, lhost, lport)
+}
+
+/*
+ * Execute hook script with bash if it exists
+ */
+func RunHook(path string, rhost string, rport string, lhost string, lport string) {
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
         cmd := "bash"
-        args := []string{"/var/lib/dupper/ondisconnect",}
+        args := []string{path,}
 
         c := exec.Command(cmd, args...)
         env := os.Environ()
@@ -0,0 +1,80 @@
+package utils
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestHostID(t *testing.T) {
+    // Two sessions of the same exporter, reconnected from the same address
+    raddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40022}
+    first := HostID(raddr, []byte{0x01, 0x02}, 8080)
+    second := HostID(raddr, []byte{0x03, 0x04}, 8080)
+
+    if first == second {
+        t.Error(
+            "For", "sessions from " + raddr.String(),
+            "expected", "different IDs",
+            "got", first, second,
+        )
+    }
+
+    if id := HostID(raddr, []byte{0x01, 0x02}, 8080); id != first {
+        t.Error(
+            "For", "same session",
+            "expected", first,
+            "got", id,
+        )
+    }
+
+    if id := HostID(raddr, []byte{0x01, 0x02}, 8081); id == first {
+        t.Error(
+            "For", "other port of the session",
+            "expected", "different ID",
+            "got", id,
+        )
+    }
+
+    expected := "10.0.0.2:40022/0102/8080"
+    if first != expected {
+        t.Error(
+            "For", "format",
+            "expected", expected,
+            "got", first,
+        )
+    }
+}
+
+func TestWaitGroup(t *testing.T) {
+    var wg WaitGroup
+
+    if err := wg.Wait(context.Background()); err != nil {
+        t.Error("For", "idle", "expected", nil, "got", err)
+    }
+
+    // Timed out Wait, then the group is used again as after Resume
+    wg.Add(1)
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    if err := wg.Wait(ctx); err != context.DeadlineExceeded {
+        t.Error("For", "busy", "expected", context.DeadlineExceeded, "got", err)
+    }
+
+    wg.Add(1)
+    wg.Done()
+    wg.Done()
+    if err := wg.Wait(context.Background()); err != nil {
+        t.Error("For", "done", "expected", nil, "got", err)
+    }
+
+    wg.Add(1)
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        wg.Done()
+    }()
+    if err := wg.Wait(context.Background()); err != nil {
+        t.Error("For", "reused", "expected", nil, "got", err)
+    }
+}